@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/warm-metal/csi-driver-configmap/pkg/cmmouter"
 	"github.com/warm-metal/csi-drivers/pkg/csi-common"
 	"k8s.io/klog/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var (
@@ -13,6 +20,25 @@ var (
 	nodeID     = flag.String("node", "", "node ID")
 	sourceRoot = flag.String("cm-source-root", "/var/lib/warm-metal/cm-volume",
 		"Directory to save directories and files populated from ConfigMaps")
+	authorizeMounts = flag.Bool("authorize-mounts", true,
+		"Check whether ServiceAccounts of pods are allowed to access ConfigMaps they mount. "+
+			"ConfigMaps in other namespaces must be shared with pods anyway")
+	tokenAudience = flag.String("token-audience", "",
+		"Audience of ServiceAccount tokens passed by kubelet for volumes using pod identities")
+	templateEnv = flag.String("template-env", "",
+		"Environment variables, separated by commas, which templates can refer to as .Env")
+	metricsAddr = flag.String("metrics-address", "",
+		"Address to serve Prometheus metrics on, e.g. \":9090\". Metrics are disabled if not set")
+	kubeconfig = flag.String("kubeconfig", "",
+		"Path to the kubeconfig to run out of the cluster. The in-cluster config is used if neither it nor --master is set")
+	master          = flag.String("master", "", "Address of the API server, which overrides the one in the kubeconfig")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second,
+		"Time to wait for in-flight requests, and then for commits of local changes, on SIGTERM")
+	gcInterval = flag.Duration("gc-interval", 10*time.Minute,
+		"Interval to remove stale volumes of which pods are gone or targets are not mounted. 0 disables it")
+	gcGracePeriod = flag.Duration("gc-grace-period", 5*time.Minute,
+		"Time volumes keep stale before being removed by the garbage collector")
+	gcDryRun = flag.Bool("gc-dry-run", false, "Only report stale volumes in logs rather than removing them")
 )
 
 const (
@@ -36,6 +62,20 @@ func main() {
 		csi.ControllerServiceCapability_RPC_UNKNOWN,
 	})
 
+	if len(*metricsAddr) > 0 {
+		go serveMetrics(*metricsAddr)
+	}
+
+	mounter := cmmouter.NewMounterOrDie(*kubeconfig, *master, cmmouter.MounterOptions{
+		SourceRoot:      *sourceRoot,
+		Node:            *nodeID,
+		AuthorizeMounts: *authorizeMounts,
+		TemplateEnv:     listOf(*templateEnv),
+		GCInterval:      *gcInterval,
+		GCGracePeriod:   *gcGracePeriod,
+		GCDryRun:        *gcDryRun,
+	})
+
 	server := csicommon.NewNonBlockingGRPCServer()
 
 	server.Start(*endpoint,
@@ -43,8 +83,38 @@ func main() {
 		&controllerServer{csicommon.NewDefaultControllerServer(driver)},
 		&nodeServer{
 			DefaultNodeServer: csicommon.NewDefaultNodeServer(driver),
-			mounter:           cmmouter.NewMounterOrDie(*sourceRoot),
+			mounter:           mounter,
+			tokenAudience:     *tokenAudience,
 		},
 	)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		klog.Infof("received %s. stop accepting requests", sig)
+		// Requests in progress are canceled if they don't finish in time.
+		timer := time.AfterFunc(*shutdownTimeout, server.ForceStop)
+		server.Stop()
+		timer.Stop()
+	}()
+
 	server.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := mounter.Stop(ctx); err != nil {
+		klog.Errorf("unable to stop the mounter: %s", err)
+	}
+
+	klog.Info("the plugin is stopped")
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	klog.Infof("serving metrics on %q", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		klog.Errorf("unable to serve metrics on %q: %s", addr, err)
+	}
 }
@@ -2,18 +2,24 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/warm-metal/csi-driver-configmap/pkg/cmmouter"
 	"github.com/warm-metal/csi-drivers/pkg/csi-common"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
 	mounter *cmmouter.Mounter
+	// audience of ServiceAccount tokens to use if pod identity is enabled
+	tokenAudience string
 }
 
 func (n nodeServer) NodeStageVolume(context.Context, *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
@@ -36,10 +42,195 @@ const (
 	ctxKeyCommitChangesOn   = "commitChangesOn"
 	ctxKeyConflictPolicy    = "conflictPolicy"
 	ctxKeyOversizePolicy    = "oversizePolicy"
+	ctxKeyBinaryOversize    = "binaryOversizePolicy"
+	ctxKeyVersionPointer    = "versionPointer"
+	ctxKeyConfigMapRef      = "configMapRef"
+	ctxKeyUsePodIdentity    = "usePodIdentity"
+	ctxKeyItems             = "items"
+	ctxKeyInclude           = "include"
+	ctxKeyExclude           = "exclude"
+	ctxKeyDefaultMode       = "defaultMode"
+	ctxKeyUID               = "uid"
+	ctxKeyGID               = "gid"
+	ctxKeyRender            = "render"
+	ctxKeyFormat            = "format"
+	ctxKeyFileName          = "fileName"
+	ctxKeyValidate          = "validate"
+	ctxKeyPinRV             = "pinResourceVersion"
+	ctxKeyPinContentHash    = "pinContentHash"
+	ctxKeyRetainRevisions   = "retainRevisions"
+	ctxKeyNotifyFile        = "notifyFile"
+	ctxKeyNotifyFIFO        = "notifyFIFO"
+	ctxKeyNotifyHTTP        = "notifyHTTP"
+	ctxKeyUpdateDelay       = "updateDelay"
+	ctxKeyUpdateJitter      = "updateJitter"
+	ctxKeyRolloutWaves      = "rolloutWaves"
+	ctxKeyWaveInterval      = "waveInterval"
+	ctxKeyEnforceContent    = "enforceContent"
+	ctxKeyReadOnly          = "readOnly"
 	ctxKeyPodNamespace      = "csi.storage.k8s.io/pod.namespace"
 	ctxKeyPodName           = "csi.storage.k8s.io/pod.name"
+	ctxKeyPodUID            = "csi.storage.k8s.io/pod.uid"
+	ctxKeyServiceAccount    = "csi.storage.k8s.io/serviceAccount.name"
+	ctxKeyTokens            = "csi.storage.k8s.io/serviceAccount.tokens"
 )
 
+type serviceAccountToken struct {
+	Token string `json:"token"`
+}
+
+// tokenOf returns the ServiceAccount token of the audience if tokenRequests of the CSIDriver is set.
+func tokenOf(tokens, audience string) (string, error) {
+	if len(tokens) == 0 {
+		return "", nil
+	}
+
+	tokenMap := make(map[string]serviceAccountToken)
+	if err := json.Unmarshal([]byte(tokens), &tokenMap); err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "invalid ServiceAccount tokens: %s", err)
+	}
+
+	return tokenMap[audience].Token, nil
+}
+
+// itemsOf parses items in either JSON or YAML.
+func itemsOf(items string) ([]cmmouter.KeyToPath, error) {
+	if len(items) == 0 {
+		return nil, nil
+	}
+
+	var keyPaths []cmmouter.KeyToPath
+	if err := yaml.Unmarshal([]byte(items), &keyPaths); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid items: %s", err)
+	}
+
+	return keyPaths, nil
+}
+
+// validatorsOf parses validators in either JSON or YAML.
+func validatorsOf(validators string) ([]cmmouter.ValueValidator, error) {
+	if len(validators) == 0 {
+		return nil, nil
+	}
+
+	var list []cmmouter.ValueValidator
+	if err := yaml.Unmarshal([]byte(validators), &list); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid validate: %s", err)
+	}
+
+	return list, nil
+}
+
+// int64Of parses the attribute if set. Octal numbers with a leading "0" are accepted.
+func int64Of(key, v string, bitSize int) (*int64, error) {
+	if len(v) == 0 {
+		return nil, nil
+	}
+
+	i, err := strconv.ParseInt(v, 0, bitSize)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s %q: %s", key, v, err)
+	}
+
+	return &i, nil
+}
+
+// durationOf parses the attribute like "30s" if set.
+func durationOf(key, v string) (time.Duration, error) {
+	if len(v) == 0 {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid %s %q: %s", key, v, err)
+	}
+
+	return d, nil
+}
+
+// intsOf parses comma-separated integers.
+func intsOf(key, values string) (list []int, err error) {
+	for _, v := range listOf(values) {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s %q: %s", key, values, err)
+		}
+
+		list = append(list, i)
+	}
+
+	return
+}
+
+// listOf splits comma-separated values.
+func listOf(values string) (list []string) {
+	for _, v := range strings.Split(values, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			list = append(list, v)
+		}
+	}
+
+	return
+}
+
+func (n nodeServer) NodeGetCapabilities(context.Context, *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: []*csi.NodeServiceCapability{
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// NodeGetVolumeStats reports usage of the volume. The volume is abnormal if local content drifts from the ConfigMap.
+func (n nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	stats, err := n.mounter.VolumeStats(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Used:      stats.UsedBytes,
+				Total:     stats.TotalBytes,
+				Available: stats.AvailableBytes,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Used:      stats.UsedInodes,
+				Total:     stats.TotalInodes,
+				Available: stats.AvailableInodes,
+			},
+		},
+		VolumeCondition: &csi.VolumeCondition{
+			Abnormal: stats.Abnormal,
+			Message:  stats.Message,
+		},
+	}, nil
+}
+
 func (n *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (resp *csi.NodePublishVolumeResponse, err error) {
 	klog.Infof("request: %s", req.String())
 	podNs := req.VolumeContext[ctxKeyPodNamespace]
@@ -48,14 +239,119 @@ func (n *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 		ns = podNs
 	}
 
+	token, err := tokenOf(req.VolumeContext[ctxKeyTokens], n.tokenAudience)
+	if err != nil {
+		return
+	}
+
+	items, err := itemsOf(req.VolumeContext[ctxKeyItems])
+	if err != nil {
+		return
+	}
+
+	validators, err := validatorsOf(req.VolumeContext[ctxKeyValidate])
+	if err != nil {
+		return
+	}
+
+	mode, err := int64Of(ctxKeyDefaultMode, req.VolumeContext[ctxKeyDefaultMode], 32)
+	if err != nil {
+		return
+	}
+
+	var defaultMode *int32
+	if mode != nil {
+		m := int32(*mode)
+		defaultMode = &m
+	}
+
+	uid, err := int64Of(ctxKeyUID, req.VolumeContext[ctxKeyUID], 64)
+	if err != nil {
+		return
+	}
+
+	gid, err := int64Of(ctxKeyGID, req.VolumeContext[ctxKeyGID], 64)
+	if err != nil {
+		return
+	}
+
+	updateDelay, err := durationOf(ctxKeyUpdateDelay, req.VolumeContext[ctxKeyUpdateDelay])
+	if err != nil {
+		return
+	}
+
+	updateJitter, err := durationOf(ctxKeyUpdateJitter, req.VolumeContext[ctxKeyUpdateJitter])
+	if err != nil {
+		return
+	}
+
+	waveInterval, err := durationOf(ctxKeyWaveInterval, req.VolumeContext[ctxKeyWaveInterval])
+	if err != nil {
+		return
+	}
+
+	waves, err := intsOf(ctxKeyRolloutWaves, req.VolumeContext[ctxKeyRolloutWaves])
+	if err != nil {
+		return
+	}
+
+	retainRevisions, err := int64Of(ctxKeyRetainRevisions, req.VolumeContext[ctxKeyRetainRevisions], 32)
+	if err != nil {
+		return
+	}
+
+	var retained int
+	if retainRevisions != nil {
+		retained = int(*retainRevisions)
+	}
+
+	fsGroup, err := int64Of("volumeMountGroup", req.GetVolumeCapability().GetMount().GetVolumeMountGroup(), 64)
+	if err != nil {
+		return
+	}
+
 	err = n.mounter.Mount(ctx, req.VolumeId, req.TargetPath,
-		req.VolumeContext[ctxKeyConfigMap], ns, req.VolumeContext[ctxKeyPodName], podNs,
+		req.VolumeContext[ctxKeyConfigMap], ns,
+		cmmouter.PodInfo{
+			Pod:            req.VolumeContext[ctxKeyPodName],
+			PodNamespace:   podNs,
+			PodUID:         req.VolumeContext[ctxKeyPodUID],
+			ServiceAccount: req.VolumeContext[ctxKeyServiceAccount],
+			FSGroup:        fsGroup,
+			Token:          token,
+		},
 		cmmouter.ConfigMapOptions{
-			SubPath:           req.VolumeContext[ctxKeySubPath],
-			KeepCurrentAlways: strings.ToLower(req.VolumeContext[ctxKeyKeepCurrentAlways]) == "true",
-			CommitChangesOn:   cmmouter.ConditionCommitChanges(req.VolumeContext[ctxKeyCommitChangesOn]),
-			ConflictPolicy:    cmmouter.ConfigMapConflictPolicy(req.VolumeContext[ctxKeyConflictPolicy]),
-			OversizePolicy:    cmmouter.ConfigMapOversizePolicy(req.VolumeContext[ctxKeyOversizePolicy]),
+			SubPath:              req.VolumeContext[ctxKeySubPath],
+			KeepCurrentAlways:    strings.ToLower(req.VolumeContext[ctxKeyKeepCurrentAlways]) == "true",
+			CommitChangesOn:      cmmouter.ConditionCommitChanges(req.VolumeContext[ctxKeyCommitChangesOn]),
+			ConflictPolicy:       cmmouter.ConfigMapConflictPolicy(req.VolumeContext[ctxKeyConflictPolicy]),
+			OversizePolicy:       cmmouter.ConfigMapOversizePolicy(req.VolumeContext[ctxKeyOversizePolicy]),
+			BinaryOversizePolicy: cmmouter.ConfigMapBinaryOversizePolicy(req.VolumeContext[ctxKeyBinaryOversize]),
+			VersionPointer:       req.VolumeContext[ctxKeyVersionPointer],
+			ConfigMapRef:         cmmouter.ConfigMapRefMode(strings.ToLower(req.VolumeContext[ctxKeyConfigMapRef])),
+			UsePodIdentity:       strings.ToLower(req.VolumeContext[ctxKeyUsePodIdentity]) == "true",
+			Items:                items,
+			Include:              listOf(req.VolumeContext[ctxKeyInclude]),
+			Exclude:              listOf(req.VolumeContext[ctxKeyExclude]),
+			DefaultMode:          defaultMode,
+			UID:                  uid,
+			GID:                  gid,
+			Render:               cmmouter.ConfigMapRenderMode(req.VolumeContext[ctxKeyRender]),
+			Format:               cmmouter.ConfigMapFormat(req.VolumeContext[ctxKeyFormat]),
+			FileName:             req.VolumeContext[ctxKeyFileName],
+			Validate:             validators,
+			PinResourceVersion:   req.VolumeContext[ctxKeyPinRV],
+			PinContentHash:       req.VolumeContext[ctxKeyPinContentHash],
+			RetainRevisions:      retained,
+			NotifyFile:           req.VolumeContext[ctxKeyNotifyFile],
+			NotifyFIFO:           req.VolumeContext[ctxKeyNotifyFIFO],
+			NotifyHTTP:           req.VolumeContext[ctxKeyNotifyHTTP],
+			UpdateDelay:          updateDelay,
+			UpdateJitter:         updateJitter,
+			RolloutWaves:         waves,
+			WaveInterval:         waveInterval,
+			EnforceContent:       strings.ToLower(req.VolumeContext[ctxKeyEnforceContent]) == "true",
+			ReadOnly:             cmmouter.ConfigMapReadOnlyPolicy(strings.ToLower(req.VolumeContext[ctxKeyReadOnly])),
 		},
 		req.Readonly,
 	)
@@ -0,0 +1,156 @@
+package cmmouter
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"strings"
+)
+
+const (
+	// annotationSharedWith on a ConfigMap or its namespace lists namespaces, separated by commas, which are allowed to
+	// mount the ConfigMap. "*" means all namespaces.
+	annotationSharedWith = "csi-cm.warm-metal.tech/shared-with"
+	// labelShared on a ConfigMap or its namespace with the value "true" shares the ConfigMap with all namespaces.
+	labelShared = "csi-cm.warm-metal.tech/shared"
+)
+
+// authorizeMount checks whether a ConfigMap in other namespaces is shared with the pod namespace explicitly, which is
+// always enforced. If mounts are reviewed, it also checks whether the ServiceAccount of the pod can read the ConfigMap,
+// and update it if commitChangesOn is enabled. Committing to immutable ConfigMaps requires creating new versions and
+// updating the pointer instead. Committing binary keys to shards requires creating and deleting shards.
+func (m *volumeMap) authorizeMount(ctx context.Context, cm *corev1.ConfigMap, pod *PodInfo, opts *ConfigMapOptions) error {
+	if cm.Namespace != pod.PodNamespace {
+		shared, err := m.isSharedWith(ctx, cm, pod.PodNamespace)
+		if err != nil {
+			return err
+		}
+
+		if !shared {
+			return status.Errorf(codes.PermissionDenied, "configmap %s/%s is not shared with namespace %q",
+				cm.Namespace, cm.Name, pod.PodNamespace)
+		}
+	}
+
+	if !m.authorizeMounts {
+		return nil
+	}
+
+	if len(pod.ServiceAccount) == 0 {
+		p, err := m.clientset.CoreV1().Pods(pod.PodNamespace).Get(ctx, pod.Pod, metav1.GetOptions{})
+		if err != nil {
+			recordAPIError("pods", "get")
+			klog.Errorf("unable to fetch pod %s/%s: %s", pod.PodNamespace, pod.Pod, err)
+			return status.Error(codes.Unavailable, err.Error())
+		}
+
+		pod.ServiceAccount = p.Spec.ServiceAccountName
+		if len(pod.ServiceAccount) == 0 {
+			pod.ServiceAccount = "default"
+		}
+	}
+
+	verbs := []string{"get"}
+	if opts.CommitChangesOn != NoCommit {
+		if isImmutable(cm) {
+			// Changes of immutable ConfigMaps are committed as new versions.
+			verbs = append(verbs, "create")
+		} else {
+			verbs = append(verbs, "update")
+		}
+	}
+
+	for _, verb := range verbs {
+		if err := m.reviewAccess(ctx, cm, pod, verb); err != nil {
+			return err
+		}
+	}
+
+	if opts.CommitChangesOn != NoCommit && opts.BinaryOversizePolicy == ShardBinary {
+		// Shards are named after their content, so creation can't be restricted to certain names.
+		shards := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: cm.Namespace}}
+		for _, verb := range []string{"create", "delete"} {
+			if err := m.reviewAccess(ctx, shards, pod, verb); err != nil {
+				return err
+			}
+		}
+	}
+
+	if opts.CommitChangesOn != NoCommit && isImmutable(cm) {
+		pointer := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: opts.VersionPointer, Namespace: cm.Namespace}}
+		return m.reviewAccess(ctx, pointer, pod, "update")
+	}
+
+	return nil
+}
+
+func (m *volumeMap) isSharedWith(ctx context.Context, cm *corev1.ConfigMap, podNs string) (bool, error) {
+	if sharedWith(cm.ObjectMeta, podNs) {
+		return true, nil
+	}
+
+	ns, err := m.clientset.CoreV1().Namespaces().Get(ctx, cm.Namespace, metav1.GetOptions{})
+	if err != nil {
+		recordAPIError("namespaces", "get")
+		klog.Errorf("unable to fetch namespace %q: %s", cm.Namespace, err)
+		return false, status.Error(codes.Unavailable, err.Error())
+	}
+
+	return sharedWith(ns.ObjectMeta, podNs), nil
+}
+
+func sharedWith(obj metav1.ObjectMeta, podNs string) bool {
+	if obj.Labels[labelShared] == "true" {
+		return true
+	}
+
+	for _, ns := range strings.Split(obj.Annotations[annotationSharedWith], ",") {
+		ns = strings.TrimSpace(ns)
+		if ns == "*" || ns == podNs {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *volumeMap) reviewAccess(ctx context.Context, cm *corev1.ConfigMap, pod *PodInfo, verb string) error {
+	review := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: cm.Namespace,
+				Verb:      verb,
+				Resource:  "configmaps",
+				Name:      cm.Name,
+			},
+			User: fmt.Sprintf("system:serviceaccount:%s:%s", pod.PodNamespace, pod.ServiceAccount),
+			Groups: []string{
+				"system:serviceaccounts",
+				"system:serviceaccounts:" + pod.PodNamespace,
+				"system:authenticated",
+			},
+		},
+	}
+
+	result, err := m.clientset.AuthorizationV1().SubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		recordAPIError("subjectaccessreviews", "create")
+		klog.Errorf("unable to review access of pod %s/%s to configmap %s/%s: %s", pod.PodNamespace, pod.Pod,
+			cm.Namespace, cm.Name, err)
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	if !result.Status.Allowed {
+		klog.Errorf("serviceaccount %s/%s is not allowed to %s configmap %s/%s: %s", pod.PodNamespace,
+			pod.ServiceAccount, verb, cm.Namespace, cm.Name, result.Status.Reason)
+		return status.Errorf(codes.PermissionDenied, "serviceaccount %s/%s is not allowed to %s configmap %s/%s",
+			pod.PodNamespace, pod.ServiceAccount, verb, cm.Namespace, cm.Name)
+	}
+
+	return nil
+}
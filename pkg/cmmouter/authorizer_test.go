@@ -0,0 +1,62 @@
+package cmmouter
+
+import (
+	"context"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"reflect"
+	"testing"
+)
+
+func TestSharedWith(t *testing.T) {
+	cases := []struct {
+		meta   metav1.ObjectMeta
+		shared bool
+	}{
+		{metav1.ObjectMeta{}, false},
+		{metav1.ObjectMeta{Labels: map[string]string{labelShared: "true"}}, true},
+		{metav1.ObjectMeta{Labels: map[string]string{labelShared: "false"}}, false},
+		{metav1.ObjectMeta{Annotations: map[string]string{annotationSharedWith: "*"}}, true},
+		{metav1.ObjectMeta{Annotations: map[string]string{annotationSharedWith: "foo, bar"}}, true},
+		{metav1.ObjectMeta{Annotations: map[string]string{annotationSharedWith: "foo,baz"}}, false},
+	}
+
+	for i, c := range cases {
+		if sharedWith(c.meta, "bar") != c.shared {
+			t.Errorf("case %d: expect %v", i, c.shared)
+		}
+	}
+}
+
+func TestAuthorizeShards(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	var reviewed []string
+	clientset.PrependReactor("create", "subjectaccessreviews",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+			attrs := review.Spec.ResourceAttributes
+			reviewed = append(reviewed, attrs.Verb+" "+attrs.Name)
+			review.Status.Allowed = true
+			return true, review, nil
+		})
+
+	m := &volumeMap{clientset: clientset, authorizeMounts: true}
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "cm-foo", Namespace: "foo"}}
+	pod := &PodInfo{Pod: "pod-0", PodNamespace: "foo", ServiceAccount: "default"}
+	err := m.authorizeMount(context.TODO(), cm, pod, &ConfigMapOptions{
+		CommitChangesOn:      CommitOnUnmount,
+		BinaryOversizePolicy: ShardBinary,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"get cm-foo", "update cm-foo", "create ", "delete "}
+	if !reflect.DeepEqual(reviewed, expected) {
+		t.Errorf("expect reviews %q, but got %q", expected, reviewed)
+	}
+}
@@ -0,0 +1,386 @@
+package cmmouter
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// annotationShards maps keys of BinaryData moved to shards to their shard ConfigMaps, in JSON.
+	annotationShards = "csi-cm.warm-metal.tech/shards"
+	// labelShardOf is the name of the ConfigMap which the shard belongs to.
+	labelShardOf = "csi-cm.warm-metal.tech/shard-of"
+)
+
+// shardRef is the shard ConfigMap of a key and the digest of the value saved in it.
+type shardRef struct {
+	ConfigMap string `json:"configMap"`
+	Digest    string `json:"digest"`
+}
+
+func shardsOf(cm *corev1.ConfigMap) (map[string]shardRef, error) {
+	annotation, found := cm.Annotations[annotationShards]
+	if !found {
+		return nil, nil
+	}
+
+	shards := make(map[string]shardRef)
+	if err := json.Unmarshal([]byte(annotation), &shards); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "invalid annotation %q of configmap %s/%s: %s",
+			annotationShards, cm.Namespace, cm.Name, err)
+	}
+
+	return shards, nil
+}
+
+// shardNameOf returns the name of the shard saving the value of the key. Names are versioned by the digest of values
+// so that shards referred by the ConfigMap are never overwritten before the ConfigMap is updated.
+func shardNameOf(cm *corev1.ConfigMap, key, digest string) string {
+	keyDigest := sha256.Sum256([]byte(key))
+	return cm.Name + "-shard-" + hex.EncodeToString(keyDigest[:])[:10] + "-" + digest[:10]
+}
+
+// mergeShards returns a copy of the ConfigMap along with BinaryData saved in its shards.
+func mergeShards(ctx context.Context, clientset kubernetes.Interface, cm *corev1.ConfigMap) (
+	*corev1.ConfigMap, error,
+) {
+	shards, err := shardsOf(cm)
+	if err != nil || len(shards) == 0 {
+		return cm, err
+	}
+
+	merged := cm.DeepCopy()
+	if merged.BinaryData == nil {
+		merged.BinaryData = make(map[string][]byte, len(shards))
+	}
+
+	for k, ref := range shards {
+		shard, err := clientset.CoreV1().ConfigMaps(cm.Namespace).Get(ctx, ref.ConfigMap, metav1.GetOptions{})
+		if err != nil {
+			recordAPIError("configmaps", "get")
+			klog.Errorf("unable to fetch shard %q of configmap %s/%s: %s", ref.ConfigMap, cm.Namespace, cm.Name, err)
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+
+		merged.BinaryData[k] = shard.BinaryData[k]
+	}
+
+	return merged, nil
+}
+
+// saveShard creates the shard ConfigMap of the value of the key if it doesn't exist. Shards are owned by the ConfigMap.
+// It returns whether the shard is created.
+func saveShard(ctx context.Context, clientset kubernetes.Interface, cm *corev1.ConfigMap, key string, value []byte) (
+	*shardRef, bool, error,
+) {
+	ref := &shardRef{Digest: digestOf(value)}
+	ref.ConfigMap = shardNameOf(cm, key, ref.Digest)
+	shard := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ref.ConfigMap,
+			Namespace: cm.Namespace,
+			Labels:    map[string]string{labelShardOf: cm.Name},
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: "v1",
+					Kind:       "ConfigMap",
+					Name:       cm.Name,
+					UID:        cm.UID,
+				},
+			},
+		},
+		BinaryData: map[string][]byte{key: value},
+	}
+
+	_, err := clientset.CoreV1().ConfigMaps(cm.Namespace).Create(ctx, shard, metav1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		// The same value is saved in the shard.
+		return ref, false, nil
+	}
+
+	if err != nil {
+		recordAPIError("configmaps", "create")
+		klog.Errorf("unable to save key %q of configmap %s/%s in shard %q: %s", key, cm.Namespace, cm.Name,
+			shard.Name, err)
+		return nil, false, err
+	}
+
+	klog.Infof("key %q of configmap %s/%s is saved in shard %q", key, cm.Namespace, cm.Name, shard.Name)
+	return ref, true, nil
+}
+
+// deleteShards removes shard ConfigMaps. Shards left behind are removed along with the ConfigMap.
+func deleteShards(ctx context.Context, clientset kubernetes.Interface, ns string, names []string) {
+	for _, name := range names {
+		err := clientset.CoreV1().ConfigMaps(ns).Delete(ctx, name, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			recordAPIError("configmaps", "delete")
+			klog.Errorf("unable to delete shard %s/%s: %s", ns, name, err)
+			continue
+		}
+
+		klog.Infof("shard %s/%s is deleted", ns, name)
+	}
+}
+
+// binaryCommit is the outcome of committing local changes of BinaryData.
+type binaryCommit struct {
+	// BinaryData saved in the ConfigMap and its size
+	data map[string][]byte
+	size int
+	// values of all keys saved in shards, and keys of which shards are to be updated
+	shards        map[string][]byte
+	updatedShards []string
+	// committed keys and keys of which local changes are dropped
+	keys    []string
+	dropped []string
+	// shards created by saveShards, and shards not referred anymore
+	createdShards []string
+	staleShards   []string
+}
+
+// commitBinaryData applies local changes in volData to BinaryData including values saved in shards. Keys of
+// BinaryData are removed from volData. If the ConfigMap would exceed the size limit, changes growing the most are
+// dropped, or moved to shards under the ShardBinary policy, one by one until the rest fits. textSize is the size of
+// the original Data.
+func commitBinaryData(
+	binaryData, volData map[string][]byte, shards map[string]shardRef, textSize int,
+	policy ConfigMapBinaryOversizePolicy,
+) *binaryCommit {
+	c := &binaryCommit{
+		data:   make(map[string][]byte, len(binaryData)),
+		size:   textSize,
+		shards: make(map[string][]byte, len(shards)),
+	}
+
+	var found, changed []string
+	for k, v := range binaryData {
+		newV, ok := volData[k]
+		delete(volData, k)
+		if ok {
+			found = append(found, k)
+		}
+
+		if _, sharded := shards[k]; sharded {
+			c.shards[k] = v
+			if ok && !bytes.Equal(newV, v) {
+				if len(newV) > configMapSizeHardLimit {
+					c.dropped = append(c.dropped, k)
+					continue
+				}
+
+				c.shards[k] = newV
+				c.updatedShards = append(c.updatedShards, k)
+			}
+
+			continue
+		}
+
+		c.data[k] = v
+		if ok && !bytes.Equal(newV, v) {
+			c.data[k] = newV
+			changed = append(changed, k)
+		}
+
+		c.size += len(c.data[k])
+	}
+
+	growthOf := func(k string) int { return len(c.data[k]) - len(binaryData[k]) }
+	sort.Slice(changed, func(i, j int) bool {
+		if gi, gj := growthOf(changed[i]), growthOf(changed[j]); gi != gj {
+			return gi > gj
+		}
+
+		return changed[i] < changed[j]
+	})
+
+	for _, k := range changed {
+		if c.size <= configMapSizeHardLimit {
+			break
+		}
+
+		c.size -= len(c.data[k])
+		if policy == ShardBinary && len(c.data[k]) <= configMapSizeHardLimit {
+			c.shards[k] = c.data[k]
+			c.updatedShards = append(c.updatedShards, k)
+			delete(c.data, k)
+			continue
+		}
+
+		c.data[k] = binaryData[k]
+		c.size += len(c.data[k])
+		c.dropped = append(c.dropped, k)
+	}
+
+	c.size -= textSize
+	dropped := make(map[string]bool, len(c.dropped))
+	for _, k := range c.dropped {
+		dropped[k] = true
+	}
+
+	for _, k := range found {
+		if !dropped[k] {
+			c.keys = append(c.keys, k)
+		}
+	}
+
+	sort.Strings(c.dropped)
+	sort.Strings(c.updatedShards)
+	return c
+}
+
+// saveShards creates shards of updated keys and records all shards in the annotation of the ConfigMap. Shards
+// previously referred are kept until the ConfigMap is updated.
+func (c *binaryCommit) saveShards(
+	ctx context.Context, clientset kubernetes.Interface, cm *corev1.ConfigMap, shards map[string]shardRef,
+) error {
+	refs := make(map[string]shardRef, len(c.shards))
+	for k := range c.shards {
+		refs[k] = shards[k]
+	}
+
+	c.createdShards = c.createdShards[:0]
+	for _, k := range c.updatedShards {
+		ref, created, err := saveShard(ctx, clientset, cm, k, c.shards[k])
+		if err != nil {
+			c.rollbackShards(ctx, clientset, cm.Namespace)
+			return err
+		}
+
+		if created {
+			c.createdShards = append(c.createdShards, ref.ConfigMap)
+		}
+
+		refs[k] = *ref
+	}
+
+	referred := make(map[string]bool, len(refs))
+	for _, ref := range refs {
+		referred[ref.ConfigMap] = true
+	}
+
+	c.staleShards = c.staleShards[:0]
+	for _, ref := range shards {
+		if !referred[ref.ConfigMap] {
+			c.staleShards = append(c.staleShards, ref.ConfigMap)
+		}
+	}
+
+	sort.Strings(c.staleShards)
+	if len(refs) == 0 {
+		delete(cm.Annotations, annotationShards)
+		return nil
+	}
+
+	annotation, err := json.Marshal(refs)
+	if err != nil {
+		return err
+	}
+
+	if cm.Annotations == nil {
+		cm.Annotations = make(map[string]string, 1)
+	}
+
+	cm.Annotations[annotationShards] = string(annotation)
+	return nil
+}
+
+// rollbackShards removes shards created by saveShards if the ConfigMap isn't updated.
+func (c *binaryCommit) rollbackShards(ctx context.Context, clientset kubernetes.Interface, ns string) {
+	deleteShards(ctx, clientset, ns, c.createdShards)
+	c.createdShards = c.createdShards[:0]
+}
+
+// changed checks whether the commit changes BinaryData or shards of the ConfigMap.
+func (c *binaryCommit) changed(cm *corev1.ConfigMap, shards map[string]shardRef) bool {
+	if len(c.updatedShards) > 0 || len(c.shards) != len(shards) || len(c.data) != len(cm.BinaryData) {
+		return true
+	}
+
+	for k, v := range c.data {
+		if original, found := cm.BinaryData[k]; !found || !bytes.Equal(original, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withShards returns a copy of the ConfigMap along with values saved in shards.
+func (c *binaryCommit) withShards(cm *corev1.ConfigMap) *corev1.ConfigMap {
+	if len(c.shards) == 0 {
+		return cm
+	}
+
+	merged := cm.DeepCopy()
+	if merged.BinaryData == nil {
+		merged.BinaryData = make(map[string][]byte, len(c.shards))
+	}
+
+	for k, v := range c.shards {
+		merged.BinaryData[k] = v
+	}
+
+	return merged
+}
+
+// restoreKeys rewrites local files of keys with values of the ConfigMap.
+func (m *volumeMap) restoreKeys(volumeID string, metadata *volumeMetadata, cm *corev1.ConfigMap, keys []string) {
+	// get volGuard locked in callers
+	path := filepath.Join(m.volumeRoot, volumeID)
+	keyPaths := map[string]string{metadata.SubPath: ""}
+	if len(metadata.SubPath) == 0 {
+		keyPaths, _ = metadata.keyPaths(cm)
+	}
+
+	for _, k := range keys {
+		f, found := keyPaths[k]
+		if !found {
+			continue
+		}
+
+		content, _ := readDataFromConfigMap(cm, k)
+		if err := metadata.writeKey(filepath.Join(path, f), k, content); err != nil {
+			klog.Errorf("unable to restore key %q of volume %q: %s", k, volumeID, err)
+		}
+	}
+}
+
+// reportDroppedKeys records keys of which local changes are dropped since they don't fit in the ConfigMap, and
+// rewrites their local files with the committed values under the KeepPreviousBinary policy.
+func (m *volumeMap) reportDroppedKeys(volumeID string, metadata *volumeMetadata, cm *corev1.ConfigMap, keys []string) {
+	// get volGuard locked in callers
+	if len(keys) == 0 {
+		return
+	}
+
+	policy := metadata.BinaryOversizePolicy
+	if len(policy) == 0 {
+		policy = RejectBinaryKey
+	}
+
+	klog.Warningf("changes of %q of volume %q are dropped according to the binary oversize policy %q", keys,
+		volumeID, policy)
+	droppedKeysTotal.WithLabelValues(metadata.ConfigMapNamespace, metadata.ConfigMapName, string(policy)).
+		Add(float64(len(keys)))
+	m.recordEvent(metadata, corev1.EventTypeWarning, reasonKeysDropped,
+		"changes of %s of volume %q are dropped since configmap %s/%s would exceed 1MiB. binary oversize policy: %q",
+		strings.Join(keys, ", "), volumeID, metadata.ConfigMapNamespace, metadata.ConfigMapName, policy)
+
+	if policy == KeepPreviousBinary {
+		m.restoreKeys(volumeID, metadata, cm, keys)
+	}
+}
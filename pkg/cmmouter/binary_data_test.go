@@ -0,0 +1,56 @@
+package cmmouter
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCommitBinaryData(t *testing.T) {
+	large := []byte(strings.Repeat("A", 700<<10))
+	medium := []byte(strings.Repeat("B", 600<<10))
+	huge := []byte(strings.Repeat("C", configMapSizeHardLimit+1))
+	binaryData := map[string][]byte{"a": []byte("a"), "b": []byte("b"), "c": []byte("c"), "s": []byte("s")}
+	shards := map[string]shardRef{"s": {ConfigMap: "cm-shard-s"}}
+
+	cases := []struct {
+		policy  ConfigMapBinaryOversizePolicy
+		keys    string
+		dropped string
+		updated string
+	}{
+		{RejectBinaryKey, "b,c", "a,s", ""},
+		{KeepPreviousBinary, "b,c", "a,s", ""},
+		{ShardBinary, "a,b,c", "s", "a"},
+	}
+
+	for _, c := range cases {
+		volData := map[string][]byte{"a": large, "b": medium, "c": []byte("c"), "s": huge, "text": []byte("foo")}
+		commit := commitBinaryData(binaryData, volData, shards, 3, c.policy)
+
+		if _, found := volData["text"]; !found || len(volData) != 1 {
+			t.Errorf("%s: keys of BinaryData should be removed from volData", c.policy)
+		}
+
+		joined := func(keys []string) string {
+			sorted := append([]string{}, keys...)
+			sort.Strings(sorted)
+			return strings.Join(sorted, ",")
+		}
+
+		if joined(commit.keys) != c.keys || joined(commit.dropped) != c.dropped ||
+			joined(commit.updatedShards) != c.updated {
+			t.Errorf("%s: unexpected keys %q, dropped %q and updated shards %q", c.policy, commit.keys,
+				commit.dropped, commit.updatedShards)
+		}
+
+		if !bytes.Equal(commit.data["b"], medium) || !bytes.Equal(commit.shards["s"], []byte("s")) {
+			t.Errorf("%s: unexpected values", c.policy)
+		}
+
+		if commit.size+3 > configMapSizeHardLimit {
+			t.Errorf("%s: %d bytes don't fit", c.policy, commit.size)
+		}
+	}
+}
@@ -2,11 +2,12 @@ package cmmouter
 
 import (
 	"context"
-	"fmt"
 	"golang.org/x/xerrors"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	watch2 "k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
@@ -16,13 +17,16 @@ import (
 	"sync"
 )
 
-func createCMWatcherMap(clientset *kubernetes.Clientset, volGuard *sync.Mutex, handler OnConfigMapModify) *configMapWatcherMap {
+func createCMWatcherMap(
+	store *stateStore, volGuard *sync.Mutex, handler OnConfigMapModify, lostHandler OnConfigMapWatchLost,
+) *configMapWatcherMap {
 	ctx, cancel := context.WithCancel(context.TODO())
 	return &configMapWatcherMap{
+		state:      store,
 		volGuard:   volGuard,
 		watcherMap: make(map[string]*cmWatcherContext),
 		updateVol:  handler,
-		clientset:  clientset,
+		watchLost:  lostHandler,
 		ctx:        ctx,
 		cancel:     cancel,
 	}
@@ -30,10 +34,19 @@ func createCMWatcherMap(clientset *kubernetes.Clientset, volGuard *sync.Mutex, h
 
 type OnConfigMapModify func(volumeKey string, cm *corev1.ConfigMap)
 
+// OnConfigMapWatchLost is called for each related volume if a watch is closed unexpectedly.
+type OnConfigMapWatchLost func(volumeKey string, reason error)
+
 type cmWatcherContext struct {
-	volSet map[string]struct{}
-	ctx    context.Context
-	cancel context.CancelFunc
+	volSet          map[string]struct{}
+	resourceVersion string
+	ctx             context.Context
+	cancel          context.CancelFunc
+
+	// set if any volume follows the watched ConfigMap as a reference. Volumes are notified of added ConfigMaps too.
+	followRefs bool
+	// set if ConfigMaps are watched via a label selector. Volumes are notified of deleted ConfigMaps too.
+	selector bool
 }
 
 type configMapWatcherMap struct {
@@ -41,49 +54,153 @@ type configMapWatcherMap struct {
 	volGuard   *sync.Mutex
 	watcherMap map[string]*cmWatcherContext
 	updateVol  OnConfigMapModify
+	watchLost  OnConfigMapWatchLost
+	state      *stateStore
+
+	wg     wait.Group
+	ctx    context.Context
+	cancel context.CancelFunc
+}
 
-	clientset *kubernetes.Clientset
-	wg        wait.Group
-	ctx       context.Context
-	cancel    context.CancelFunc
+// watchCM watches the ConfigMap via the clientset for the volume. Volumes of the same mapKey share the watcher.
+func (m *configMapWatcherMap) watchCM(
+	volumeKey, mapKey string, cm, ns string, clientset kubernetes.Interface,
+) error {
+	return m.watch(volumeKey, mapKey, listWatchOf(clientset, cm, ns), false)
 }
 
-func (m *configMapWatcherMap) watchCM(volumeKey string, cm, ns string) error {
+// watchRef watches the pointer ConfigMap, or ConfigMaps matching the label selector, for the volume which follows
+// the reference.
+func (m *configMapWatcherMap) watchRef(
+	volumeKey, mapKey string, mode ConfigMapRefMode, ref, ns string, clientset kubernetes.Interface,
+) error {
+	listWatcher := listWatchOf(clientset, ref, ns)
+	if mode == RefSelector {
+		listWatcher = listWatchOfSelector(clientset, ref, ns)
+	}
+
+	if err := m.watch(volumeKey, mapKey, listWatcher, mode == RefSelector); err != nil {
+		return err
+	}
+
+	m.watcherMap[mapKey].followRefs = true
+	return nil
+}
+
+func (m *configMapWatcherMap) watch(volumeKey, mapKey string, listWatcher *cache.ListWatch, selector bool) error {
 	// should get locked to remove the race condition between unwatchCM and the event handler.
-	mapKey := cm + "~" + ns
 	klog.Infof("start watching configmap %q for %q", mapKey, volumeKey)
 	if watcherCtx, found := m.watcherMap[mapKey]; found {
 		klog.Infof("found an existed watch on %q", mapKey)
 		if _, found := watcherCtx.volSet[volumeKey]; found {
-			panic(fmt.Sprintf("cm %q/%q is already watching for volume %q", ns, cm, volumeKey))
+			klog.Warningf("configmap %q is already watching for volume %q", mapKey, volumeKey)
+			return nil
 		}
 
 		watcherCtx.volSet[volumeKey] = struct{}{}
 		return nil
 	}
 
-	listWatcher := cache.NewListWatchFromClient(m.clientset.CoreV1().RESTClient(), "configmaps",
-		ns, fields.OneTermEqualSelector("metadata.name", cm),
-	)
-
-	watcherCtx := &cmWatcherContext{volSet: map[string]struct{}{volumeKey: {}}}
+	watcherCtx := &cmWatcherContext{volSet: map[string]struct{}{volumeKey: {}}, selector: selector}
 	watcherCtx.ctx, watcherCtx.cancel = context.WithCancel(m.ctx)
+	if state, _ := m.state.loadWatcherState(mapKey); state != nil {
+		// resume from the ResourceVersion observed before the plugin restarted
+		watcherCtx.resourceVersion = state.ResourceVersion
+	}
+
 	m.watcherMap[mapKey] = watcherCtx
+	activeWatches.Set(float64(len(m.watcherMap)))
 
 	m.wg.StartWithContext(watcherCtx.ctx, func(ctx context.Context) {
 		_, err := watch.UntilWithSync(
 			ctx, listWatcher, &corev1.ConfigMap{}, nil, m.cmEventHandler(mapKey),
 		)
 		klog.Infof("watch on %q closed: %s", mapKey, err)
+		if ctx.Err() == nil {
+			m.handleWatchLost(mapKey, watcherCtx, err)
+		}
 	})
 
 	return nil
 }
 
-func (m *configMapWatcherMap) unwatchCM(volumeID string, cm, ns string) {
+// listWatchOfSelector returns a typed ListWatch of ConfigMaps matching the label selector. Like listWatchOf, objects
+// are also filtered locally.
+func listWatchOfSelector(clientset kubernetes.Interface, selector, ns string) *cache.ListWatch {
+	parsed, _ := labels.Parse(selector)
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = selector
+			list, err := clientset.CoreV1().ConfigMaps(ns).List(context.TODO(), options)
+			if err != nil {
+				return nil, err
+			}
+
+			items := list.Items[:0]
+			for _, item := range list.Items {
+				if parsed.Matches(labels.Set(item.Labels)) {
+					items = append(items, item)
+				}
+			}
+
+			list.Items = items
+			return list, nil
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch2.Interface, error) {
+			options.LabelSelector = selector
+			w, err := clientset.CoreV1().ConfigMaps(ns).Watch(context.TODO(), options)
+			if err != nil {
+				return nil, err
+			}
+
+			return watch2.Filter(w, func(in watch2.Event) (watch2.Event, bool) {
+				obj, ok := in.Object.(*corev1.ConfigMap)
+				return in, !ok || parsed.Matches(labels.Set(obj.Labels))
+			}), nil
+		},
+	}
+}
+
+// listWatchOf returns a typed ListWatch of the ConfigMap which works with any kubernetes.Interface, including fakes.
+// Objects are also filtered locally since fake clientsets ignore field selectors.
+func listWatchOf(clientset kubernetes.Interface, cm, ns string) *cache.ListWatch {
+	selector := fields.OneTermEqualSelector("metadata.name", cm).String()
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			list, err := clientset.CoreV1().ConfigMaps(ns).List(context.TODO(), options)
+			if err != nil {
+				return nil, err
+			}
+
+			items := list.Items[:0]
+			for _, item := range list.Items {
+				if item.Name == cm {
+					items = append(items, item)
+				}
+			}
+
+			list.Items = items
+			return list, nil
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch2.Interface, error) {
+			options.FieldSelector = selector
+			w, err := clientset.CoreV1().ConfigMaps(ns).Watch(context.TODO(), options)
+			if err != nil {
+				return nil, err
+			}
+
+			return watch2.Filter(w, func(in watch2.Event) (watch2.Event, bool) {
+				obj, ok := in.Object.(*corev1.ConfigMap)
+				return in, !ok || obj.Name == cm
+			}), nil
+		},
+	}
+}
+
+func (m *configMapWatcherMap) unwatchCM(volumeID string, mapKey string) {
 	// should get locked to remove the race condition between unwatchCM and the event handler.
 
-	mapKey := cm + "~" + ns
 	watcherCtx, found := m.watcherMap[mapKey]
 	if !found {
 		klog.Infof("configmap %q is not found in the watcher list", mapKey)
@@ -101,12 +218,37 @@ func (m *configMapWatcherMap) unwatchCM(volumeID string, cm, ns string) {
 		return
 	}
 
-	klog.Infof("no volume watches on configmap %q. close the watcher", volumeID, mapKey)
+	klog.Infof("no volume watches on configmap %q. close the watcher", mapKey)
 	delete(m.watcherMap, mapKey)
+	m.state.deleteWatcherState(mapKey)
+	activeWatches.Set(float64(len(m.watcherMap)))
 	// need not wait for watch loop end
 	watcherCtx.cancel()
 }
 
+// handleWatchLost notifies volumes of the lost watch and removes it.
+func (m *configMapWatcherMap) handleWatchLost(mapKey string, watcherCtx *cmWatcherContext, reason error) {
+	m.volGuard.Lock()
+	defer m.volGuard.Unlock()
+
+	if m.watcherMap[mapKey] != watcherCtx {
+		return
+	}
+
+	if reason == nil {
+		reason = xerrors.New("configmap is deleted")
+	}
+
+	for vol := range watcherCtx.volSet {
+		m.watchLost(vol, reason)
+	}
+
+	delete(m.watcherMap, mapKey)
+	m.state.deleteWatcherState(mapKey)
+	activeWatches.Set(float64(len(m.watcherMap)))
+	watcherCtx.cancel()
+}
+
 func (m *configMapWatcherMap) cmEventHandler(mapKey string) watch.ConditionFunc {
 	return func(event watch2.Event) (done bool, err error) {
 		m.volGuard.Lock()
@@ -118,11 +260,13 @@ func (m *configMapWatcherMap) cmEventHandler(mapKey string) watch.ConditionFunc
 		}
 
 		if len(watcherCtx.volSet) == 0 {
-			panic(mapKey)
+			klog.Warningf("no volume is watching configmap %q. close the watcher", mapKey)
+			return true, nil
 		}
 
 		switch event.Type {
 		case watch2.Error:
+			recordAPIError("configmaps", "watch")
 			st, ok := event.Object.(*metav1.Status)
 			if ok {
 				err = xerrors.Errorf("failed %s", st.Message)
@@ -131,6 +275,13 @@ func (m *configMapWatcherMap) cmEventHandler(mapKey string) watch.ConditionFunc
 			}
 		case watch2.Deleted:
 			cm := event.Object.(*corev1.ConfigMap)
+			if watcherCtx.selector {
+				// Other ConfigMaps may still match the selector.
+				klog.Infof("configmap %s/%s is deleted", cm.Namespace, cm.Name)
+				m.updateVols(watcherCtx, cm)
+				break
+			}
+
 			relatedVols := make([]string, 0, len(watcherCtx.volSet))
 			for vol := range watcherCtx.volSet {
 				relatedVols = append(relatedVols, vol)
@@ -139,23 +290,44 @@ func (m *configMapWatcherMap) cmEventHandler(mapKey string) watch.ConditionFunc
 				cm.Namespace+"~"+cm.Name, relatedVols)
 			done = true
 		case watch2.Added:
+			cm := event.Object.(*corev1.ConfigMap)
 			klog.Infof("configmap %q is added to the local cache", mapKey)
+			if watcherCtx.followRefs {
+				// References may change while not watching.
+				m.updateVols(watcherCtx, cm)
+			} else if len(watcherCtx.resourceVersion) > 0 && watcherCtx.resourceVersion != cm.ResourceVersion {
+				klog.Infof("configmap %s/%s is updated while not watching", cm.Namespace, cm.Name)
+				m.updateVols(watcherCtx, cm)
+			}
+
+			watcherCtx.resourceVersion = cm.ResourceVersion
+			m.saveState(mapKey, watcherCtx)
 		case watch2.Modified:
 			cm := event.Object.(*corev1.ConfigMap)
 			klog.Infof("configmap %s/%s is updated", cm.Namespace, cm.Name)
-			for vol := range watcherCtx.volSet {
-				klog.Infof("updating volume %q", vol)
-				// FIXME considering go in parallel
-				m.updateVol(vol, cm)
-			}
+			m.updateVols(watcherCtx, cm)
+			watcherCtx.resourceVersion = cm.ResourceVersion
+			m.saveState(mapKey, watcherCtx)
 		default:
-			panic(event)
+			klog.Warningf("ignore unknown event %q of configmap %q", event.Type, mapKey)
 		}
 
 		return
 	}
 }
 
+func (m *configMapWatcherMap) updateVols(watcherCtx *cmWatcherContext, cm *corev1.ConfigMap) {
+	for vol := range watcherCtx.volSet {
+		klog.Infof("updating volume %q", vol)
+		// FIXME considering go in parallel
+		m.updateVol(vol, cm)
+	}
+}
+
+func (m *configMapWatcherMap) saveState(mapKey string, watcherCtx *cmWatcherContext) {
+	m.state.persistentWatcherState(mapKey, &watcherState{ResourceVersion: watcherCtx.resourceVersion})
+}
+
 func (m *configMapWatcherMap) stop() {
 	m.cancel()
 	m.wg.Wait()
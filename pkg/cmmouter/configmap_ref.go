@@ -0,0 +1,268 @@
+package cmmouter
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+func (o *ConfigMapOptions) validateRef(ref string) error {
+	switch o.ConfigMapRef {
+	case NoRef:
+		return nil
+	case RefPointer:
+	case RefSelector:
+		if _, err := labels.Parse(ref); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid label selector %q: %s", ref, err)
+		}
+	default:
+		return status.Errorf(codes.InvalidArgument, "valid values of %q are %q and %q", "configMapRef",
+			RefPointer, RefSelector)
+	}
+
+	if o.KeepCurrentAlways || o.pinned() {
+		return status.Error(codes.InvalidArgument,
+			"volumes following configMapRef can't keep current or be pinned")
+	}
+
+	if o.CommitChangesOn != NoCommit {
+		return status.Error(codes.InvalidArgument, "volumes following configMapRef can't commit changes")
+	}
+
+	return nil
+}
+
+// targetOf returns the ConfigMap named by the pointer ConfigMap, or the highest version of ConfigMaps matching the
+// label selector. Versions are ordered by the "-v<N>" suffix of names and then creation timestamps.
+func targetOf(ctx context.Context, clientset kubernetes.Interface, mode ConfigMapRefMode, ref, ns string) (
+	*corev1.ConfigMap, error,
+) {
+	cli := clientset.CoreV1().ConfigMaps(ns)
+	if mode == RefPointer {
+		target, err := currentVersionOf(ctx, clientset, ns, ref)
+		if err != nil {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+
+		if len(target) == 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "pointer configmap %s/%s doesn't name a configmap",
+				ns, ref)
+		}
+
+		cm, err := cli.Get(ctx, target, metav1.GetOptions{})
+		if err != nil {
+			recordAPIError("configmaps", "get")
+			klog.Errorf("unable to fetch configmap %s/%s: %s", ns, target, err)
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+
+		return cm, nil
+	}
+
+	list, err := cli.List(ctx, metav1.ListOptions{LabelSelector: ref})
+	if err != nil {
+		recordAPIError("configmaps", "list")
+		klog.Errorf("unable to list configmaps of %q in namespace %q: %s", ref, ns, err)
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	selector, _ := labels.Parse(ref)
+	candidates := make([]corev1.ConfigMap, 0, len(list.Items))
+	for _, item := range list.Items {
+		if selector.Matches(labels.Set(item.Labels)) {
+			candidates = append(candidates, item)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, status.Errorf(codes.NotFound, "no configmaps match %q in namespace %q", ref, ns)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		_, vi := versionOf(candidates[i].Name)
+		_, vj := versionOf(candidates[j].Name)
+		if vi != vj {
+			return vi < vj
+		}
+
+		ti, tj := candidates[i].CreationTimestamp, candidates[j].CreationTimestamp
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+
+		return candidates[i].Name < candidates[j].Name
+	})
+
+	return &candidates[len(candidates)-1], nil
+}
+
+// authorizeRef checks whether the ServiceAccount of the pod can read the pointer, or list ConfigMaps for the selector.
+func (m *volumeMap) authorizeRef(ctx context.Context, metadata *volumeMetadata) error {
+	ref := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: metadata.ConfigMapNamespace}}
+	if metadata.ConfigMapRef == RefSelector {
+		return m.reviewAccess(ctx, ref, &metadata.PodInfo, "list")
+	}
+
+	ref.Name = metadata.Reference
+	return m.reviewAccess(ctx, ref, &metadata.PodInfo, "get")
+}
+
+// followRef switches the volume to the current target of its reference if it changes.
+func (m *volumeMap) followRef(ctx context.Context, volumeID string, metadata *volumeMetadata) {
+	// get volGuard locked in callers
+	clientset, err := m.clientsetOf(volumeID, metadata)
+	if err != nil {
+		klog.Errorf("unable to follow %s %q of volume %q: %s", metadata.ConfigMapRef, metadata.Reference, volumeID,
+			err)
+		return
+	}
+
+	target, err := targetOf(ctx, clientset, metadata.ConfigMapRef, metadata.Reference, metadata.ConfigMapNamespace)
+	if err == nil && target.Name == metadata.ConfigMapName && target.ResourceVersion == metadata.ResourceVersion {
+		return
+	}
+
+	previous := metadata.ConfigMapName
+	if err == nil && target.Name != previous {
+		// The pod must be allowed to read the new target as well.
+		err = m.authorizeMount(ctx, target, &metadata.PodInfo, &metadata.ConfigMapOptions)
+	}
+
+	if err == nil {
+		err = m.switchTarget(ctx, volumeID, metadata, clientset, target)
+	}
+
+	if err != nil {
+		klog.Errorf("unable to switch volume %q following %s %q: %s", volumeID, metadata.ConfigMapRef,
+			metadata.Reference, err)
+		m.recordPodEvent(metadata, corev1.EventTypeWarning, reasonSwitchFailed,
+			"unable to switch volume %q following %s %q: %s", volumeID, metadata.ConfigMapRef, metadata.Reference,
+			err)
+		return
+	}
+
+	m.recordPodEvent(metadata, corev1.EventTypeNormal, reasonSwitched,
+		"volume %q is switched from configmap %s to %s following %s %q", volumeID, previous, target.Name,
+		metadata.ConfigMapRef, metadata.Reference)
+}
+
+// switchTarget materializes the target in a staging directory, then moves files into the volume. Nothing in the
+// volume changes if the target can't be fetched or saved. Each file is replaced atomically, except subPath volumes,
+// which are rewritten in place to keep their bind mounts, but the volume as a whole isn't. Readers may see files of
+// both targets during the switch. Notifications fire once all files are switched.
+func (m *volumeMap) switchTarget(
+	ctx context.Context, volumeID string, metadata *volumeMetadata, clientset kubernetes.Interface,
+	target *corev1.ConfigMap,
+) error {
+	// get volGuard locked in callers
+	staged := *metadata
+	staged.ConfigMapName = target.Name
+	staged.ResourceVersion = ""
+	if err := staged.checkImmutable(target); err != nil {
+		return err
+	}
+
+	cm, err := mergeShards(ctx, clientset, target)
+	if err != nil {
+		return err
+	}
+
+	if cm, err = m.renderConfigMap(ctx, &staged, cm); err != nil {
+		return err
+	}
+
+	if len(metadata.SubPath) > 0 {
+		if _, _, err = m.updateLocalVolume(volumeID, &staged, cm); err != nil {
+			return err
+		}
+	} else {
+		staging := volumeHelper{volumeRoot: filepath.Join(filepath.Dir(m.volumeRoot), "staging")}
+		staging.deleteVolume(volumeID)
+		defer staging.deleteVolume(volumeID)
+		if err = os.MkdirAll(staging.volumeRoot, 0755); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		if _, _, err = staging.updateLocalVolume(volumeID, &staged, cm); err != nil {
+			return err
+		}
+
+		if err = m.moveStagedFiles(volumeID, &staged, filepath.Join(staging.volumeRoot, volumeID)); err != nil {
+			return err
+		}
+
+		m.removeStaleKeys(volumeID, &staged, cm)
+	}
+
+	klog.Infof("volume %q is switched from configmap %q to %q of ResourceVersion %s", volumeID,
+		metadata.ConfigMapName, staged.ConfigMapName, staged.ResourceVersion)
+	*metadata = staged
+	m.persistentMetadata(volumeID, metadata)
+	m.persistentDigests(volumeID, digestsOfVolume(metadata, cm))
+	m.clearDrift(volumeID)
+	m.notifyRefresh(volumeID, metadata)
+	return nil
+}
+
+// moveStagedFiles renames files in the staging directory to the same paths of the volume.
+func (m *volumeMap) moveStagedFiles(volumeID string, metadata *volumeMetadata, staging string) error {
+	path := filepath.Join(m.volumeRoot, volumeID)
+	return filepath.Walk(staging, func(src string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		rel, err := filepath.Rel(staging, src)
+		if err != nil {
+			return err
+		}
+
+		dst := filepath.Join(path, rel)
+		if dir := filepath.Dir(dst); dir != path {
+			if err = metadata.mkdir(dir); err != nil {
+				klog.Errorf("unable to create dir %q: %s", dir, err)
+				return status.Error(codes.Aborted, err.Error())
+			}
+		}
+
+		if err = os.Rename(src, dst); err != nil {
+			klog.Errorf("unable to move %q to %q: %s", src, dst, err)
+			return status.Error(codes.Aborted, err.Error())
+		}
+
+		return nil
+	})
+}
+
+// removeStaleKeys removes files of keys which are saved in the volume but not found in the ConfigMap.
+func (m *volumeMap) removeStaleKeys(volumeID string, metadata *volumeMetadata, cm *corev1.ConfigMap) {
+	// Items must exist in all ConfigMaps and formatted files are always rewritten.
+	if len(metadata.Items) > 0 || metadata.Format != NoFormat {
+		return
+	}
+
+	digests, err := m.loadDigests(volumeID)
+	if err != nil {
+		return
+	}
+
+	for k := range digests {
+		if _, found := readDataFromConfigMap(cm, k); found {
+			continue
+		}
+
+		path := filepath.Join(m.volumeRoot, volumeID, k)
+		klog.Infof("remove file %q of key %q not found in configmap %s/%s", path, k, cm.Namespace, cm.Name)
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			klog.Errorf("unable to remove %q: %s", path, err)
+		}
+	}
+}
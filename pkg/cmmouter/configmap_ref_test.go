@@ -0,0 +1,72 @@
+package cmmouter
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"time"
+)
+
+func TestTargetOfSelector(t *testing.T) {
+	now := time.Now()
+	configMapOf := func(name, app string, created time.Time) *corev1.ConfigMap {
+		return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "foo",
+			Labels:            map[string]string{"app": app},
+			CreationTimestamp: metav1.NewTime(created),
+		}}
+	}
+
+	clientset := fake.NewSimpleClientset(
+		configMapOf("cm-foo-v2", "foo", now),
+		configMapOf("cm-foo-v10", "foo", now.Add(-time.Hour)),
+		configMapOf("cm-foo-v11", "bar", now),
+		configMapOf("cm-bar-5f7d9", "bar", now.Add(-time.Hour)),
+		configMapOf("cm-bar-8c2ab", "baz", now),
+	)
+
+	cases := map[string]string{
+		"app=foo":      "cm-foo-v10",
+		"app in (bar)": "cm-foo-v11",
+		"app=baz":      "cm-bar-8c2ab",
+	}
+
+	for selector, expected := range cases {
+		cm, err := targetOf(context.TODO(), clientset, RefSelector, selector, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cm.Name != expected {
+			t.Errorf("%q: expected %q, but got %q", selector, expected, cm.Name)
+		}
+	}
+
+	if _, err := targetOf(context.TODO(), clientset, RefSelector, "app=qux", "foo"); err == nil {
+		t.Errorf("no configmaps match the selector")
+	}
+
+	opts := ConfigMapOptions{ConfigMapRef: RefSelector}
+	if err := opts.validateRef("app in (foo"); err == nil {
+		t.Errorf("invalid selectors should be rejected")
+	}
+
+	opts.PinResourceVersion = "1"
+	if err := opts.validateRef("app=foo"); err == nil {
+		t.Errorf("volumes following references can't be pinned")
+	}
+
+	opts = ConfigMapOptions{ConfigMapRef: RefPointer, CommitChangesOn: CommitOnUnmount}
+	if err := opts.validateRef("cm-foo-current"); err == nil {
+		t.Errorf("volumes following references can't commit changes")
+	}
+
+	ref := &volumeMetadata{ConfigMapOptions: opts, ConfigMapNamespace: "foo", Reference: "cm-foo-current"}
+	cm := &volumeMetadata{ConfigMapName: "cm-foo-current", ConfigMapNamespace: "foo"}
+	if watcherKeyOf("vol-ref", ref) == watcherKeyOf("vol-cm", cm) {
+		t.Errorf("volumes following a pointer should not share watchers with volumes mounting it")
+	}
+}
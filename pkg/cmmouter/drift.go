@@ -0,0 +1,192 @@
+package cmmouter
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"sort"
+	"strings"
+)
+
+// VolumeStats is the usage and the condition of a volume.
+type VolumeStats struct {
+	UsedBytes       int64
+	TotalBytes      int64
+	AvailableBytes  int64
+	UsedInodes      int64
+	TotalInodes     int64
+	AvailableInodes int64
+	// Abnormal is set if local content of the volume drifts from the ConfigMap. Message describes the drift.
+	Abnormal bool
+	Message  string
+}
+
+func (o *ConfigMapOptions) validateEnforceContent() error {
+	if o.EnforceContent && o.CommitChangesOn != NoCommit {
+		return status.Error(codes.InvalidArgument, "enforceContent can't be used along with commitChangesOn")
+	}
+
+	return nil
+}
+
+// driftedKeys returns keys of which local content is modified or removed since the volume was refreshed or committed.
+func (m *volumeMap) driftedKeys(volumeID string, metadata *volumeMetadata) ([]string, error) {
+	volData, err := m.readLocalVolume(volumeID, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	digests, err := m.loadDigests(volumeID)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for k, digest := range digests {
+		if v, found := volData[k]; !found || digestOf(v) != digest {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// checkDrift detects local drift of volumes which don't commit changes, and restores the volume if enforceContent
+// is set. It returns keys drifting from the ConfigMap.
+func (m *volumeMap) checkDrift(volumeID string, metadata *volumeMetadata) []string {
+	// get volGuard locked in callers
+	keys, err := m.driftedKeys(volumeID, metadata)
+	if err != nil {
+		klog.Errorf("unable to check drift of volume %q: %s", volumeID, err)
+		return m.drifts[volumeID]
+	}
+
+	if len(keys) == 0 {
+		if _, found := m.drifts[volumeID]; found {
+			klog.Infof("volume %q doesn't drift from configmap %s/%s anymore", volumeID, metadata.ConfigMapNamespace,
+				metadata.ConfigMapName)
+			m.clearDrift(volumeID)
+		}
+
+		return nil
+	}
+
+	if strings.Join(m.drifts[volumeID], ",") != strings.Join(keys, ",") {
+		klog.Warningf("keys %q of volume %q drift from configmap %s/%s", keys, volumeID,
+			metadata.ConfigMapNamespace, metadata.ConfigMapName)
+		driftDetectionsTotal.WithLabelValues(metadata.ConfigMapNamespace, metadata.ConfigMapName).Inc()
+		m.recordPodEvent(metadata, corev1.EventTypeWarning, reasonLocalDrift,
+			"%s of volume %q drift from configmap %s/%s", strings.Join(keys, ", "), volumeID,
+			metadata.ConfigMapNamespace, metadata.ConfigMapName)
+	}
+
+	m.drifts[volumeID] = keys
+	driftedVolumes.Set(float64(len(m.drifts)))
+
+	if !metadata.EnforceContent {
+		return keys
+	}
+
+	if err = m.restoreVolume(context.TODO(), volumeID, metadata); err != nil {
+		klog.Errorf("unable to restore volume %q: %s", volumeID, err)
+		m.recordPodEvent(metadata, corev1.EventTypeWarning, reasonEnforceFailed,
+			"unable to restore volume %q to configmap %s/%s: %s", volumeID, metadata.ConfigMapNamespace,
+			metadata.ConfigMapName, err)
+		return keys
+	}
+
+	m.recordPodEvent(metadata, corev1.EventTypeNormal, reasonContentEnforced,
+		"%s of volume %q are restored to ResourceVersion %s of configmap %s/%s", strings.Join(keys, ", "), volumeID,
+		metadata.ResourceVersion, metadata.ConfigMapNamespace, metadata.ConfigMapName)
+	m.clearDrift(volumeID)
+	return nil
+}
+
+func (m *volumeMap) clearDrift(volumeID string) {
+	delete(m.drifts, volumeID)
+	driftedVolumes.Set(float64(len(m.drifts)))
+}
+
+// restoreVolume rewrites the volume with the revision of the ConfigMap it was refreshed to. The revision must be
+// either current or retained in snapshots.
+func (m *volumeMap) restoreVolume(ctx context.Context, volumeID string, metadata *volumeMetadata) error {
+	// get volGuard locked in callers
+	clientset, err := m.clientsetOf(volumeID, metadata)
+	if err != nil {
+		return err
+	}
+
+	cm, err := clientset.CoreV1().ConfigMaps(metadata.ConfigMapNamespace).
+		Get(ctx, metadata.ConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		recordAPIError("configmaps", "get")
+		return err
+	}
+
+	if cm, err = mergeShards(ctx, clientset, cm); err != nil {
+		return err
+	}
+
+	if cm, err = pinnedConfigMap(ctx, clientset, cm,
+		&ConfigMapOptions{PinResourceVersion: metadata.ResourceVersion}); err != nil {
+		return err
+	}
+
+	if cm, err = m.renderConfigMap(ctx, metadata, cm); err != nil {
+		return err
+	}
+
+	// Clear the ResourceVersion to rewrite files of the same revision.
+	rv := metadata.ResourceVersion
+	metadata.ResourceVersion = ""
+	if _, _, err = m.updateLocalVolume(volumeID, metadata, cm); err != nil {
+		metadata.ResourceVersion = rv
+		return err
+	}
+
+	klog.Infof("volume %q is restored to ResourceVersion %s", volumeID, rv)
+	return nil
+}
+
+// volumeStats returns usage of the volume. Volumes which don't commit changes are abnormal if they drift. Nothing is
+// changed even if they drift.
+func (m *volumeMap) volumeStats(volumeID string) (*VolumeStats, error) {
+	m.volGuard.Lock()
+	defer m.volGuard.Unlock()
+
+	metadata := m.metadataMap[volumeID]
+	if metadata == nil {
+		return nil, status.Errorf(codes.NotFound, "volume %q not found", volumeID)
+	}
+
+	stats, err := m.usageOf(volumeID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if metadata.CommitChangesOn != NoCommit {
+		return stats, nil
+	}
+
+	// Stats only report drift. Drift is recorded and enforced on inotify events.
+	keys, err := m.driftedKeys(volumeID, metadata)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if len(keys) > 0 {
+		stats.Abnormal = true
+		stats.Message = fmt.Sprintf("%s drift from ResourceVersion %s of configmap %s/%s", strings.Join(keys, ", "),
+			metadata.ResourceVersion, metadata.ConfigMapNamespace, metadata.ConfigMapName)
+	} else {
+		stats.Message = fmt.Sprintf("up to date with ResourceVersion %s of configmap %s/%s",
+			metadata.ResourceVersion, metadata.ConfigMapNamespace, metadata.ConfigMapName)
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,79 @@
+package cmmouter
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const eventSourceComponent = "csi-cm.warm-metal.tech"
+
+// Reasons of events recorded on pods and ConfigMaps.
+const (
+	reasonRefreshed          = "ConfigMapRefreshed"
+	reasonCommitted          = "LocalChangesCommitted"
+	reasonConflictDiscard    = "LocalChangesDiscarded"
+	reasonTruncated          = "LocalChangesTruncated"
+	reasonKeysDropped        = "LocalChangesDropped"
+	reasonCommitFailed       = "CommitFailed"
+	reasonValidationFailed   = "ValidationFailed"
+	reasonConfigMapWatchLost = "ConfigMapWatchLost"
+	reasonRolledBack         = "RolledBack"
+	reasonRollbackFailed     = "RollbackFailed"
+	reasonNotifyFailed       = "NotifyFailed"
+	reasonLocalDrift         = "LocalDriftDetected"
+	reasonContentEnforced    = "ContentEnforced"
+	reasonEnforceFailed      = "EnforceFailed"
+	reasonSwitched           = "ConfigMapSwitched"
+	reasonSwitchFailed       = "ConfigMapSwitchFailed"
+)
+
+func createEventRecorder(clientset kubernetes.Interface, node string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventSourceComponent, Host: node})
+}
+
+func podRefOf(metadata *volumeMetadata) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Name:       metadata.Pod,
+		Namespace:  metadata.PodNamespace,
+		UID:        types.UID(metadata.PodUID),
+	}
+}
+
+func configMapRefOf(metadata *volumeMetadata) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Name:       metadata.ConfigMapName,
+		Namespace:  metadata.ConfigMapNamespace,
+	}
+}
+
+// recordPodEvent records an event on the pod which mounts the volume.
+func (m *volumeMap) recordPodEvent(metadata *volumeMetadata, eventType, reason, messageFmt string, args ...interface{}) {
+	if m.recorder == nil {
+		return
+	}
+
+	m.recorder.Eventf(podRefOf(metadata), eventType, reason, messageFmt, args...)
+}
+
+// recordEvent records an event on both the pod and the ConfigMap. Messages on the ConfigMap are prefixed by the pod.
+func (m *volumeMap) recordEvent(metadata *volumeMetadata, eventType, reason, messageFmt string, args ...interface{}) {
+	if m.recorder == nil {
+		return
+	}
+
+	message := fmt.Sprintf(messageFmt, args...)
+	m.recorder.Event(podRefOf(metadata), eventType, reason, message)
+	m.recorder.Eventf(configMapRefOf(metadata), eventType, reason, "pod %s/%s: %s", metadata.PodNamespace,
+		metadata.Pod, message)
+}
@@ -0,0 +1,477 @@
+package cmmouter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"path/filepath"
+	"regexp"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+)
+
+// ConfigMapFormat is the format of the single file which all values of the ConfigMap are serialized into.
+type ConfigMapFormat string
+
+const (
+	NoFormat         ConfigMapFormat = ""
+	FormatDotenv     ConfigMapFormat = "dotenv"
+	FormatJSON       ConfigMapFormat = "json"
+	FormatYAML       ConfigMapFormat = "yaml"
+	FormatProperties ConfigMapFormat = "properties"
+	FormatINI        ConfigMapFormat = "ini"
+)
+
+var defaultFormatFileNames = map[ConfigMapFormat]string{
+	FormatDotenv:     ".env",
+	FormatJSON:       "config.json",
+	FormatYAML:       "config.yaml",
+	FormatProperties: "config.properties",
+	FormatINI:        "config.ini",
+}
+
+func (o *ConfigMapOptions) validateFormat() error {
+	if o.Format == NoFormat {
+		if len(o.FileName) > 0 {
+			return status.Error(codes.InvalidArgument, "fileName is only valid if format is set")
+		}
+
+		return nil
+	}
+
+	if _, found := defaultFormatFileNames[o.Format]; !found {
+		return status.Errorf(codes.InvalidArgument, "valid values of %q are %q, %q, %q, %q and %q", "format",
+			FormatDotenv, FormatJSON, FormatYAML, FormatProperties, FormatINI)
+	}
+
+	if len(o.SubPath) > 0 || len(o.Items) > 0 {
+		return status.Error(codes.InvalidArgument, "format can't be used along with subPath or items")
+	}
+
+	if len(o.FileName) > 0 && (o.FileName != filepath.Base(o.FileName) || o.FileName == "..") {
+		return status.Errorf(codes.InvalidArgument, "fileName %q must be a file name rather than a path",
+			o.FileName)
+	}
+
+	return nil
+}
+
+func (o *ConfigMapOptions) formatFileName() string {
+	if len(o.FileName) > 0 {
+		return o.FileName
+	}
+
+	return defaultFormatFileNames[o.Format]
+}
+
+func sortedKeys(data map[string]string) []string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// encodeData serializes data in the format.
+func encodeData(format ConfigMapFormat, data map[string]string) ([]byte, error) {
+	switch format {
+	case FormatJSON:
+		return json.MarshalIndent(data, "", "  ")
+	case FormatYAML:
+		return yaml.Marshal(data)
+	case FormatDotenv:
+		buf := bytes.Buffer{}
+		for _, k := range sortedKeys(data) {
+			fmt.Fprintf(&buf, "%s=%s\n", k, quoteDotenv(data[k]))
+		}
+		return buf.Bytes(), nil
+	case FormatProperties:
+		buf := bytes.Buffer{}
+		for _, k := range sortedKeys(data) {
+			fmt.Fprintf(&buf, "%s=%s\n", escapeProperty(k, true), escapeProperty(data[k], false))
+		}
+		return buf.Bytes(), nil
+	case FormatINI:
+		return encodeINI(data), nil
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown format %q", format)
+	}
+}
+
+// decodeData parses content in the format.
+func decodeData(format ConfigMapFormat, content []byte) (map[string]string, error) {
+	switch format {
+	case FormatJSON, FormatYAML:
+		values := make(map[string]interface{})
+		if err := yaml.Unmarshal(content, &values); err != nil {
+			return nil, err
+		}
+
+		data := make(map[string]string, len(values))
+		for k, v := range values {
+			if s, ok := v.(string); ok {
+				data[k] = s
+				continue
+			}
+
+			bytes, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+
+			data[k] = string(bytes)
+		}
+
+		return data, nil
+	case FormatDotenv:
+		return decodeDotenv(content)
+	case FormatProperties:
+		return decodeProperties(content)
+	case FormatINI:
+		return decodeINI(content)
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown format %q", format)
+	}
+}
+
+func decodeDotenv(content []byte) (map[string]string, error) {
+	data := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, configMapSizeHardLimit+1)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "export ")
+		sep := strings.IndexByte(line, '=')
+		if sep <= 0 {
+			return nil, fmt.Errorf("line %d: missing \"=\"", lineNo)
+		}
+
+		k := strings.TrimSpace(line[:sep])
+		v := strings.TrimSpace(line[sep+1:])
+		switch {
+		case strings.HasPrefix(v, `"`):
+			unquoted, err := unquoteDotenv(v)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNo, err)
+			}
+			v = unquoted
+		case strings.HasPrefix(v, "'") && strings.HasSuffix(v, "'") && len(v) > 1:
+			v = v[1 : len(v)-1]
+		default:
+			if comment := strings.Index(v, " #"); comment >= 0 {
+				v = strings.TrimSpace(v[:comment])
+			}
+		}
+
+		data[k] = v
+	}
+
+	return data, scanner.Err()
+}
+
+// dotenvPlain matches values which can be saved in dotenv files without quotes.
+var dotenvPlain = regexp.MustCompile(`^[A-Za-z0-9_.,:/@%+=-]+$`)
+
+// quoteDotenv quotes the value in the way most dotenv parsers understand. Values are single-quoted, which keeps
+// them as they are, unless they contain single quotes or line breaks. Double-quoted values only escape backslashes,
+// double quotes, dollar signs and line breaks.
+func quoteDotenv(v string) string {
+	if dotenvPlain.MatchString(v) {
+		return v
+	}
+
+	if !strings.ContainsAny(v, "'\n\r") {
+		return "'" + v + "'"
+	}
+
+	buf := strings.Builder{}
+	buf.WriteByte('"')
+	for _, c := range v {
+		switch c {
+		case '\\', '"', '$':
+			buf.WriteByte('\\')
+			buf.WriteRune(c)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		default:
+			buf.WriteRune(c)
+		}
+	}
+
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// unquoteDotenv parses a double-quoted value. Unknown escapes are kept as they are. Only comments can follow the
+// closing quote.
+func unquoteDotenv(v string) (string, error) {
+	buf := strings.Builder{}
+	for i := 1; i < len(v); i++ {
+		c := v[i]
+		if c == '"' {
+			if rest := strings.TrimSpace(v[i+1:]); len(rest) > 0 && rest[0] != '#' {
+				return "", fmt.Errorf("unexpected %q after the closing quote", rest)
+			}
+
+			return buf.String(), nil
+		}
+
+		if c != '\\' || i+1 == len(v) {
+			buf.WriteByte(c)
+			continue
+		}
+
+		i++
+		switch v[i] {
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 't':
+			buf.WriteByte('\t')
+		case '\\', '"', '$':
+			buf.WriteByte(v[i])
+		default:
+			buf.WriteByte('\\')
+			buf.WriteByte(v[i])
+		}
+	}
+
+	return "", fmt.Errorf("missing the closing quote")
+}
+
+func escapeProperty(s string, key bool) string {
+	buf := strings.Builder{}
+	for i, c := range s {
+		switch c {
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '=', ':', '#', '!':
+			if key {
+				buf.WriteByte('\\')
+			}
+			buf.WriteRune(c)
+		case ' ':
+			if key || i == 0 {
+				buf.WriteByte('\\')
+			}
+			buf.WriteRune(c)
+		default:
+			buf.WriteRune(c)
+		}
+	}
+
+	return buf.String()
+}
+
+func unescapeProperty(s string) string {
+	buf := strings.Builder{}
+	escaped := false
+	for _, c := range s {
+		if !escaped {
+			if c == '\\' {
+				escaped = true
+			} else {
+				buf.WriteRune(c)
+			}
+			continue
+		}
+
+		escaped = false
+		switch c {
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 't':
+			buf.WriteByte('\t')
+		default:
+			buf.WriteRune(c)
+		}
+	}
+
+	return buf.String()
+}
+
+// logicalLines joins lines ending with an odd number of backslashes with their following lines.
+func logicalLines(content []byte) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, configMapSizeHardLimit+1)
+	current := ""
+	continued := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if continued {
+			line = strings.TrimLeft(line, " \t\f")
+		}
+
+		trailing := len(line) - len(strings.TrimRight(line, `\`))
+		if trailing%2 == 1 {
+			current += line[:len(line)-1]
+			continued = true
+			continue
+		}
+
+		lines = append(lines, current+line)
+		current = ""
+		continued = false
+	}
+
+	if continued {
+		lines = append(lines, current)
+	}
+
+	return lines, scanner.Err()
+}
+
+func decodeProperties(content []byte) (map[string]string, error) {
+	lines, err := logicalLines(content)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]string, len(lines))
+	for _, line := range lines {
+		line = strings.TrimLeft(line, " \t\f")
+		if len(line) == 0 || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+
+		// The key ends at the first unescaped "=", ":" or whitespace.
+		sep := len(line)
+		for i := 0; i < len(line); i++ {
+			if line[i] == '\\' {
+				i++
+				continue
+			}
+
+			if strings.IndexByte("=: \t\f", line[i]) >= 0 {
+				sep = i
+				break
+			}
+		}
+
+		k := unescapeProperty(line[:sep])
+		v := strings.TrimLeft(line[sep:], " \t\f")
+		if len(v) > 0 && (v[0] == '=' || v[0] == ':') {
+			v = strings.TrimLeft(v[1:], " \t\f")
+		}
+
+		data[k] = unescapeProperty(v)
+	}
+
+	return data, nil
+}
+
+// encodeINI saves keys like "section.key" in sections. Keys without dots are saved before any section.
+func encodeINI(data map[string]string) []byte {
+	sections := make(map[string]map[string]string)
+	for k, v := range data {
+		section, key := "", k
+		if dot := strings.IndexByte(k, '.'); dot > 0 {
+			section, key = k[:dot], k[dot+1:]
+		}
+
+		if sections[section] == nil {
+			sections[section] = make(map[string]string)
+		}
+
+		sections[section][key] = v
+	}
+
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := bytes.Buffer{}
+	for _, name := range names {
+		if len(name) > 0 {
+			if buf.Len() > 0 {
+				buf.WriteByte('\n')
+			}
+			fmt.Fprintf(&buf, "[%s]\n", name)
+		}
+
+		for _, k := range sortedKeys(sections[name]) {
+			fmt.Fprintf(&buf, "%s = %s\n", k, quoteINI(sections[name][k]))
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// quoteINI escapes the value and double-quotes it if it has leading or trailing spaces, which parsers trim, or begins
+// with a double quote.
+func quoteINI(v string) string {
+	escaped := escapeProperty(v, false)
+	if v != strings.TrimSpace(v) || strings.HasPrefix(v, `"`) {
+		return `"` + escaped + `"`
+	}
+
+	return escaped
+}
+
+func unquoteINI(v string) string {
+	if len(v) > 1 && v[0] == '"' && v[len(v)-1] == '"' {
+		return v[1 : len(v)-1]
+	}
+
+	return v
+}
+
+func decodeINI(content []byte) (map[string]string, error) {
+	data := make(map[string]string)
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, configMapSizeHardLimit+1)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				return nil, fmt.Errorf("line %d: invalid section", lineNo)
+			}
+
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		sep := strings.IndexByte(line, '=')
+		if sep <= 0 {
+			return nil, fmt.Errorf("line %d: missing \"=\"", lineNo)
+		}
+
+		k := strings.TrimSpace(line[:sep])
+		if len(section) > 0 {
+			k = section + "." + k
+		}
+
+		data[k] = unescapeProperty(unquoteINI(strings.TrimSpace(line[sep+1:])))
+	}
+
+	return data, scanner.Err()
+}
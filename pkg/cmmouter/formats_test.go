@@ -0,0 +1,113 @@
+package cmmouter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFormatRoundTrip(t *testing.T) {
+	data := map[string]string{
+		"HOST":          "example.com",
+		"greeting":      "hello \"world\"\nbye",
+		"server.port":   "8080",
+		"server.name":   " leading space",
+		"key with = :":  `back\slash`,
+		"database.url":  "jdbc:mysql://localhost:3306/db?a=b",
+		"empty":         "",
+		"comment.style": "# not a comment",
+		"server.path":   "trailing space  ",
+		"server.tab":    "\ttabs\t",
+		"quoted":        `"double" and 'single'`,
+		"dollar":        "$HOME and ${USER}",
+		"unicode":       "snow \u2603 \x01",
+		"crlf":          "line\r\nbreak\\n",
+	}
+
+	for _, format := range []ConfigMapFormat{FormatDotenv, FormatJSON, FormatYAML, FormatProperties, FormatINI} {
+		input := data
+		if format == FormatINI || format == FormatDotenv {
+			// keys of ini and dotenv files can't contain "=" or spaces
+			input = make(map[string]string, len(data))
+			for k, v := range data {
+				if k != "key with = :" {
+					input[k] = v
+				}
+			}
+		}
+
+		content, err := encodeData(format, input)
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+
+		decoded, err := decodeData(format, content)
+		if err != nil {
+			t.Fatalf("%s: %s\n%s", format, err, content)
+		}
+
+		if !reflect.DeepEqual(decoded, input) {
+			t.Errorf("%s: mismatched\n%s\n%#v", format, content, decoded)
+		}
+	}
+}
+
+func TestEncodeDotenv(t *testing.T) {
+	content, err := encodeData(FormatDotenv, map[string]string{
+		"PLAIN":  "example.com:8080",
+		"SPACE":  " padded $HOME ",
+		"QUOTE":  "it's\n\"quoted\" $HOME \u2603",
+		"EMPTY":  "",
+		"BINARY": "\x01",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Escapes like \xNN or \uNNNN are not understood by dotenv parsers.
+	expected := "BINARY='\x01'\nEMPTY=''\nPLAIN=example.com:8080\n" +
+		"QUOTE=\"it's\\n\\\"quoted\\\" \\$HOME \u2603\"\nSPACE=' padded $HOME '\n"
+	if string(content) != expected {
+		t.Errorf("expect\n%s\nbut got\n%s", expected, content)
+	}
+}
+
+func TestDecodeHandWrittenFiles(t *testing.T) {
+	cases := []struct {
+		format  ConfigMapFormat
+		content string
+		data    map[string]string
+	}{
+		{FormatDotenv, "# comment\nexport FOO=bar # trailing\nBAZ='single quoted'\n", map[string]string{
+			"FOO": "bar", "BAZ": "single quoted",
+		}},
+		{FormatProperties, "! comment\nfoo : bar\nlong = first \\\n    second\nflag\n", map[string]string{
+			"foo": "bar", "long": "first second", "flag": "",
+		}},
+		{FormatINI, "top = 1\n; comment\n[server]\nport = 8080\nname = \" padded \"  \n", map[string]string{
+			"top": "1", "server.port": "8080", "server.name": " padded ",
+		}},
+		{FormatDotenv, "A=\"x \\$y\\q\\n\" # comment\n", map[string]string{"A": "x $y\\q\n"}},
+		{FormatDotenv, "B=\"unterminated\n", nil},
+		{FormatJSON, `{"foo": "bar", "num": 1, "obj": {"a": true}}`, map[string]string{
+			"foo": "bar", "num": "1", "obj": `{"a":true}`,
+		}},
+	}
+
+	for _, c := range cases {
+		data, err := decodeData(c.format, []byte(c.content))
+		if c.data == nil {
+			if err == nil {
+				t.Errorf("%s: invalid content should be rejected, but got %#v", c.format, data)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %s", c.format, err)
+		}
+
+		if !reflect.DeepEqual(data, c.data) {
+			t.Errorf("%s: unexpected %#v", c.format, data)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package cmmouter
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/mount"
+	"os"
+	"time"
+)
+
+// garbageCollector periodically removes volumes of which pods are gone or targets are not mounted anymore.
+// These volumes are left behind if NodeUnpublishVolume never arrives.
+type garbageCollector struct {
+	interval    time.Duration
+	gracePeriod time.Duration
+	dryRun      bool
+
+	// mapping from volumeKey to the time the volume is found stale
+	staleSince map[string]time.Time
+
+	wg     wait.Group
+	stopCh chan struct{}
+}
+
+func (m *volumeMap) startGC() {
+	if m.gc.interval <= 0 {
+		klog.Info("garbage collection of stale volumes is disabled")
+		return
+	}
+
+	klog.Infof("collect stale volumes every %s. grace period: %s, dry-run: %t", m.gc.interval, m.gc.gracePeriod,
+		m.gc.dryRun)
+	m.gc.wg.Start(func() {
+		wait.Until(m.collectGarbage, m.gc.interval, m.gc.stopCh)
+	})
+}
+
+func (m *volumeMap) stopGC() {
+	close(m.gc.stopCh)
+	m.gc.wg.Wait()
+}
+
+// collectGarbage removes volumes which have been stale for longer than the grace period.
+func (m *volumeMap) collectGarbage() {
+	volumes, err := m.listLocalVolumes()
+	if err != nil {
+		return
+	}
+
+	// Pods and mount points are checked without volGuard locked to not block other operations.
+	ctx := context.TODO()
+	stale := make(map[string]string)
+	for volumeID, metadata := range volumes {
+		if reason := m.staleReasonOf(ctx, metadata); len(reason) > 0 {
+			stale[volumeID] = reason
+		}
+	}
+
+	m.volGuard.Lock()
+	defer m.volGuard.Unlock()
+
+	if m.stopped {
+		return
+	}
+
+	now := time.Now()
+	for volumeID := range m.gc.staleSince {
+		if _, found := stale[volumeID]; !found {
+			delete(m.gc.staleSince, volumeID)
+		}
+	}
+
+	for volumeID, reason := range stale {
+		metadata := volumes[volumeID]
+		if m.metadataMap[volumeID] != metadata {
+			// The volume is unmounted or mounted again while checking.
+			delete(m.gc.staleSince, volumeID)
+			continue
+		}
+
+		since, found := m.gc.staleSince[volumeID]
+		if !found {
+			since = now
+			m.gc.staleSince[volumeID] = now
+		}
+
+		if now.Sub(since) < m.gc.gracePeriod {
+			klog.Infof("volume %q is stale since %s: %s", volumeID, since.Format(time.RFC3339), reason)
+			continue
+		}
+
+		if m.gc.dryRun {
+			klog.Warningf("volume %q has been stale since %s: %s. keep it in the dry-run mode", volumeID,
+				since.Format(time.RFC3339), reason)
+			continue
+		}
+
+		klog.Warningf("remove stale volume %q: %s", volumeID, reason)
+		if err := m.removeStaleVolume(ctx, volumeID, metadata); err != nil {
+			continue
+		}
+
+		delete(m.gc.staleSince, volumeID)
+		gcRemovedVolumesTotal.Inc()
+	}
+
+	staleVolumes.Set(float64(len(m.gc.staleSince)))
+}
+
+// listLocalVolumes returns all volumes in the volume root along with their metadata, which are nil if not found.
+func (m *volumeMap) listLocalVolumes() (map[string]*volumeMetadata, error) {
+	m.volGuard.Lock()
+	defer m.volGuard.Unlock()
+
+	fis, err := ioutil.ReadDir(m.volumeRoot)
+	if err != nil {
+		klog.Errorf("unable to read volumes from %q: %s", m.volumeRoot, err)
+		return nil, err
+	}
+
+	volumes := make(map[string]*volumeMetadata, len(fis))
+	for _, fi := range fis {
+		volumes[fi.Name()] = m.metadataMap[fi.Name()]
+	}
+
+	return volumes, nil
+}
+
+// staleReasonOf returns why the volume is stale, or an empty string if it isn't.
+func (m *volumeMap) staleReasonOf(ctx context.Context, metadata *volumeMetadata) string {
+	if metadata == nil {
+		return "metadata not found"
+	}
+
+	pod, err := m.clientset.CoreV1().Pods(metadata.PodNamespace).Get(ctx, metadata.Pod, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return fmt.Sprintf("pod %s/%s is deleted", metadata.PodNamespace, metadata.Pod)
+		}
+
+		recordAPIError("pods", "get")
+		klog.Errorf("unable to fetch pod %s/%s: %s", metadata.PodNamespace, metadata.Pod, err)
+		return ""
+	}
+
+	if len(metadata.PodUID) > 0 && string(pod.UID) != metadata.PodUID {
+		return fmt.Sprintf("pod %s/%s is recreated", metadata.PodNamespace, metadata.Pod)
+	}
+
+	notMnt, err := mount.IsNotMountPoint(m.mounter, metadata.TargetPath)
+	if err != nil && !os.IsNotExist(err) {
+		klog.Errorf("unable to check mount point %q: %s", metadata.TargetPath, err)
+		return ""
+	}
+
+	if err == nil && !notMnt {
+		return ""
+	}
+
+	return fmt.Sprintf("target %q is not mounted", metadata.TargetPath)
+}
+
+// removeStaleVolume unmounts the target if it is still mounted, then releases the volume.
+func (m *volumeMap) removeStaleVolume(ctx context.Context, volumeID string, metadata *volumeMetadata) error {
+	// get volGuard locked in callers
+	if metadata == nil {
+		m.cleanAmbiguousVolume(volumeID, nil)
+		return nil
+	}
+
+	if notMnt, err := mount.IsNotMountPoint(m.mounter, metadata.TargetPath); err == nil && !notMnt {
+		if err = m.mounter.Unmount(metadata.TargetPath); err != nil {
+			klog.Errorf("unable to unmount %q of stale volume %q: %s", metadata.TargetPath, volumeID, err)
+			return err
+		}
+	}
+
+	delete(m.metadataMap, volumeID)
+	return m.releaseVolume(ctx, volumeID, metadata)
+}
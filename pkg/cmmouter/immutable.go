@@ -0,0 +1,302 @@
+package cmmouter
+
+import (
+	"context"
+	"golang.org/x/xerrors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+const (
+	// labelVersionOf is the name, without the version suffix, of ConfigMap versions created by commits.
+	labelVersionOf = "csi-cm.warm-metal.tech/version-of"
+	// pointerKey is the key of pointer ConfigMaps which names the current version.
+	pointerKey = "configMap"
+
+	// maximum number of attempts to create a new version if names are taken
+	maxVersionAttempts = 5
+)
+
+var versionSuffix = regexp.MustCompile(`-v([0-9]+)$`)
+
+func isImmutable(cm *corev1.ConfigMap) bool {
+	return cm.Immutable != nil && *cm.Immutable
+}
+
+func (o *ConfigMapOptions) validateVersionPointer() error {
+	if len(o.VersionPointer) == 0 {
+		return nil
+	}
+
+	if o.CommitChangesOn == NoCommit {
+		return status.Error(codes.InvalidArgument, "versionPointer requires commitChangesOn")
+	}
+
+	if o.BinaryOversizePolicy == ShardBinary {
+		return status.Error(codes.InvalidArgument, "versionPointer can't be used along with the shard policy")
+	}
+
+	return nil
+}
+
+// checkImmutable marks volumes of immutable ConfigMaps, which are never watched. Commits to them are rejected unless
+// they are committed as new versions.
+func (m *volumeMetadata) checkImmutable(cm *corev1.ConfigMap) error {
+	m.Immutable = isImmutable(cm)
+	if !m.Immutable {
+		return nil
+	}
+
+	if m.CommitChangesOn != NoCommit && len(m.VersionPointer) == 0 {
+		return status.Errorf(codes.FailedPrecondition,
+			"configmap %s/%s is immutable. set versionPointer to commit changes as new versions", cm.Namespace,
+			cm.Name)
+	}
+
+	if m.KeepCurrentAlways {
+		klog.Infof("configmap %s/%s is immutable. keepCurrentAlways takes no effect", cm.Namespace, cm.Name)
+	}
+
+	return nil
+}
+
+// versionOf splits the name of a ConfigMap version into the name without the suffix and the version.
+func versionOf(name string) (string, int) {
+	match := versionSuffix.FindStringSubmatch(name)
+	if match == nil {
+		return name, 0
+	}
+
+	version, err := strconv.Atoi(match[1])
+	if err != nil {
+		return name, 0
+	}
+
+	return name[:len(name)-len(match[0])], version
+}
+
+// currentVersionOf returns the ConfigMap the pointer names, or an empty string if the pointer doesn't exist.
+func currentVersionOf(ctx context.Context, clientset kubernetes.Interface, ns, pointer string) (string, error) {
+	cm, err := clientset.CoreV1().ConfigMaps(ns).Get(ctx, pointer, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return "", nil
+		}
+
+		recordAPIError("configmaps", "get")
+		klog.Errorf("unable to fetch pointer configmap %s/%s: %s", ns, pointer, err)
+		return "", err
+	}
+
+	return cm.Data[pointerKey], nil
+}
+
+// versionConflicted checks whether the pointer names a version other than the one the volume is committed to.
+func versionConflicted(ctx context.Context, clientset kubernetes.Interface, metadata *volumeMetadata) (bool, error) {
+	current, err := currentVersionOf(ctx, clientset, metadata.ConfigMapNamespace, metadata.VersionPointer)
+	if err != nil {
+		return false, err
+	}
+
+	return len(current) > 0 && current != metadata.ConfigMapName, nil
+}
+
+// errPointerMoved means the pointer ConfigMap names a version other than the one committed to.
+var errPointerMoved = xerrors.New("pointer is moved to another version")
+
+// commitNewVersion creates an immutable ConfigMap named "<name>-v<N>" with the content of cm, where N is greater than
+// the version of all existing ones, then points the pointer ConfigMap to it. Only the sharing and retention settings of
+// cm are kept in the new version, along with annotations in author. The version is deleted if the pointer can't be
+// updated, and a conflict is returned if the pointer is moved to another version in the meantime. Versions other than
+// the latest retained ones are pruned once the pointer is updated.
+func commitNewVersion(
+	ctx context.Context, clientset kubernetes.Interface, metadata *volumeMetadata, cm *corev1.ConfigMap,
+	author map[string]string,
+) (*corev1.ConfigMap, error) {
+	name, latest := versionOf(cm.Name)
+	cli := clientset.CoreV1().ConfigMaps(cm.Namespace)
+	list, err := cli.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{labelVersionOf: name}).String(),
+	})
+	if err != nil {
+		recordAPIError("configmaps", "list")
+		klog.Errorf("unable to list versions of configmap %s/%s: %s", cm.Namespace, name, err)
+		return nil, err
+	}
+
+	for i := range list.Items {
+		if _, version := versionOf(list.Items[i].Name); version > latest {
+			latest = version
+		}
+	}
+
+	immutable := true
+	version := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   cm.Namespace,
+			Labels:      map[string]string{labelVersionOf: name},
+			Annotations: make(map[string]string, len(author)+1),
+		},
+		Data:       cm.Data,
+		BinaryData: cm.BinaryData,
+		Immutable:  &immutable,
+	}
+
+	if v, found := cm.Labels[labelShared]; found {
+		version.Labels[labelShared] = v
+	}
+
+	if v, found := cm.Annotations[annotationSharedWith]; found {
+		version.Annotations[annotationSharedWith] = v
+	}
+
+	if v, found := cm.Annotations[annotationRetainRevisions]; found {
+		version.Annotations[annotationRetainRevisions] = v
+	}
+
+	for k, v := range author {
+		version.Annotations[k] = v
+	}
+
+	for i := 0; i < maxVersionAttempts; i++ {
+		latest++
+		version.Name = name + "-v" + strconv.Itoa(latest)
+		var created *corev1.ConfigMap
+		if created, err = cli.Create(ctx, version, metav1.CreateOptions{}); err == nil {
+			version = created
+			break
+		}
+
+		if !errors.IsAlreadyExists(err) {
+			recordAPIError("configmaps", "create")
+			klog.Errorf("unable to create version %q of configmap %s/%s: %s", version.Name, cm.Namespace, name, err)
+			return nil, err
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	klog.Infof("version %q of configmap %s/%s is created", version.Name, cm.Namespace, name)
+	// Versions committed by others in the meantime are overridden along with remote changes.
+	from := cm.Name
+	if metadata.ConflictPolicy == OverrideRemoteChanges {
+		from = ""
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		return pointTo(ctx, clientset, cm.Namespace, metadata.VersionPointer, from, version.Name)
+	})
+	if err == nil {
+		pruneVersions(ctx, clientset, name, append(list.Items, *version), version.Name,
+			retainedRevisionsOf(cm, metadata.RetainRevisions))
+		return version, nil
+	}
+
+	if err := cli.Delete(ctx, version.Name, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+		recordAPIError("configmaps", "delete")
+		klog.Errorf("unable to delete version %q of configmap %s/%s: %s", version.Name, cm.Namespace, name, err)
+	}
+
+	if xerrors.Is(err, errPointerMoved) {
+		return nil, errors.NewConflict(corev1.Resource("configmaps"), metadata.VersionPointer, err)
+	}
+
+	return nil, err
+}
+
+// pruneVersions deletes versions of the ConfigMap name except the latest retained ones. The current version the pointer
+// names is never deleted. ConfigMaps labeled as versions but not named after the ConfigMap are left untouched.
+func pruneVersions(
+	ctx context.Context, clientset kubernetes.Interface, name string, versions []corev1.ConfigMap, current string,
+	retained int,
+) {
+	numbered := make([]*corev1.ConfigMap, 0, len(versions))
+	for i := range versions {
+		if base, version := versionOf(versions[i].Name); base == name && version > 0 {
+			numbered = append(numbered, &versions[i])
+		}
+	}
+
+	sort.Slice(numbered, func(i, j int) bool {
+		_, vi := versionOf(numbered[i].Name)
+		_, vj := versionOf(numbered[j].Name)
+		return vi > vj
+	})
+
+	for i, version := range numbered {
+		if i < retained || version.Name == current {
+			continue
+		}
+
+		klog.Infof("prune version %q of configmap %s/%s", version.Name, version.Namespace, name)
+		err := clientset.CoreV1().ConfigMaps(version.Namespace).Delete(ctx, version.Name, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			recordAPIError("configmaps", "delete")
+			klog.Errorf("unable to delete version %q of configmap %s/%s: %s", version.Name, version.Namespace,
+				name, err)
+		}
+	}
+}
+
+// pointTo updates the pointer ConfigMap from the version from to the target, or creates the pointer if it doesn't
+// exist. It returns errPointerMoved if the pointer names another version, unless from is empty.
+func pointTo(ctx context.Context, clientset kubernetes.Interface, ns, pointer, from, target string) error {
+	cli := clientset.CoreV1().ConfigMaps(ns)
+	cm, err := cli.Get(ctx, pointer, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: pointer, Namespace: ns},
+			Data:       map[string]string{pointerKey: target},
+		}
+
+		if _, err = cli.Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+			if errors.IsAlreadyExists(err) {
+				// Created by others in the meantime. Check it again.
+				return errors.NewConflict(corev1.Resource("configmaps"), pointer, err)
+			}
+
+			recordAPIError("configmaps", "create")
+			klog.Errorf("unable to create pointer configmap %s/%s: %s", ns, pointer, err)
+			return err
+		}
+
+		return nil
+	}
+
+	if err != nil {
+		recordAPIError("configmaps", "get")
+		klog.Errorf("unable to fetch pointer configmap %s/%s: %s", ns, pointer, err)
+		return err
+	}
+
+	if current := cm.Data[pointerKey]; len(from) > 0 && len(current) > 0 && current != from {
+		klog.Errorf("pointer configmap %s/%s names %q instead of %q", ns, pointer, current, from)
+		return errPointerMoved
+	}
+
+	if cm.Data == nil {
+		cm.Data = make(map[string]string, 1)
+	}
+
+	cm.Data[pointerKey] = target
+	if _, err = cli.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		recordAPIError("configmaps", "update")
+		klog.Errorf("unable to update pointer configmap %s/%s: %s", ns, pointer, err)
+		return err
+	}
+
+	klog.Infof("pointer configmap %s/%s points to %q", ns, pointer, target)
+	return nil
+}
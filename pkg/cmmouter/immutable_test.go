@@ -0,0 +1,38 @@
+package cmmouter
+
+import "testing"
+
+func TestVersionOf(t *testing.T) {
+	cases := []struct {
+		name    string
+		base    string
+		version int
+	}{
+		{"cm-foo", "cm-foo", 0},
+		{"cm-foo-v1", "cm-foo", 1},
+		{"cm-foo-v12", "cm-foo", 12},
+		{"cm-v2-foo", "cm-v2-foo", 0},
+		{"cm-foo-v", "cm-foo-v", 0},
+	}
+
+	for _, c := range cases {
+		if base, version := versionOf(c.name); base != c.base || version != c.version {
+			t.Errorf("%q: expected %q and %d, but got %q and %d", c.name, c.base, c.version, base, version)
+		}
+	}
+
+	opts := ConfigMapOptions{VersionPointer: "cm-foo-current"}
+	if err := opts.validateVersionPointer(); err == nil {
+		t.Errorf("versionPointer requires commitChangesOn")
+	}
+
+	opts.CommitChangesOn = CommitOnModify
+	if err := opts.validateVersionPointer(); err != nil {
+		t.Error(err)
+	}
+
+	opts.BinaryOversizePolicy = ShardBinary
+	if err := opts.validateVersionPointer(); err == nil {
+		t.Errorf("versionPointer can't be used along with the shard policy")
+	}
+}
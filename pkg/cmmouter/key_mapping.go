@@ -0,0 +1,144 @@
+package cmmouter
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// KeyToPath maps a key of the ConfigMap to a relative path in the volume, like items of the builtin ConfigMap volume.
+type KeyToPath struct {
+	Key  string `json:"key"`
+	Path string `json:"path,omitempty"`
+	Mode *int32 `json:"mode,omitempty"`
+}
+
+func (o *ConfigMapOptions) selectsKeys() bool {
+	return len(o.Items) > 0 || len(o.Include) > 0 || len(o.Exclude) > 0
+}
+
+func (o *ConfigMapOptions) validateKeyMapping() error {
+	if !o.selectsKeys() {
+		return nil
+	}
+
+	if len(o.SubPath) > 0 {
+		return status.Error(codes.InvalidArgument, "subPath can't be used along with items, include or exclude")
+	}
+
+	for _, pattern := range append(append([]string{}, o.Include...), o.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid pattern %q: %s", pattern, err)
+		}
+	}
+
+	paths := make(map[string]struct{}, len(o.Items))
+	for _, item := range o.Items {
+		if len(item.Key) == 0 {
+			return status.Error(codes.InvalidArgument, "key of items is required")
+		}
+
+		p := item.pathOrKey()
+		if filepath.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") || p != filepath.Clean(p) {
+			return status.Errorf(codes.InvalidArgument, "path %q of key %q must be a relative path without \"..\"",
+				p, item.Key)
+		}
+
+		if _, found := paths[p]; found {
+			return status.Errorf(codes.InvalidArgument, "path %q is duplicated in items", p)
+		}
+
+		paths[p] = struct{}{}
+	}
+
+	return nil
+}
+
+func (i *KeyToPath) pathOrKey() string {
+	if len(i.Path) > 0 {
+		return i.Path
+	}
+
+	return i.Key
+}
+
+// filterKey returns true if the key matches any include pattern if set and none of the exclude patterns.
+func (o *ConfigMapOptions) filterKey(key string) bool {
+	for _, pattern := range o.Exclude {
+		if matched, _ := path.Match(pattern, key); matched {
+			return false
+		}
+	}
+
+	if len(o.Include) == 0 {
+		return true
+	}
+
+	for _, pattern := range o.Include {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// keyPaths returns relative paths of the selected keys in a directory volume.
+func (o *ConfigMapOptions) keyPaths(cm *corev1.ConfigMap) (map[string]string, error) {
+	paths := make(map[string]string, len(cm.Data)+len(cm.BinaryData))
+	if len(o.Items) > 0 {
+		for _, item := range o.Items {
+			if _, found := readDataFromConfigMap(cm, item.Key); !found {
+				return nil, status.Errorf(codes.NotFound, "key %q not found in configmap %s/%s", item.Key,
+					cm.Namespace, cm.Name)
+			}
+
+			if o.filterKey(item.Key) {
+				paths[item.Key] = item.pathOrKey()
+			}
+		}
+
+		return paths, nil
+	}
+
+	for k := range cm.Data {
+		if o.filterKey(k) {
+			paths[k] = k
+		}
+	}
+
+	for k := range cm.BinaryData {
+		if o.filterKey(k) {
+			paths[k] = k
+		}
+	}
+
+	return paths, nil
+}
+
+// localKeyPaths returns keys of local files which would be committed, without the ConfigMap. If items are set, the
+// item paths are read. Otherwise, top-level files of the volume are filtered by include and exclude patterns.
+func (o *ConfigMapOptions) localKeyPaths(files []string) map[string]string {
+	if len(o.Items) > 0 {
+		paths := make(map[string]string, len(o.Items))
+		for _, item := range o.Items {
+			if o.filterKey(item.Key) {
+				paths[item.Key] = item.pathOrKey()
+			}
+		}
+
+		return paths
+	}
+
+	paths := make(map[string]string, len(files))
+	for _, f := range files {
+		if o.filterKey(f) {
+			paths[f] = f
+		}
+	}
+
+	return paths
+}
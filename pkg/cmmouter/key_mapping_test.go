@@ -0,0 +1,83 @@
+package cmmouter
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"reflect"
+	"testing"
+)
+
+func TestKeyPaths(t *testing.T) {
+	cm := &corev1.ConfigMap{
+		Data: map[string]string{
+			"foo.txt":  "foo",
+			"bar.txt":  "bar",
+			"foo.yaml": "foo: bar",
+		},
+		BinaryData: map[string][]byte{
+			"foo.bin": []byte("foo"),
+		},
+	}
+
+	cases := []struct {
+		opts  ConfigMapOptions
+		paths map[string]string
+	}{
+		{
+			ConfigMapOptions{Include: []string{"foo.*"}, Exclude: []string{"*.bin"}},
+			map[string]string{"foo.txt": "foo.txt", "foo.yaml": "foo.yaml"},
+		},
+		{
+			ConfigMapOptions{Items: []KeyToPath{{Key: "foo.txt", Path: "etc/foo.conf"}, {Key: "foo.bin"}}},
+			map[string]string{"foo.txt": "etc/foo.conf", "foo.bin": "foo.bin"},
+		},
+		{
+			ConfigMapOptions{
+				Items:   []KeyToPath{{Key: "foo.txt", Path: "etc/foo.conf"}, {Key: "foo.bin"}},
+				Exclude: []string{"*.bin"},
+			},
+			map[string]string{"foo.txt": "etc/foo.conf"},
+		},
+	}
+
+	for i, c := range cases {
+		paths, err := c.opts.keyPaths(cm)
+		if err != nil {
+			t.Fatalf("case %d: %s", i, err)
+		}
+
+		if !reflect.DeepEqual(paths, c.paths) {
+			t.Errorf("case %d: unexpected paths %#v", i, paths)
+		}
+
+		files := make([]string, 0, len(paths))
+		for k := range cm.Data {
+			files = append(files, k)
+		}
+
+		if local := c.opts.localKeyPaths(files); len(c.opts.Items) > 0 && !reflect.DeepEqual(local, c.paths) {
+			t.Errorf("case %d: unexpected local paths %#v", i, local)
+		}
+	}
+
+	opts := ConfigMapOptions{Items: []KeyToPath{{Key: "missing"}}}
+	if _, err := opts.keyPaths(cm); err == nil {
+		t.Error("missing keys should fail")
+	}
+}
+
+func TestValidateKeyMapping(t *testing.T) {
+	invalid := []ConfigMapOptions{
+		{SubPath: "foo.txt", Include: []string{"*"}},
+		{Items: []KeyToPath{{Key: "foo", Path: "../foo"}}},
+		{Items: []KeyToPath{{Key: "foo", Path: "/etc/foo"}}},
+		{Items: []KeyToPath{{Key: "foo", Path: "foo"}, {Key: "bar", Path: "foo"}}},
+		{Items: []KeyToPath{{Path: "foo"}}},
+		{Include: []string{"["}},
+	}
+
+	for i, opts := range invalid {
+		if err := opts.validateKeyMapping(); err == nil {
+			t.Errorf("case %d should be invalid", i)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package cmmouter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+const metricsNamespace = "csi_configmap"
+
+var (
+	operationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "operations_total",
+		Help:      "Number of mount and unmount operations, partitioned by the gRPC status code.",
+	}, []string{"operation", "code"})
+
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of mount and unmount operations.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	refreshDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "refresh_duration_seconds",
+		Help:      "Duration of refreshing local volumes after their ConfigMaps are updated.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"namespace", "configmap"})
+
+	commitAttemptsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "commit_attempts_total",
+		Help:      "Number of attempts to commit local changes, partitioned by the result.",
+	}, []string{"namespace", "configmap", "result"})
+
+	conflictsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "conflicts_total",
+		Help:      "Number of conflicts found while committing local changes, partitioned by the conflict policy.",
+	}, []string{"namespace", "configmap", "policy"})
+
+	truncatedBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "truncated_bytes_total",
+		Help:      "Bytes of local changes truncated by the oversize policy.",
+	}, []string{"namespace", "configmap", "policy"})
+
+	droppedKeysTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dropped_keys_total",
+		Help:      "Number of keys of which local changes are dropped by the binary oversize policy.",
+	}, []string{"namespace", "configmap", "policy"})
+
+	activeWatches = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_configmap_watches",
+		Help:      "Number of ConfigMaps being watched.",
+	})
+
+	inotifyEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "inotify_events_total",
+		Help:      "Number of inotify events received on local volumes, partitioned by whether they are handled.",
+	}, []string{"result"})
+
+	driftedVolumes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "drifted_volumes",
+		Help:      "Number of volumes of which local content drifts from their ConfigMaps.",
+	})
+
+	driftDetectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "drift_detections_total",
+		Help:      "Number of local drifts detected on volumes which don't commit changes.",
+	}, []string{"namespace", "configmap"})
+
+	staleVolumes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "stale_volumes",
+		Help:      "Number of stale volumes found by the garbage collector but not removed yet.",
+	})
+
+	gcRemovedVolumesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gc_removed_volumes_total",
+		Help:      "Number of stale volumes removed by the garbage collector.",
+	})
+
+	apiErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_errors_total",
+		Help:      "Number of failed Kubernetes API calls.",
+	}, []string{"resource", "verb"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		operationsTotal,
+		operationDuration,
+		refreshDuration,
+		commitAttemptsTotal,
+		conflictsTotal,
+		truncatedBytesTotal,
+		droppedKeysTotal,
+		activeWatches,
+		inotifyEventsTotal,
+		driftedVolumes,
+		driftDetectionsTotal,
+		staleVolumes,
+		gcRemovedVolumesTotal,
+		apiErrorsTotal,
+	)
+}
+
+const (
+	opMount   = "mount"
+	opUnmount = "unmount"
+
+	commitResultCommitted = "committed"
+	commitResultDiscarded = "discarded"
+	commitResultFailed    = "failed"
+	commitResultRejected  = "rejected"
+	commitResultUnchanged = "unchanged"
+
+	inotifyHandled = "handled"
+	inotifyIgnored = "ignored"
+)
+
+func observeOperation(op string, start time.Time, err error) {
+	operationsTotal.WithLabelValues(op, status.Code(err).String()).Inc()
+	operationDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+func recordAPIError(resource, verb string) {
+	apiErrorsTotal.WithLabelValues(resource, verb).Inc()
+}
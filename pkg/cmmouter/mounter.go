@@ -2,30 +2,77 @@ package cmmouter
 
 import (
 	"context"
+	"golang.org/x/xerrors"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
 	"k8s.io/utils/mount"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 type Mounter struct {
-	clientset    *kubernetes.Clientset
+	clientset    kubernetes.Interface
 	cmSourceRoot string
 
 	volumeMap *volumeMap
 	mounter   mount.Interface
 }
 
-func NewMounterOrDie(sourceRoot string) *Mounter {
+// MounterOptions configures behaviors of the Mounter.
+type MounterOptions struct {
+	// SourceRoot is the directory to save volumes and the state store.
+	SourceRoot string
+	// Node is the name of the node the Mounter runs on.
+	Node string
+	// AuthorizeMounts enables access reviews of pods to ConfigMaps before mounting them. ConfigMaps in other namespaces
+	// must be shared with pods whether or not it is enabled.
+	AuthorizeMounts bool
+	// TemplateEnv lists environment variables exposed to templates.
+	TemplateEnv []string
+	// Config is the base config of clientsets authenticated by pod tokens. Pod identities are not supported if nil.
+	Config *rest.Config
+	// GCInterval is the interval to collect stale volumes, of which pods are gone or targets are not mounted.
+	// Stale volumes are removed if they keep stale for GCGracePeriod. GC is disabled if GCInterval is 0.
+	GCInterval    time.Duration
+	GCGracePeriod time.Duration
+	// GCDryRun only reports stale volumes rather than removing them.
+	GCDryRun bool
+}
+
+// NewMounter creates a Mounter which accesses the cluster via the clientset and mounts volumes via the mounter.
+func NewMounter(clientset kubernetes.Interface, mounter mount.Interface, opts MounterOptions) (*Mounter, error) {
+	sourceRoot := opts.SourceRoot
 	if len(sourceRoot) == 0 || !filepath.IsAbs(sourceRoot) {
-		klog.Fatal("--mount-root must be an absolute path")
+		return nil, xerrors.Errorf("source root %q must be an absolute path", sourceRoot)
 	}
 
-	config, err := rest.InClusterConfig()
+	volMap, err := createVolumeMap(clientset, mounter, createEventRecorder(clientset, opts.Node), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = volMap.build(); err != nil {
+		return nil, err
+	}
+
+	volMap.startGC()
+
+	return &Mounter{
+		cmSourceRoot: sourceRoot,
+		clientset:    clientset,
+		volumeMap:    volMap,
+		mounter:      mounter,
+	}, nil
+}
+
+// NewMounterOrDie creates a Mounter with the kubeconfig or the master URL, or the in-cluster config if neither is set.
+func NewMounterOrDie(kubeconfig, master string, opts MounterOptions) *Mounter {
+	config, err := clientcmd.BuildConfigFromFlags(master, kubeconfig)
 	if err != nil {
 		klog.Fatalf("unable to fetch cluster config: %s", err)
 	}
@@ -35,22 +82,30 @@ func NewMounterOrDie(sourceRoot string) *Mounter {
 		klog.Fatalf("unable to create k8s clientset: %s", err)
 	}
 
-	volRoot := filepath.Join(sourceRoot, "volumes")
-	metaRoot := filepath.Join(sourceRoot, "metadata")
-	for _, dir := range []string{volRoot, metaRoot} {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			klog.Fatalf("unable to mkdir %q: %s", dir, err)
-		}
+	opts.Config = config
+	m, err := NewMounter(clientset, mount.New(""), opts)
+	if err != nil {
+		klog.Fatalf("unable to create the mounter: %s", err)
 	}
 
-	volMap := createVolumeMap(clientset, sourceRoot)
-	volMap.buildOrDie()
-	return &Mounter{
-		cmSourceRoot: sourceRoot,
-		clientset:    clientset,
-		volumeMap:    volMap,
-		mounter:      mount.New(""),
+	return m
+}
+
+// Stop stops watching ConfigMaps and volumes, then commits local changes of volumes committed on modification.
+// Commits not done before the deadline of ctx, as well as refreshes held back by rollout policies, are resumed
+// on the next start. The Mounter can't mount or unmount volumes after being stopped.
+func (m *Mounter) Stop(ctx context.Context) error {
+	return m.volumeMap.stop(ctx)
+}
+
+// VolumeStats returns usage of the volume. Volumes which don't commit changes are abnormal if they drift from their
+// ConfigMaps.
+func (m *Mounter) VolumeStats(volumeID string) (*VolumeStats, error) {
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "missing volumeId")
 	}
+
+	return m.volumeMap.volumeStats(volumeID)
 }
 
 type ConditionCommitChanges string
@@ -77,17 +132,109 @@ const (
 	TruncateTailLine ConfigMapOversizePolicy = "truncateTailLine"
 )
 
+// ConfigMapBinaryOversizePolicy determines what happens to changes of BinaryData which don't fit in the ConfigMap.
+type ConfigMapBinaryOversizePolicy string
+
+const (
+	// RejectBinaryKey drops changes of keys which don't fit but keeps them in the volume. It is the default policy.
+	RejectBinaryKey ConfigMapBinaryOversizePolicy = "rejectKey"
+	// KeepPreviousBinary drops changes of keys which don't fit and restores their committed values in the volume.
+	KeepPreviousBinary ConfigMapBinaryOversizePolicy = "keepPrevious"
+	// ShardBinary moves keys which don't fit to shard ConfigMaps owned by the ConfigMap.
+	ShardBinary ConfigMapBinaryOversizePolicy = "shard"
+)
+
+// ConfigMapRefMode determines how volumes find the ConfigMap to mount.
+type ConfigMapRefMode string
+
+const (
+	// NoRef mounts the ConfigMap named by the volume.
+	NoRef ConfigMapRefMode = ""
+	// RefPointer mounts the ConfigMap named by the key "configMap" of the pointer ConfigMap named by the volume.
+	RefPointer ConfigMapRefMode = "pointer"
+	// RefSelector mounts the highest version of ConfigMaps matching the label selector given by the volume.
+	RefSelector ConfigMapRefMode = "selector"
+)
+
+// ConfigMapReadOnlyPolicy determines whether volumes are mounted read-only.
+type ConfigMapReadOnlyPolicy string
+
+const (
+	// ReadOnlyAuto mounts volumes read-only unless commitChangesOn is set. It is the default policy.
+	ReadOnlyAuto   ConfigMapReadOnlyPolicy = "auto"
+	ReadOnlyAlways ConfigMapReadOnlyPolicy = "true"
+	ReadOnlyNever  ConfigMapReadOnlyPolicy = "false"
+)
+
+// PodInfo is the information of the pod which mounts the volume. kubelet passes it if podInfoOnMount is enabled.
+type PodInfo struct {
+	Pod            string `json:"pod"`
+	PodNamespace   string `json:"podNamespace"`
+	PodUID         string `json:"podUID,omitempty"`
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+	// FSGroup is the fsGroup of the pod passed via VolumeMountGroup.
+	FSGroup *int64 `json:"fsGroup,omitempty"`
+	// Token is the ServiceAccount token of the pod. It is never persisted.
+	Token string `json:"-"`
+}
+
 type ConfigMapOptions struct {
 	SubPath           string                  `json:"subPath,omitempty"`
 	KeepCurrentAlways bool                    `json:"keepCurrentAlways,omitempty"`
 	CommitChangesOn   ConditionCommitChanges  `json:"commitChangesOn,omitempty"`
 	ConflictPolicy    ConfigMapConflictPolicy `json:"conflictPolicy,omitempty"`
 	OversizePolicy    ConfigMapOversizePolicy `json:"oversizePolicy,omitempty"`
+	UsePodIdentity    bool                    `json:"usePodIdentity,omitempty"`
+	// BinaryOversizePolicy applies to each key of BinaryData if local changes exceed the size limit.
+	BinaryOversizePolicy ConfigMapBinaryOversizePolicy `json:"binaryOversizePolicy,omitempty"`
+	// ConfigMapRef follows a pointer ConfigMap or a label selector and switches volumes once the target changes.
+	ConfigMapRef ConfigMapRefMode `json:"configMapRef,omitempty"`
+	// VersionPointer commits changes of immutable ConfigMaps as new versions and points the pointer ConfigMap to them.
+	VersionPointer string `json:"versionPointer,omitempty"`
+	// Items, Include and Exclude select keys to be saved in the volume. Items also map keys to custom paths.
+	Items   []KeyToPath `json:"items,omitempty"`
+	Include []string    `json:"include,omitempty"`
+	Exclude []string    `json:"exclude,omitempty"`
+	// DefaultMode, UID and GID are applied to files in the volume after each refresh.
+	DefaultMode *int32 `json:"defaultMode,omitempty"`
+	UID         *int64 `json:"uid,omitempty"`
+	GID         *int64 `json:"gid,omitempty"`
+	// Render values of the ConfigMap before saving them.
+	Render ConfigMapRenderMode `json:"render,omitempty"`
+	// Format and FileName serialize all values into a single file.
+	Format   ConfigMapFormat `json:"format,omitempty"`
+	FileName string          `json:"fileName,omitempty"`
+	// Validate checks local changes before committing them.
+	Validate []ValueValidator `json:"validate,omitempty"`
+	// PinResourceVersion and PinContentHash mount the specific revision of the ConfigMap.
+	PinResourceVersion string `json:"pinResourceVersion,omitempty"`
+	PinContentHash     string `json:"pinContentHash,omitempty"`
+	// RetainRevisions snapshots revisions before and after each commit and keeps the latest ones, unless the
+	// ConfigMap sets the number itself.
+	RetainRevisions int `json:"retainRevisions,omitempty"`
+	// NotifyFile, NotifyFIFO and NotifyHTTP notify the application after each refresh.
+	NotifyFile string `json:"notifyFile,omitempty"`
+	NotifyFIFO string `json:"notifyFIFO,omitempty"`
+	NotifyHTTP string `json:"notifyHTTP,omitempty"`
+	// UpdateDelay, UpdateJitter, RolloutWaves and WaveInterval stagger refreshes. Pods are distributed to waves,
+	// which are ascending cumulative percentages, by hashes of their names.
+	UpdateDelay  time.Duration `json:"updateDelay,omitempty"`
+	UpdateJitter time.Duration `json:"updateJitter,omitempty"`
+	RolloutWaves []int         `json:"rolloutWaves,omitempty"`
+	WaveInterval time.Duration `json:"waveInterval,omitempty"`
+	// EnforceContent restores local drift of volumes which don't commit changes.
+	EnforceContent bool `json:"enforceContent,omitempty"`
+	// ReadOnly is resolved to either ReadOnlyAlways or ReadOnlyNever on mount.
+	ReadOnly ConfigMapReadOnlyPolicy `json:"readOnly,omitempty"`
 }
 
 func (m *Mounter) Mount(
-	ctx context.Context, volumeID, targetPath, cmName, cmNamespace, pod, podNs string, opts ConfigMapOptions, ro bool,
-) error {
+	ctx context.Context, volumeID, targetPath, cmName, cmNamespace string, pod PodInfo, opts ConfigMapOptions, ro bool,
+) (err error) {
+	defer func(start time.Time) {
+		observeOperation(opMount, start, err)
+	}(time.Now())
+
 	if len(volumeID) == 0 {
 		return status.Error(codes.InvalidArgument, "missing volumeId")
 	}
@@ -104,14 +251,66 @@ func (m *Mounter) Mount(
 		return status.Error(codes.InvalidArgument, "missing namespace")
 	}
 
-	if len(pod) == 0 {
+	if len(pod.Pod) == 0 {
 		return status.Error(codes.InvalidArgument, "missing pod name")
 	}
 
-	if len(podNs) == 0 {
+	if len(pod.PodNamespace) == 0 {
 		return status.Error(codes.InvalidArgument, "missing pod namespace")
 	}
 
+	if err = opts.validateKeyMapping(); err != nil {
+		return err
+	}
+
+	if err = opts.validateOwnership(); err != nil {
+		return err
+	}
+
+	if err = opts.validateRender(); err != nil {
+		return err
+	}
+
+	if err = opts.validateFormat(); err != nil {
+		return err
+	}
+
+	if err = opts.validateValidators(); err != nil {
+		return err
+	}
+
+	if err = opts.validatePin(); err != nil {
+		return err
+	}
+
+	if err = opts.validateRetainRevisions(); err != nil {
+		return err
+	}
+
+	if err = opts.validateNotify(); err != nil {
+		return err
+	}
+
+	if err = opts.validateRollout(); err != nil {
+		return err
+	}
+
+	if err = opts.validateEnforceContent(); err != nil {
+		return err
+	}
+
+	if err = opts.validateVersionPointer(); err != nil {
+		return err
+	}
+
+	if err = opts.validateRef(cmName); err != nil {
+		return err
+	}
+
+	if err = opts.resolveReadOnly(ro); err != nil {
+		return err
+	}
+
 	if notMnt, err := mount.IsNotMountPoint(m.mounter, targetPath); err != nil {
 		if !os.IsNotExist(err) {
 			return status.Error(codes.Internal, err.Error())
@@ -129,7 +328,13 @@ func (m *Mounter) Mount(
 			}
 		}
 	} else if !notMnt {
-		klog.Warning("%q is already mounted", targetPath)
+		klog.Warningf("%q is already mounted", targetPath)
+		if opts.UsePodIdentity && len(pod.Token) > 0 {
+			// kubelet republishes volumes periodically to rotate tokens
+			klog.Infof("refresh token of volume %q", volumeID)
+			return m.volumeMap.saveToken(volumeID, pod.Token)
+		}
+
 		return nil
 	}
 
@@ -151,24 +356,42 @@ func (m *Mounter) Mount(
 				"oversizePolicy is required if commitChangesOn is enabled. valid values are %q, %q, %q and %q",
 				TruncateHead, TruncateHeadLine, TruncateTail, TruncateTailLine)
 		}
+
+		switch opts.BinaryOversizePolicy {
+		case "", RejectBinaryKey, KeepPreviousBinary, ShardBinary:
+		default:
+			return status.Errorf(codes.InvalidArgument, "valid values of %q are %q, %q and %q",
+				"binaryOversizePolicy", RejectBinaryKey, KeepPreviousBinary, ShardBinary)
+		}
 	default:
 		return status.Errorf(codes.InvalidArgument, "valid values of %q are %q, %q, and %q",
 			"commitChangesOn", NoCommit, CommitOnModify, CommitOnUnmount)
 	}
 
-	source, err := m.volumeMap.prepareVolume(ctx, volumeID, targetPath, cmName, cmNamespace, pod, podNs, opts)
+	source, err := m.volumeMap.prepareVolume(ctx, volumeID, targetPath, cmName, cmNamespace, pod, opts)
 	if err != nil {
 		return err
 	}
 
 	mountOpts := []string{"rbind"}
-	if ro {
-		mountOpts = append(mountOpts, "ro")
+	if opts.ReadOnly == ReadOnlyAlways {
+		// The kernel ignores "ro" of new bind mounts. The mounter remounts the target read-only only if "bind" is set,
+		// and then always mounts it with "bind" first. Sources have no submounts, so "bind" works the same as "rbind".
+		mountOpts = []string{"bind", "ro"}
+	}
+
+	if err = m.mounter.Mount(source, targetPath, "", mountOpts); err != nil {
+		return status.Error(codes.Internal, err.Error())
 	}
-	return m.mounter.Mount(source, targetPath, "", mountOpts)
+
+	return nil
 }
 
-func (m *Mounter) Unmount(ctx context.Context, volumeID, targetPath string) error {
+func (m *Mounter) Unmount(ctx context.Context, volumeID, targetPath string) (err error) {
+	defer func(start time.Time) {
+		observeOperation(opUnmount, start, err)
+	}(time.Now())
+
 	if len(volumeID) == 0 {
 		return status.Error(codes.InvalidArgument, "missing volumeId")
 	}
@@ -177,14 +400,15 @@ func (m *Mounter) Unmount(ctx context.Context, volumeID, targetPath string) erro
 		return status.Error(codes.InvalidArgument, "missing targetPath")
 	}
 
+	// Retries should also clean up the volume if the target has been unmounted.
 	if notMnt, err := mount.IsNotMountPoint(m.mounter, targetPath); err != nil {
-		return status.Error(codes.Unavailable, err.Error())
-	} else if notMnt {
-		return nil
-	}
-
-	if err := m.mounter.Unmount(targetPath); err != nil {
-		return err
+		if !os.IsNotExist(err) {
+			return status.Error(codes.Unavailable, err.Error())
+		}
+	} else if !notMnt {
+		if err := m.mounter.Unmount(targetPath); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
 	}
 
 	return m.volumeMap.unmountVolume(ctx, volumeID)
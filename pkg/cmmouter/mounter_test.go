@@ -0,0 +1,1708 @@
+package cmmouter
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/xerrors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/utils/mount"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testNamespace = "foo"
+	testConfigMap = "cm-foo"
+)
+
+var configMapsResource = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+
+// testHarness drives a Mounter against a fake clientset, a fake mounter and a temporary source root.
+type testHarness struct {
+	t         *testing.T
+	root      string
+	clientset *fake.Clientset
+	mounter   *mount.FakeMounter
+	m         *Mounter
+}
+
+// newFakeClientset returns a fake clientset which, like the API server, bumps ResourceVersions of ConfigMaps and
+// rejects updates with stale ResourceVersions.
+func newFakeClientset(objects ...runtime.Object) *fake.Clientset {
+	clientset := fake.NewSimpleClientset(objects...)
+	guard := sync.Mutex{}
+	rv := 100
+	clientset.PrependReactor("*", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetVerb() != "create" && action.GetVerb() != "update" {
+			return false, nil, nil
+		}
+
+		cm := action.(k8stesting.CreateAction).GetObject().(*corev1.ConfigMap)
+		guard.Lock()
+		defer guard.Unlock()
+		if action.GetVerb() == "update" {
+			current, err := clientset.Tracker().Get(configMapsResource, cm.Namespace, cm.Name)
+			if err == nil && current.(*corev1.ConfigMap).ResourceVersion != cm.ResourceVersion {
+				return true, nil, errors.NewConflict(configMapsResource.GroupResource(), cm.Name,
+					xerrors.New("stale ResourceVersion"))
+			}
+		}
+
+		rv++
+		cm.ResourceVersion = strconv.Itoa(rv)
+		return false, nil, nil
+	})
+
+	return clientset
+}
+
+func newTestHarness(t *testing.T, data map[string]string) *testHarness {
+	root, err := ioutil.TempDir("", "cm-harness")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: testConfigMap, Namespace: testNamespace, ResourceVersion: "1"},
+		Data:       data,
+	}
+
+	h := &testHarness{
+		t:         t,
+		root:      root,
+		clientset: newFakeClientset(cm, podOf("pod-0"), podOf("pod-1")),
+		mounter:   mount.NewFakeMounter(nil),
+	}
+
+	h.start()
+	return h
+}
+
+func podOf(name string) *corev1.Pod {
+	return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace}}
+}
+
+func (h *testHarness) start() {
+	m, err := NewMounter(h.clientset, h.mounter, MounterOptions{SourceRoot: h.root, Node: "node"})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	h.m = m
+}
+
+// crash stops the Mounter without draining or unmounting volumes, like the plugin is killed.
+func (h *testHarness) crash() {
+	h.m.volumeMap.volGuard.Lock()
+	h.m.volumeMap.stopped = true
+	h.m.volumeMap.volGuard.Unlock()
+
+	h.m.volumeMap.stopGC()
+	h.m.volumeMap.cmWatcher.stop()
+	h.m.volumeMap.volWatcher.stop()
+	h.m.volumeMap.stateStore.close()
+}
+
+func (h *testHarness) cleanup() {
+	if !h.m.volumeMap.stopped {
+		h.crash()
+	}
+
+	os.RemoveAll(h.root)
+}
+
+func (h *testHarness) mount(volumeID, pod string, opts ConfigMapOptions) {
+	target := filepath.Join(h.root, "targets", volumeID)
+	if len(opts.SubPath) == 0 {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			h.t.Fatal(err)
+		}
+	} else if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		h.t.Fatal(err)
+	}
+
+	watches := h.countWatches()
+	_, watching := h.m.volumeMap.cmWatcher.watcherMap[cmKeyOf(testConfigMap, testNamespace)]
+	if err := h.m.Mount(context.TODO(), volumeID, target, testConfigMap, testNamespace,
+		PodInfo{Pod: pod, PodNamespace: testNamespace}, opts, false); err != nil {
+		h.t.Fatalf("unable to mount volume %q: %s", volumeID, err)
+	}
+
+	if opts.KeepCurrentAlways && !watching {
+		h.waitForWatch(watches)
+	}
+}
+
+func (h *testHarness) unmount(volumeID string) {
+	target := filepath.Join(h.root, "targets", volumeID)
+	if err := h.m.Unmount(context.TODO(), volumeID, target); err != nil {
+		h.t.Fatalf("unable to unmount volume %q: %s", volumeID, err)
+	}
+}
+
+func (h *testHarness) countWatches() (n int) {
+	for _, action := range h.clientset.Actions() {
+		if action.GetVerb() == "watch" && action.GetResource() == configMapsResource {
+			n++
+		}
+	}
+
+	return
+}
+
+// waitForWatch waits for a new watch since events before it starts are missed by fake clientsets.
+func (h *testHarness) waitForWatch(watches int) {
+	h.eventually("configmap watch", func() bool { return h.countWatches() > watches })
+}
+
+func (h *testHarness) eventually(what string, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	h.t.Fatalf("timed out waiting for %s", what)
+}
+
+func (h *testHarness) volumePath(volumeID string, file ...string) string {
+	return filepath.Join(append([]string{h.root, "volumes", volumeID}, file...)...)
+}
+
+func (h *testHarness) readVolume(volumeID string, file ...string) string {
+	content, err := ioutil.ReadFile(h.volumePath(volumeID, file...))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	return string(content)
+}
+
+func (h *testHarness) writeVolume(volumeID, content string, file ...string) {
+	if err := ioutil.WriteFile(h.volumePath(volumeID, file...), []byte(content), 0644); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+func (h *testHarness) configMap() *corev1.ConfigMap {
+	cm, err := h.clientset.CoreV1().ConfigMaps(testNamespace).Get(context.TODO(), testConfigMap, metav1.GetOptions{})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	return cm
+}
+
+func (h *testHarness) updateConfigMap(data map[string]string) {
+	cm := h.configMap()
+	cm.Data = data
+	if _, err := h.clientset.CoreV1().ConfigMaps(testNamespace).Update(context.TODO(), cm,
+		metav1.UpdateOptions{}); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+func commitAttempts(result string) float64 {
+	return testutil.ToFloat64(commitAttemptsTotal.WithLabelValues(testNamespace, testConfigMap, result))
+}
+
+func TestMountAndUnmount(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo", "bar.txt": "bar"})
+	defer h.cleanup()
+
+	h.mount("vol-dir", "pod-0", ConfigMapOptions{})
+	h.mount("vol-file", "pod-0", ConfigMapOptions{SubPath: "bar.txt"})
+	if h.readVolume("vol-dir", "foo.txt") != "foo" || h.readVolume("vol-dir", "bar.txt") != "bar" {
+		t.Error("unexpected content of the directory volume")
+	}
+
+	if h.readVolume("vol-file") != "bar" {
+		t.Error("unexpected content of the subPath volume")
+	}
+
+	if mounts, _ := h.mounter.List(); len(mounts) != 2 {
+		t.Errorf("volumes should be mounted, but got %#v", mounts)
+	}
+
+	h.unmount("vol-dir")
+	h.unmount("vol-file")
+	// unmounting twice is fine
+	h.unmount("vol-file")
+	for _, vol := range []string{"vol-dir", "vol-file"} {
+		if _, err := os.Stat(h.volumePath(vol)); !os.IsNotExist(err) {
+			t.Errorf("volume %q should be removed", vol)
+		}
+
+		if _, err := h.m.volumeMap.loadMetadata(vol); !os.IsNotExist(err) {
+			t.Errorf("metadata of volume %q should be removed", vol)
+		}
+	}
+}
+
+func TestKeepCurrentAlways(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo", "bar.txt": "bar"})
+	defer h.cleanup()
+
+	h.mount("vol-dir", "pod-0", ConfigMapOptions{KeepCurrentAlways: true})
+	h.mount("vol-file", "pod-1", ConfigMapOptions{KeepCurrentAlways: true, SubPath: "foo.txt"})
+	h.updateConfigMap(map[string]string{"foo.txt": "foo-v2", "bar.txt": "bar-v2"})
+	h.eventually("refreshing volumes", func() bool {
+		return h.readVolume("vol-dir", "foo.txt") == "foo-v2" && h.readVolume("vol-dir", "bar.txt") == "bar-v2" &&
+			h.readVolume("vol-file") == "foo-v2"
+	})
+
+	h.unmount("vol-dir")
+	h.updateConfigMap(map[string]string{"foo.txt": "foo-v3", "bar.txt": "bar-v3"})
+	h.eventually("refreshing the subPath volume", func() bool { return h.readVolume("vol-file") == "foo-v3" })
+	h.unmount("vol-file")
+	if len(h.m.volumeMap.cmWatcher.watcherMap) > 0 {
+		t.Error("watchers should be removed")
+	}
+}
+
+func TestCommitOnUnmount(t *testing.T) {
+	for _, subPath := range []string{"", "foo.txt"} {
+		h := newTestHarness(t, map[string]string{"foo.txt": "foo", "bar.txt": "bar"})
+		opts := ConfigMapOptions{
+			SubPath:         subPath,
+			CommitChangesOn: CommitOnUnmount,
+			ConflictPolicy:  OverrideRemoteChanges,
+			OversizePolicy:  TruncateHeadLine,
+		}
+
+		h.mount("vol-override", "pod-0", opts)
+		opts.ConflictPolicy = DiscardLocalChanges
+		h.mount("vol-discard", "pod-1", opts)
+		h.updateConfigMap(map[string]string{"foo.txt": "remote", "bar.txt": "bar"})
+
+		if len(subPath) == 0 {
+			h.writeVolume("vol-discard", "discarded", "foo.txt")
+			h.writeVolume("vol-override", "override", "foo.txt")
+		} else {
+			h.writeVolume("vol-discard", "discarded")
+			h.writeVolume("vol-override", "override")
+		}
+
+		h.unmount("vol-discard")
+		if cm := h.configMap(); cm.Data["foo.txt"] != "remote" {
+			t.Errorf("subPath %q: local changes should be discarded, but got %q", subPath, cm.Data["foo.txt"])
+		}
+
+		h.unmount("vol-override")
+		if cm := h.configMap(); cm.Data["foo.txt"] != "override" || cm.Data["bar.txt"] != "bar" {
+			t.Errorf("subPath %q: remote changes should be overridden, but got %#v", subPath, cm.Data)
+		}
+
+		h.cleanup()
+	}
+}
+
+func TestCommitOnModify(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo", "bar.txt": "bar"})
+	defer h.cleanup()
+
+	opts := ConfigMapOptions{
+		CommitChangesOn: CommitOnModify,
+		ConflictPolicy:  OverrideRemoteChanges,
+		OversizePolicy:  TruncateHeadLine,
+	}
+
+	h.mount("vol-override", "pod-0", opts)
+	h.writeVolume("vol-override", "modified", "foo.txt")
+	h.eventually("committing local changes", func() bool { return h.configMap().Data["foo.txt"] == "modified" })
+
+	opts.ConflictPolicy = DiscardLocalChanges
+	opts.SubPath = "bar.txt"
+	h.mount("vol-discard", "pod-1", opts)
+	h.updateConfigMap(map[string]string{"foo.txt": "modified", "bar.txt": "remote"})
+	discarded := commitAttempts(commitResultDiscarded)
+	h.writeVolume("vol-discard", "discarded")
+	h.eventually("discarding local changes", func() bool { return commitAttempts(commitResultDiscarded) > discarded })
+	if cm := h.configMap(); cm.Data["bar.txt"] != "remote" {
+		t.Errorf("local changes should be discarded, but got %q", cm.Data["bar.txt"])
+	}
+
+	h.unmount("vol-override")
+	h.unmount("vol-discard")
+}
+
+func TestCommitNestedItems(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo", "bar.txt": "bar"})
+	defer h.cleanup()
+
+	h.mount("vol-items", "pod-0", ConfigMapOptions{
+		CommitChangesOn: CommitOnModify,
+		ConflictPolicy:  OverrideRemoteChanges,
+		OversizePolicy:  TruncateHeadLine,
+		Items:           []KeyToPath{{Key: "foo.txt", Path: "etc/app/foo.conf"}, {Key: "bar.txt"}},
+	})
+
+	h.writeVolume("vol-items", "modified", "etc", "app", "foo.conf")
+	h.eventually("committing changes of nested items", func() bool {
+		return h.configMap().Data["foo.txt"] == "modified"
+	})
+
+	h.unmount("vol-items")
+	if n := len(h.m.volumeMap.volWatcher.subDirs); n != 0 {
+		t.Errorf("watches on subdirectories should be removed, but got %d volumes", n)
+	}
+}
+
+func TestOversizePolicies(t *testing.T) {
+	payload := strings.Repeat("X", configMapSizeHardLimit)
+	cases := []struct {
+		policy   ConfigMapOversizePolicy
+		local    string
+		expected string
+	}{
+		{TruncateHead, "head-" + payload, payload},
+		{TruncateHeadLine, payload + "\nonlyline\n", "onlyline\n"},
+		{TruncateTail, payload + "-tail", payload},
+		{TruncateTailLine, "onlyline\n" + payload, "onlyline\n"},
+	}
+
+	for _, c := range cases {
+		h := newTestHarness(t, map[string]string{"foo.txt": "foo"})
+		h.mount("vol", "pod-0", ConfigMapOptions{
+			SubPath:         "foo.txt",
+			CommitChangesOn: CommitOnUnmount,
+			ConflictPolicy:  OverrideRemoteChanges,
+			OversizePolicy:  c.policy,
+		})
+
+		h.writeVolume("vol", c.local)
+		h.unmount("vol")
+		if v := h.configMap().Data["foo.txt"]; v != c.expected {
+			t.Errorf("%s: unexpected value of %d bytes", c.policy, len(v))
+		}
+
+		h.cleanup()
+	}
+}
+
+func TestBinaryOversizePolicies(t *testing.T) {
+	large := strings.Repeat("A", 700<<10)
+	medium := strings.Repeat("B", 600<<10)
+	cases := []struct {
+		policy  ConfigMapBinaryOversizePolicy
+		localA  string
+		sharded bool
+	}{
+		{RejectBinaryKey, large, false},
+		{KeepPreviousBinary, "a", false},
+		{ShardBinary, large, true},
+	}
+
+	for _, c := range cases {
+		h := newTestHarness(t, map[string]string{"foo.txt": "foo"})
+		cm := h.configMap()
+		cm.BinaryData = map[string][]byte{"a.bin": []byte("a"), "b.bin": []byte("b")}
+		if _, err := h.clientset.CoreV1().ConfigMaps(testNamespace).Update(context.TODO(), cm,
+			metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		h.mount("vol", "pod-0", ConfigMapOptions{
+			CommitChangesOn:      CommitOnUnmount,
+			ConflictPolicy:       OverrideRemoteChanges,
+			OversizePolicy:       TruncateTail,
+			BinaryOversizePolicy: c.policy,
+		})
+
+		h.writeVolume("vol", "bar", "foo.txt")
+		h.writeVolume("vol", large, "a.bin")
+		h.writeVolume("vol", medium, "b.bin")
+
+		vm := h.m.volumeMap
+		vm.volGuard.Lock()
+		err := vm.commitLocalVolumeChanges(context.TODO(), "vol", vm.metadataMap["vol"])
+		vm.volGuard.Unlock()
+		if err != nil {
+			t.Fatalf("%s: %s", c.policy, err)
+		}
+
+		cm = h.configMap()
+		if cm.Data["foo.txt"] != "bar" || string(cm.BinaryData["b.bin"]) != medium {
+			t.Errorf("%s: changes which fit are not committed", c.policy)
+		}
+
+		if v := h.readVolume("vol", "a.bin"); v != c.localA {
+			t.Errorf("%s: unexpected local a.bin of %d bytes", c.policy, len(v))
+		}
+
+		_, sharded := cm.Annotations[annotationShards]
+		if sharded != c.sharded {
+			t.Errorf("%s: expected sharded %t", c.policy, c.sharded)
+		}
+
+		if !c.sharded {
+			if string(cm.BinaryData["a.bin"]) != "a" {
+				t.Errorf("%s: dropped changes of a.bin are committed", c.policy)
+			}
+
+			h.cleanup()
+			continue
+		}
+
+		if _, found := cm.BinaryData["a.bin"]; found {
+			t.Errorf("%s: a.bin is not moved to the shard", c.policy)
+		}
+
+		shards, err := shardsOf(cm)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		shard, err := h.clientset.CoreV1().ConfigMaps(testNamespace).Get(context.TODO(), shards["a.bin"].ConfigMap,
+			metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(shard.BinaryData["a.bin"]) != large || shard.OwnerReferences[0].Name != testConfigMap {
+			t.Errorf("%s: unexpected shard", c.policy)
+		}
+
+		h.mount("vol-1", "pod-1", ConfigMapOptions{})
+		if v := h.readVolume("vol-1", "a.bin"); v != large {
+			t.Errorf("%s: shard isn't merged into new volumes. got %d bytes", c.policy, len(v))
+		}
+
+		h.cleanup()
+	}
+}
+
+func TestShardConsistency(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo"})
+	defer h.cleanup()
+
+	var apiDown int32
+	h.clientset.PrependReactor("update", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if atomic.LoadInt32(&apiDown) > 0 {
+			return true, nil, errors.NewServiceUnavailable("unavailable")
+		}
+
+		return false, nil, nil
+	})
+
+	large := strings.Repeat("A", 700<<10)
+	cm := h.configMap()
+	cm.BinaryData = map[string][]byte{"a.bin": []byte("a"), "b.bin": []byte(strings.Repeat("B", 600<<10))}
+	if _, err := h.clientset.CoreV1().ConfigMaps(testNamespace).Update(context.TODO(), cm,
+		metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.mount("vol", "pod-0", ConfigMapOptions{
+		CommitChangesOn:      CommitOnUnmount,
+		ConflictPolicy:       OverrideRemoteChanges,
+		OversizePolicy:       TruncateTail,
+		BinaryOversizePolicy: ShardBinary,
+	})
+
+	vm := h.m.volumeMap
+	commit := func() error {
+		vm.volGuard.Lock()
+		defer vm.volGuard.Unlock()
+		return vm.commitLocalVolumeChanges(context.TODO(), "vol", vm.metadataMap["vol"])
+	}
+
+	shardOf := func() (string, []string) {
+		shards, err := shardsOf(h.configMap())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		list, err := h.clientset.CoreV1().ConfigMaps(testNamespace).List(context.TODO(), metav1.ListOptions{
+			LabelSelector: labelShardOf + "=" + testConfigMap,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, shard := range list.Items {
+			names = append(names, shard.Name)
+		}
+
+		return shards["a.bin"].ConfigMap, names
+	}
+
+	h.writeVolume("vol", large, "a.bin")
+	if err := commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	committed, shards := shardOf()
+	if len(shards) != 1 || shards[0] != committed {
+		t.Fatalf("expect shard %q, but got %v", committed, shards)
+	}
+
+	// Shards stay consistent with the ConfigMap if it fails to be updated.
+	atomic.StoreInt32(&apiDown, 1)
+	updated := strings.Repeat("C", 700<<10)
+	h.writeVolume("vol", updated, "a.bin")
+	if err := commit(); err == nil {
+		t.Fatal("commits should fail while the API server is unavailable")
+	}
+
+	if current, shards := shardOf(); current != committed || len(shards) != 1 || shards[0] != committed {
+		t.Fatalf("failed commits should leave shards untouched, but got %q and %v", current, shards)
+	}
+
+	h.mount("vol-1", "pod-1", ConfigMapOptions{})
+	if v := h.readVolume("vol-1", "a.bin"); v != large {
+		t.Errorf("shards of the ConfigMap are changed by failed commits. got %d bytes", len(v))
+	}
+
+	// Shards replaced by the commit are removed after the ConfigMap is updated.
+	atomic.StoreInt32(&apiDown, 0)
+	if err := commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	current, shards := shardOf()
+	if current == committed || len(shards) != 1 || shards[0] != current {
+		t.Fatalf("expect the only shard %q, but got %v", current, shards)
+	}
+
+	// Nothing is updated if the volume doesn't change.
+	rv := h.configMap().ResourceVersion
+	h.writeVolume("vol", updated, "a.bin")
+	if err := commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if cm := h.configMap(); cm.ResourceVersion != rv {
+		t.Errorf("unchanged volumes should not be committed, but got ResourceVersion %s", cm.ResourceVersion)
+	}
+}
+
+func TestShardedRevisions(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo"})
+	defer h.cleanup()
+
+	cm := h.configMap()
+	cm.BinaryData = map[string][]byte{"a.bin": []byte("a"), "b.bin": []byte(strings.Repeat("B", 600<<10))}
+	if _, err := h.clientset.CoreV1().ConfigMaps(testNamespace).Update(context.TODO(), cm,
+		metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.mount("vol", "pod-0", ConfigMapOptions{
+		CommitChangesOn:      CommitOnUnmount,
+		ConflictPolicy:       OverrideRemoteChanges,
+		OversizePolicy:       TruncateTail,
+		BinaryOversizePolicy: ShardBinary,
+		RetainRevisions:      5,
+	})
+	h.mount("vol-current", "pod-1", ConfigMapOptions{KeepCurrentAlways: true})
+
+	vm := h.m.volumeMap
+	commit := func(content string) (string, string) {
+		h.writeVolume("vol", content, "a.bin")
+		vm.volGuard.Lock()
+		err := vm.commitLocalVolumeChanges(context.TODO(), "vol", vm.metadataMap["vol"])
+		vm.volGuard.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cm := h.configMap()
+		shards, err := shardsOf(cm)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return cm.ResourceVersion, shards["a.bin"].ConfigMap
+	}
+
+	large := strings.Repeat("A", 700<<10)
+	rv, shard := commit(large)
+	_, replacing := commit(strings.Repeat("C", 700<<10))
+
+	// The replaced shard is kept for the snapshot of the previous revision.
+	if _, err := h.clientset.CoreV1().ConfigMaps(testNamespace).Get(context.TODO(), shard,
+		metav1.GetOptions{}); err != nil {
+		t.Fatalf("shards referred by snapshots should be kept, but got %s", err)
+	}
+
+	snapshots, err := listSnapshots(context.TODO(), h.clientset, h.configMap())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashes := map[string]bool{}
+	for _, snapshot := range snapshots {
+		if _, found := snapshot.BinaryData["a.bin"]; found && snapshot.Annotations[annotationShards] != "" {
+			t.Errorf("sharded values should not be copied to snapshot %q", snapshot.Name)
+		}
+
+		hashes[snapshot.Annotations[annotationSnapshotContentHash]] = true
+	}
+
+	if len(hashes) != 3 {
+		t.Errorf("content hashes should cover sharded keys, but got %d hashes of 3 revisions", len(hashes))
+	}
+
+	h.mount("vol-pinned", "pod-2", ConfigMapOptions{PinResourceVersion: rv})
+	if v := h.readVolume("vol-pinned", "a.bin"); v != large {
+		t.Errorf("pinned volumes should be of the sharded value of the revision, but got %d bytes", len(v))
+	}
+
+	cm = h.configMap()
+	cm.Annotations[annotationRollbackTo] = rv
+	if _, err = h.clientset.CoreV1().ConfigMaps(testNamespace).Update(context.TODO(), cm,
+		metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.eventually("rolling back the sharded key", func() bool {
+		_, requested := h.configMap().Annotations[annotationRollbackTo]
+		return !requested && h.readVolume("vol-current", "a.bin") == large
+	})
+
+	shards, err := shardsOf(h.configMap())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if shards["a.bin"].ConfigMap != shard {
+		t.Errorf("the rolled back ConfigMap should refer to shard %q, but got %q", shard, shards["a.bin"].ConfigMap)
+	}
+
+	if _, err = h.clientset.CoreV1().ConfigMaps(testNamespace).Get(context.TODO(), replacing,
+		metav1.GetOptions{}); err != nil {
+		t.Errorf("shards referred by snapshots should be kept after rollbacks, but got %s", err)
+	}
+
+	// Shards are deleted along with the last snapshots referring to them.
+	cm = h.configMap()
+	cm.Annotations[annotationRetainRevisions] = "1"
+	if _, err = h.clientset.CoreV1().ConfigMaps(testNamespace).Update(context.TODO(), cm,
+		metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, current := commit(strings.Repeat("D", 700<<10))
+	list, err := h.clientset.CoreV1().ConfigMaps(testNamespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: labelShardOf + "=" + testConfigMap,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list.Items) != 1 || list.Items[0].Name != current {
+		t.Errorf("expect the only shard %q after pruning, but got %d shards", current, len(list.Items))
+	}
+}
+
+func TestRestartRecovery(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo", "bar.txt": "bar"})
+	defer h.cleanup()
+
+	h.mount("vol-current", "pod-0", ConfigMapOptions{KeepCurrentAlways: true})
+	h.mount("vol-commit", "pod-0", ConfigMapOptions{
+		SubPath:         "bar.txt",
+		CommitChangesOn: CommitOnUnmount,
+		ConflictPolicy:  OverrideRemoteChanges,
+		OversizePolicy:  TruncateHeadLine,
+	})
+	h.mount("vol-orphan", "pod-1", ConfigMapOptions{})
+
+	h.crash()
+	if err := h.clientset.CoreV1().Pods(testNamespace).Delete(context.TODO(), "pod-1",
+		metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	watches := h.countWatches()
+	h.start()
+	h.waitForWatch(watches)
+
+	if _, err := os.Stat(h.volumePath("vol-orphan")); !os.IsNotExist(err) {
+		t.Error("volumes of deleted pods should be removed")
+	}
+
+	if len(h.m.volumeMap.metadataMap) != 2 {
+		t.Errorf("volumes should be restored, but got %#v", h.m.volumeMap.metadataMap)
+	}
+
+	h.updateConfigMap(map[string]string{"foo.txt": "foo-v2", "bar.txt": "bar"})
+	h.eventually("refreshing restored volumes", func() bool { return h.readVolume("vol-current", "foo.txt") == "foo-v2" })
+
+	h.writeVolume("vol-commit", "bar-v2")
+	h.unmount("vol-commit")
+	h.unmount("vol-current")
+	if cm := h.configMap(); cm.Data["bar.txt"] != "bar-v2" {
+		t.Errorf("local changes of restored volumes should be committed, but got %q", cm.Data["bar.txt"])
+	}
+}
+
+func TestResumeWatchers(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo"})
+	defer h.cleanup()
+
+	h.mount("vol-current", "pod-0", ConfigMapOptions{KeepCurrentAlways: true})
+	h.eventually("the watcher state", func() bool {
+		h.m.volumeMap.volGuard.Lock()
+		defer h.m.volumeMap.volGuard.Unlock()
+		return len(h.m.volumeMap.cmWatcher.watcherMap[cmKeyOf(testConfigMap, testNamespace)].resourceVersion) > 0
+	})
+
+	h.crash()
+	h.updateConfigMap(map[string]string{"foo.txt": "foo-v2"})
+
+	h.start()
+	h.eventually("catching up changes while not watching", func() bool {
+		return h.readVolume("vol-current", "foo.txt") == "foo-v2"
+	})
+}
+
+func TestRollback(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo"})
+	defer h.cleanup()
+
+	cm := h.configMap()
+	cm.Annotations = map[string]string{annotationRetainRevisions: "3"}
+	if _, err := h.clientset.CoreV1().ConfigMaps(testNamespace).Update(context.TODO(), cm,
+		metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.mount("vol-current", "pod-0", ConfigMapOptions{KeepCurrentAlways: true})
+	revision := h.configMap().ResourceVersion
+
+	rollbackTo := func(data map[string]string, revision string) {
+		cm := h.configMap()
+		cm.Data = data
+		cm.Annotations[annotationRollbackTo] = revision
+		if _, err := h.clientset.CoreV1().ConfigMaps(testNamespace).Update(context.TODO(), cm,
+			metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h.updateConfigMap(map[string]string{"foo.txt": "bad"})
+	h.eventually("refreshing the bad revision", func() bool { return h.readVolume("vol-current", "foo.txt") == "bad" })
+
+	rollbackTo(map[string]string{"foo.txt": "bad"}, revision)
+	h.eventually("rolling back", func() bool {
+		_, requested := h.configMap().Annotations[annotationRollbackTo]
+		return !requested && h.readVolume("vol-current", "foo.txt") == "foo"
+	})
+
+	// Volumes are still refreshed if rollbacks fail.
+	h.clientset.PrependReactor("list", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewServiceUnavailable("unavailable")
+	})
+
+	rollbackTo(map[string]string{"foo.txt": "bar"}, revision)
+	h.eventually("refreshing despite failed rollbacks", func() bool {
+		return h.readVolume("vol-current", "foo.txt") == "bar"
+	})
+}
+
+func TestCommitRevisions(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo"})
+	defer h.cleanup()
+
+	snapshots := func() []corev1.ConfigMap {
+		list, err := listSnapshots(context.TODO(), h.clientset, h.configMap())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return list
+	}
+
+	opts := ConfigMapOptions{
+		CommitChangesOn: CommitOnUnmount,
+		ConflictPolicy:  OverrideRemoteChanges,
+		OversizePolicy:  TruncateHeadLine,
+	}
+
+	// Revisions are not retained unless requested.
+	h.mount("vol-default", "pod-0", opts)
+	h.writeVolume("vol-default", "foo-v2", "foo.txt")
+	h.unmount("vol-default")
+	if list := snapshots(); len(list) != 0 {
+		t.Errorf("commits should not be snapshotted by default, but got %d snapshots", len(list))
+	}
+
+	opts.RetainRevisions = 3
+	for i, content := range []string{"foo-v3", "foo-v4"} {
+		vol := fmt.Sprintf("vol-retain-%d", i)
+		h.mount(vol, "pod-0", opts)
+		h.writeVolume(vol, content, "foo.txt")
+		h.unmount(vol)
+	}
+
+	list := snapshots()
+	if len(list) != 3 {
+		t.Fatalf("the latest 3 revisions should be retained, but got %d snapshots", len(list))
+	}
+
+	if latest := list[2]; latest.Data["foo.txt"] != "foo-v4" ||
+		latest.Annotations[annotationAuthorVolume] != "vol-retain-1" {
+		t.Errorf("unexpected latest snapshot %#v", latest.ObjectMeta)
+	}
+
+	// The annotation of the ConfigMap takes precedence.
+	cm := h.configMap()
+	cm.Annotations = map[string]string{annotationRetainRevisions: "0"}
+	if _, err := h.clientset.CoreV1().ConfigMaps(testNamespace).Update(context.TODO(), cm,
+		metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.mount("vol-disabled", "pod-0", opts)
+	h.writeVolume("vol-disabled", "foo-v5", "foo.txt")
+	h.unmount("vol-disabled")
+	if list = snapshots(); len(list) != 3 || list[2].Data["foo.txt"] != "foo-v4" {
+		t.Errorf("snapshots should be disabled by the annotation, but got %d snapshots", len(list))
+	}
+}
+
+func TestCommitOrphanedVolumes(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo", "bar.txt": "bar"})
+	defer h.cleanup()
+
+	opts := ConfigMapOptions{
+		SubPath:         "foo.txt",
+		CommitChangesOn: CommitOnUnmount,
+		ConflictPolicy:  OverrideRemoteChanges,
+		OversizePolicy:  TruncateHeadLine,
+	}
+
+	h.mount("vol-override", "pod-1", opts)
+	opts.SubPath = "bar.txt"
+	opts.ConflictPolicy = DiscardLocalChanges
+	h.mount("vol-discard", "pod-1", opts)
+	h.updateConfigMap(map[string]string{"foo.txt": "foo", "bar.txt": "remote"})
+	h.writeVolume("vol-override", "foo-v2")
+	h.writeVolume("vol-discard", "discarded")
+
+	h.crash()
+	if err := h.clientset.CoreV1().Pods(testNamespace).Delete(context.TODO(), "pod-1",
+		metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.start()
+	if cm := h.configMap(); cm.Data["foo.txt"] != "foo-v2" || cm.Data["bar.txt"] != "remote" {
+		t.Errorf("local changes of orphaned volumes should be committed per their policies, but got %#v", cm.Data)
+	}
+
+	for _, vol := range []string{"vol-override", "vol-discard"} {
+		if _, err := os.Stat(h.volumePath(vol)); !os.IsNotExist(err) {
+			t.Errorf("orphaned volume %q should be removed", vol)
+		}
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo", "bar.txt": "bar"})
+	defer h.cleanup()
+
+	h.mount("vol-commit", "pod-0", ConfigMapOptions{
+		SubPath:         "foo.txt",
+		CommitChangesOn: CommitOnModify,
+		ConflictPolicy:  OverrideRemoteChanges,
+		OversizePolicy:  TruncateHeadLine,
+	})
+	h.mount("vol-delayed", "pod-1", ConfigMapOptions{KeepCurrentAlways: true, UpdateDelay: 2 * time.Second})
+
+	h.updateConfigMap(map[string]string{"foo.txt": "foo", "bar.txt": "bar-v2"})
+	h.eventually("holding back the refresh", func() bool {
+		h.m.volumeMap.volGuard.Lock()
+		defer h.m.volumeMap.volGuard.Unlock()
+		return h.m.volumeMap.pendingRefreshes["vol-delayed"] != nil
+	})
+
+	// Commits fail while the API server is unavailable.
+	var apiDown int32 = 1
+	h.clientset.PrependReactor("update", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if atomic.LoadInt32(&apiDown) > 0 {
+			return true, nil, errors.NewServiceUnavailable("unavailable")
+		}
+
+		return false, nil, nil
+	})
+
+	h.writeVolume("vol-commit", "interrupted")
+	if err := h.m.Stop(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	err := h.m.Mount(context.TODO(), "vol-new", filepath.Join(h.root, "targets", "vol-new"), testConfigMap,
+		testNamespace, PodInfo{Pod: "pod-0", PodNamespace: testNamespace}, ConfigMapOptions{}, false)
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("volumes can't be mounted after being stopped, but got %v", err)
+	}
+
+	if h.readVolume("vol-delayed", "bar.txt") != "bar" {
+		t.Error("held back refreshes should not be applied on shutdown")
+	}
+
+	atomic.StoreInt32(&apiDown, 0)
+	h.start()
+	if cm := h.configMap(); cm.Data["foo.txt"] != "interrupted" {
+		t.Errorf("interrupted commits should be resumed, but got %q", cm.Data["foo.txt"])
+	}
+
+	h.eventually("resuming the held back refresh", func() bool {
+		return h.readVolume("vol-delayed", "bar.txt") == "bar-v2"
+	})
+
+	h.writeVolume("vol-commit", "drained")
+	if err := h.m.Stop(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	if cm := h.configMap(); cm.Data["foo.txt"] != "drained" {
+		t.Errorf("local changes should be committed on shutdown, but got %q", cm.Data["foo.txt"])
+	}
+
+	// Stopping twice is fine.
+	if err := h.m.Stop(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommitDeadline(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo"})
+	defer h.cleanup()
+
+	h.mount("vol-commit", "pod-0", ConfigMapOptions{
+		SubPath:         "foo.txt",
+		CommitChangesOn: CommitOnUnmount,
+		ConflictPolicy:  OverrideRemoteChanges,
+		OversizePolicy:  TruncateHeadLine,
+	})
+
+	// The deadline is exceeded while the first attempt conflicts.
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	var updates int32
+	h.clientset.PrependReactor("update", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if atomic.AddInt32(&updates, 1) > 1 {
+			return false, nil, nil
+		}
+
+		cancel()
+		return true, nil, errors.NewConflict(configMapsResource.GroupResource(), testConfigMap,
+			xerrors.New("conflicted"))
+	})
+
+	h.writeVolume("vol-commit", "interrupted")
+	vm := h.m.volumeMap
+	vm.volGuard.Lock()
+	err := vm.commitLocalVolumeChanges(ctx, "vol-commit", vm.metadataMap["vol-commit"])
+	vm.volGuard.Unlock()
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("commits should be unavailable after the deadline, but got %v", err)
+	}
+
+	if n := atomic.LoadInt32(&updates); n != 1 {
+		t.Errorf("commits should not be retried after the deadline, but got %d updates", n)
+	}
+
+	h.unmount("vol-commit")
+	if cm := h.configMap(); cm.Data["foo.txt"] != "interrupted" {
+		t.Errorf("local changes should be committed on unmount, but got %q", cm.Data["foo.txt"])
+	}
+}
+
+func TestGarbageCollection(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo", "bar.txt": "bar"})
+	defer h.cleanup()
+
+	h.mount("vol-live", "pod-0", ConfigMapOptions{KeepCurrentAlways: true})
+	h.mount("vol-unmounted", "pod-0", ConfigMapOptions{KeepCurrentAlways: true})
+	h.mount("vol-orphan", "pod-1", ConfigMapOptions{
+		SubPath:         "foo.txt",
+		CommitChangesOn: CommitOnUnmount,
+		ConflictPolicy:  OverrideRemoteChanges,
+		OversizePolicy:  TruncateHeadLine,
+	})
+	h.writeVolume("vol-orphan", "foo-v2")
+
+	if err := h.mounter.Unmount(filepath.Join(h.root, "targets", "vol-unmounted")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.clientset.CoreV1().Pods(testNamespace).Delete(context.TODO(), "pod-1",
+		metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(h.volumePath("vol-leftover"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	stale := []string{"vol-leftover", "vol-orphan", "vol-unmounted"}
+	gc := &h.m.volumeMap.gc
+	gc.gracePeriod = time.Hour
+	h.m.volumeMap.collectGarbage()
+	if len(gc.staleSince) != len(stale) || testutil.ToFloat64(staleVolumes) != float64(len(stale)) {
+		t.Errorf("stale volumes should be found, but got %#v", gc.staleSince)
+	}
+
+	gc.gracePeriod = 0
+	gc.dryRun = true
+	h.m.volumeMap.collectGarbage()
+	for _, vol := range stale {
+		if _, err := os.Stat(h.volumePath(vol)); err != nil {
+			t.Errorf("stale volume %q should be kept in the dry-run mode: %s", vol, err)
+		}
+	}
+
+	gc.dryRun = false
+	removed := testutil.ToFloat64(gcRemovedVolumesTotal)
+	h.m.volumeMap.collectGarbage()
+	for _, vol := range stale {
+		if _, err := os.Stat(h.volumePath(vol)); !os.IsNotExist(err) {
+			t.Errorf("stale volume %q should be removed", vol)
+		}
+	}
+
+	if n := testutil.ToFloat64(gcRemovedVolumesTotal) - removed; n != float64(len(stale)) {
+		t.Errorf("%d stale volumes should be removed, but got %.0f", len(stale), n)
+	}
+
+	if _, err := os.Stat(h.volumePath("vol-live")); err != nil {
+		t.Errorf("live volumes should be kept: %s", err)
+	}
+
+	if mounts, _ := h.mounter.List(); len(mounts) != 1 {
+		t.Errorf("targets of stale volumes should be unmounted, but got %#v", mounts)
+	}
+
+	if cm := h.configMap(); cm.Data["foo.txt"] != "foo-v2" {
+		t.Errorf("local changes of stale volumes should be committed, but got %q", cm.Data["foo.txt"])
+	}
+
+	watcher := h.m.volumeMap.cmWatcher.watcherMap[cmKeyOf(testConfigMap, testNamespace)]
+	if watcher == nil || len(watcher.volSet) != 1 {
+		t.Error("stale volumes should stop watching the configmap")
+	}
+}
+
+func TestDriftDetection(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo", "bar.txt": "bar"})
+	defer h.cleanup()
+
+	err := h.m.Mount(context.TODO(), "vol-invalid", filepath.Join(h.root, "targets", "vol-invalid"), testConfigMap,
+		testNamespace, PodInfo{Pod: "pod-0", PodNamespace: testNamespace}, ConfigMapOptions{
+			EnforceContent:  true,
+			CommitChangesOn: CommitOnUnmount,
+			ConflictPolicy:  OverrideRemoteChanges,
+			OversizePolicy:  TruncateHeadLine,
+		}, false)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("enforceContent can't be used along with commits, but got %v", err)
+	}
+
+	h.mount("vol-drift", "pod-0", ConfigMapOptions{ReadOnly: ReadOnlyNever})
+	h.mount("vol-enforce", "pod-1", ConfigMapOptions{ReadOnly: ReadOnlyNever, EnforceContent: true, SubPath: "bar.txt"})
+	detections := testutil.ToFloat64(driftDetectionsTotal.WithLabelValues(testNamespace, testConfigMap))
+
+	h.writeVolume("vol-drift", "drifted", "foo.txt")
+	h.eventually("detecting drift", func() bool {
+		return testutil.ToFloat64(driftDetectionsTotal.WithLabelValues(testNamespace, testConfigMap)) > detections
+	})
+
+	if stats, err := h.m.VolumeStats("vol-drift"); err != nil || !stats.Abnormal ||
+		!strings.Contains(stats.Message, "foo.txt") {
+		t.Errorf("drift should be reported in stats, but got %#v, %v", stats, err)
+	}
+
+	h.writeVolume("vol-enforce", "drifted")
+	h.eventually("restoring drifted content", func() bool { return h.readVolume("vol-enforce") == "bar" })
+
+	h.writeVolume("vol-drift", "foo", "foo.txt")
+	h.eventually("clearing drift", func() bool {
+		stats, err := h.m.VolumeStats("vol-drift")
+		return err == nil && !stats.Abnormal
+	})
+
+	stats, err := h.m.VolumeStats("vol-enforce")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Abnormal || stats.UsedBytes != int64(len("bar")) || stats.TotalBytes == 0 {
+		t.Errorf("unexpected stats %#v", stats)
+	}
+
+	if _, err = h.m.VolumeStats("vol-unknown"); status.Code(err) != codes.NotFound {
+		t.Errorf("stats of unknown volumes should be NotFound, but got %v", err)
+	}
+
+	h.unmount("vol-drift")
+	h.unmount("vol-enforce")
+	if len(h.m.volumeMap.drifts) > 0 || len(h.m.volumeMap.volWatcher.watcherMap) > 0 {
+		t.Error("drift detection should stop after unmount")
+	}
+}
+
+func TestDriftStats(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo"})
+	defer h.cleanup()
+
+	h.mount("vol-enforce", "pod-0", ConfigMapOptions{
+		ReadOnly:          ReadOnlyNever,
+		EnforceContent:    true,
+		KeepCurrentAlways: true,
+	})
+
+	// Refreshes by the driver itself are not drift.
+	detections := testutil.ToFloat64(driftDetectionsTotal.WithLabelValues(testNamespace, testConfigMap))
+	h.updateConfigMap(map[string]string{"foo.txt": "foo-v2"})
+	h.eventually("refreshing the volume", func() bool { return h.readVolume("vol-enforce", "foo.txt") == "foo-v2" })
+	if n := testutil.ToFloat64(driftDetectionsTotal.WithLabelValues(testNamespace, testConfigMap)); n != detections {
+		t.Error("refreshes should not be detected as drift")
+	}
+
+	// Stop the inotify watch so that only stats see the drift.
+	h.m.volumeMap.volGuard.Lock()
+	h.m.volumeMap.volWatcher.unwatchVolume("vol-enforce", true)
+	h.m.volumeMap.volGuard.Unlock()
+
+	h.writeVolume("vol-enforce", "drifted", "foo.txt")
+	stats, err := h.m.VolumeStats("vol-enforce")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !stats.Abnormal || !strings.Contains(stats.Message, "foo.txt") {
+		t.Errorf("drift should be reported, but got %#v", stats)
+	}
+
+	if h.readVolume("vol-enforce", "foo.txt") != "drifted" || len(h.m.volumeMap.drifts) > 0 {
+		t.Error("stats should neither restore nor record drift")
+	}
+}
+
+func TestReadOnlyVolumes(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo"})
+	defer h.cleanup()
+
+	h.mount("vol-ro", "pod-0", ConfigMapOptions{})
+	h.mount("vol-rw", "pod-0", ConfigMapOptions{
+		CommitChangesOn: CommitOnUnmount,
+		ConflictPolicy:  OverrideRemoteChanges,
+		OversizePolicy:  TruncateHeadLine,
+	})
+
+	mounts, _ := h.mounter.List()
+	for _, mnt := range mounts {
+		ro := false
+		for _, opt := range mnt.Opts {
+			ro = ro || opt == "ro"
+		}
+
+		if ro != strings.HasSuffix(mnt.Path, "vol-ro") {
+			t.Errorf("unexpected mount options %q of %q", mnt.Opts, mnt.Path)
+		}
+	}
+
+	for vol, mode := range map[string]os.FileMode{"vol-ro": 0444, "vol-rw": 0644} {
+		if fi, err := os.Stat(h.volumePath(vol, "foo.txt")); err != nil || fi.Mode().Perm() != mode {
+			t.Errorf("mode of files in volume %q should be %#o", vol, mode)
+		}
+	}
+
+	if _, watched := h.m.volumeMap.volWatcher.watcherMap["vol-ro"]; watched {
+		t.Error("read-only volumes should not be watched for drift")
+	}
+
+	err := h.m.Mount(context.TODO(), "vol-invalid", filepath.Join(h.root, "targets", "vol-invalid"), testConfigMap,
+		testNamespace, PodInfo{Pod: "pod-0", PodNamespace: testNamespace}, ConfigMapOptions{
+			CommitChangesOn: CommitOnModify,
+			ConflictPolicy:  OverrideRemoteChanges,
+			OversizePolicy:  TruncateHeadLine,
+		}, true)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("read-only pods can't commit changes, but got %v", err)
+	}
+}
+
+func TestImmutableConfigMaps(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo"})
+	defer h.cleanup()
+
+	immutable := true
+	cm := h.configMap()
+	cm.Immutable = &immutable
+	if _, err := h.clientset.CoreV1().ConfigMaps(testNamespace).Update(context.TODO(), cm,
+		metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	commitOpts := ConfigMapOptions{
+		CommitChangesOn: CommitOnUnmount,
+		ConflictPolicy:  OverrideRemoteChanges,
+		OversizePolicy:  TruncateHeadLine,
+	}
+
+	err := h.m.Mount(context.TODO(), "vol-rejected", filepath.Join(h.root, "targets", "vol-rejected"), testConfigMap,
+		testNamespace, PodInfo{Pod: "pod-0", PodNamespace: testNamespace}, commitOpts, false)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("commits to immutable configmaps should be rejected, but got %v", err)
+	}
+
+	watches := h.countWatches()
+	if err = h.m.Mount(context.TODO(), "vol-current", filepath.Join(h.root, "targets", "vol-current"), testConfigMap,
+		testNamespace, PodInfo{Pod: "pod-0", PodNamespace: testNamespace}, ConfigMapOptions{KeepCurrentAlways: true},
+		false); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(h.m.volumeMap.cmWatcher.watcherMap) > 0 || h.countWatches() != watches {
+		t.Errorf("immutable configmaps should not be watched")
+	}
+
+	commitOpts.VersionPointer = "cm-foo-current"
+	for i, content := range []string{"bar", "baz"} {
+		h.mount("vol", "pod-0", commitOpts)
+		h.writeVolume("vol", content, "foo.txt")
+		h.unmount("vol")
+
+		pointer, err := h.clientset.CoreV1().ConfigMaps(testNamespace).Get(context.TODO(), "cm-foo-current",
+			metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The second commit conflicts with the first version, which is overridden.
+		expected := "cm-foo-v" + strconv.Itoa(i+1)
+		if pointer.Data[pointerKey] != expected {
+			t.Fatalf("pointer should name %q, but got %q", expected, pointer.Data[pointerKey])
+		}
+
+		version, err := h.clientset.CoreV1().ConfigMaps(testNamespace).Get(context.TODO(), expected,
+			metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !isImmutable(version) || version.Data["foo.txt"] != content || version.Labels[labelVersionOf] != "cm-foo" {
+			t.Errorf("unexpected version %q", expected)
+		}
+	}
+
+	if v := h.configMap().Data["foo.txt"]; v != "foo" {
+		t.Errorf("immutable configmap is updated to %q", v)
+	}
+}
+
+func TestCommitVersions(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo"})
+	defer h.cleanup()
+
+	// 0: the API server works, 1: the first pointer update conflicts, 2: pointer updates fail
+	var pointerFailure, pointerUpdates int32
+	h.clientset.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.UpdateAction).GetObject().(*corev1.ConfigMap).Name != "cm-foo-current" {
+			return false, nil, nil
+		}
+
+		n := atomic.AddInt32(&pointerUpdates, 1)
+		switch atomic.LoadInt32(&pointerFailure) {
+		case 1:
+			if n == 1 {
+				return true, nil, errors.NewConflict(configMapsResource.GroupResource(), "cm-foo-current",
+					xerrors.New("conflicted"))
+			}
+		case 2:
+			return true, nil, errors.NewServiceUnavailable("unavailable")
+		}
+
+		return false, nil, nil
+	})
+
+	immutable := true
+	cm := h.configMap()
+	cm.Immutable = &immutable
+	cm.Annotations = map[string]string{
+		annotationSharedWith: "*",
+		"kubectl.kubernetes.io/last-applied-configuration": "{}",
+	}
+	if _, err := h.clientset.CoreV1().ConfigMaps(testNamespace).Update(context.TODO(), cm,
+		metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := h.clientset.CoreV1().ConfigMaps(testNamespace).Create(context.TODO(), &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cm-foo-current", Namespace: testNamespace},
+		Data:       map[string]string{pointerKey: testConfigMap},
+	}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.mount("vol", "pod-0", ConfigMapOptions{
+		CommitChangesOn: CommitOnUnmount,
+		ConflictPolicy:  DiscardLocalChanges,
+		OversizePolicy:  TruncateHeadLine,
+		VersionPointer:  "cm-foo-current",
+	})
+
+	vm := h.m.volumeMap
+	commit := func() error {
+		vm.volGuard.Lock()
+		defer vm.volGuard.Unlock()
+		return vm.commitLocalVolumeChanges(context.TODO(), "vol", vm.metadataMap["vol"])
+	}
+
+	versions := func() (names []string) {
+		list, err := h.clientset.CoreV1().ConfigMaps(testNamespace).List(context.TODO(), metav1.ListOptions{
+			LabelSelector: labelVersionOf + "=" + testConfigMap,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, version := range list.Items {
+			names = append(names, version.Name)
+		}
+
+		return
+	}
+
+	// Versions are deleted if the pointer can't be updated.
+	atomic.StoreInt32(&pointerFailure, 2)
+	h.writeVolume("vol", "bar", "foo.txt")
+	if err := commit(); err == nil {
+		t.Fatal("commits should fail if the pointer can't be updated")
+	}
+
+	if names := versions(); len(names) > 0 {
+		t.Errorf("versions of failed commits should be deleted, but got %v", names)
+	}
+
+	// Only the pointer update is retried on conflicts.
+	atomic.StoreInt32(&pointerFailure, 1)
+	atomic.StoreInt32(&pointerUpdates, 0)
+	if err := commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	names := versions()
+	if len(names) != 1 || atomic.LoadInt32(&pointerUpdates) != 2 {
+		t.Fatalf("expect 1 version and 2 pointer updates, but got %v and %d", names, pointerUpdates)
+	}
+
+	pointer, err := h.clientset.CoreV1().ConfigMaps(testNamespace).Get(context.TODO(), "cm-foo-current",
+		metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pointer.Data[pointerKey] != names[0] {
+		t.Errorf("pointer should name %q, but got %q", names[0], pointer.Data[pointerKey])
+	}
+
+	version, err := h.clientset.CoreV1().ConfigMaps(testNamespace).Get(context.TODO(), names[0], metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		annotationSharedWith:   "*",
+		annotationAuthorPod:    testNamespace + "/pod-0",
+		annotationAuthorVolume: "vol",
+		annotationAuthorNode:   "node",
+	}
+	if !reflect.DeepEqual(version.Annotations, expected) {
+		t.Errorf("unexpected annotations of the version: %v", version.Annotations)
+	}
+}
+
+func TestPruneVersions(t *testing.T) {
+	for _, retained := range []int{0, 2} {
+		h := newTestHarness(t, map[string]string{"foo.txt": "foo"})
+		immutable := true
+		cm := h.configMap()
+		cm.Immutable = &immutable
+		if _, err := h.clientset.CoreV1().ConfigMaps(testNamespace).Update(context.TODO(), cm,
+			metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		// A ConfigMap labeled as a version of another name is never pruned.
+		if _, err := h.clientset.CoreV1().ConfigMaps(testNamespace).Create(context.TODO(), &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "cm-bar-v1",
+				Namespace: testNamespace,
+				Labels:    map[string]string{labelVersionOf: testConfigMap},
+			},
+		}, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		h.mount("vol", "pod-0", ConfigMapOptions{
+			CommitChangesOn: CommitOnUnmount,
+			ConflictPolicy:  OverrideRemoteChanges,
+			OversizePolicy:  TruncateHeadLine,
+			VersionPointer:  "cm-foo-current",
+			RetainRevisions: retained,
+		})
+
+		vm := h.m.volumeMap
+		for i := 2; i <= 5; i++ {
+			h.writeVolume("vol", fmt.Sprintf("foo-v%d", i), "foo.txt")
+			vm.volGuard.Lock()
+			err := vm.commitLocalVolumeChanges(context.TODO(), "vol", vm.metadataMap["vol"])
+			vm.volGuard.Unlock()
+			if err != nil {
+				t.Fatalf("retained %d: %s", retained, err)
+			}
+		}
+
+		list, err := h.clientset.CoreV1().ConfigMaps(testNamespace).List(context.TODO(), metav1.ListOptions{
+			LabelSelector: labelVersionOf + "=" + testConfigMap,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, version := range list.Items {
+			names = append(names, version.Name)
+		}
+
+		sort.Strings(names)
+		// The pointer names the latest version, which is kept even if no versions are retained.
+		expected := []string{"cm-bar-v1", "cm-foo-v4"}
+		if retained == 0 {
+			expected = []string{"cm-bar-v1"}
+		}
+
+		expected = append(expected, "cm-foo-v5")
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("retained %d: expect versions %v, but got %v", retained, expected, names)
+		}
+
+		current, err := currentVersionOf(context.TODO(), h.clientset, testNamespace, "cm-foo-current")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if current != "cm-foo-v5" {
+			t.Errorf("retained %d: the pointer should name the latest version, but got %q", retained, current)
+		}
+
+		if h.configMap().Name != testConfigMap {
+			t.Errorf("retained %d: the original ConfigMap should never be pruned", retained)
+		}
+
+		h.cleanup()
+	}
+}
+
+func TestConfigMapRef(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo"})
+	defer h.cleanup()
+
+	cli := h.clientset.CoreV1().ConfigMaps(testNamespace)
+	createVersion := func(name string, data map[string]string) {
+		if _, err := cli.Create(context.TODO(), &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace, Labels: map[string]string{"app": "foo"}},
+			Data:       data,
+		}, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	createVersion("cm-foo-v1", map[string]string{"a.txt": "1", "stale.txt": "stale"})
+	createVersion("cm-foo-v2", map[string]string{"a.txt": "2", "b.txt": "b"})
+	if _, err := cli.Create(context.TODO(), &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cm-foo-current", Namespace: testNamespace},
+		Data:       map[string]string{pointerKey: "cm-foo-v1"},
+	}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	mountRef := func(volumeID, ref string, mode ConfigMapRefMode) {
+		watches := h.countWatches()
+		if err := h.m.Mount(context.TODO(), volumeID, filepath.Join(h.root, "targets", volumeID), ref,
+			testNamespace, PodInfo{Pod: "pod-0", PodNamespace: testNamespace},
+			ConfigMapOptions{ConfigMapRef: mode}, false); err != nil {
+			t.Fatalf("unable to mount volume %q: %s", volumeID, err)
+		}
+
+		h.waitForWatch(watches)
+	}
+
+	mountRef("vol-pointer", "cm-foo-current", RefPointer)
+	mountRef("vol-selector", "app=foo", RefSelector)
+	if h.readVolume("vol-pointer", "a.txt") != "1" || h.readVolume("vol-selector", "a.txt") != "2" {
+		t.Fatalf("volumes should mount targets of their references")
+	}
+
+	pointer, err := cli.Get(context.TODO(), "cm-foo-current", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pointer.Data[pointerKey] = "cm-foo-v2"
+	if _, err = cli.Update(context.TODO(), pointer, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.eventually("switch following the pointer", func() bool {
+		content, _ := ioutil.ReadFile(h.volumePath("vol-pointer", "a.txt"))
+		return string(content) == "2"
+	})
+
+	if h.readVolume("vol-pointer", "b.txt") != "b" {
+		t.Errorf("new keys should be saved")
+	}
+
+	if _, err = os.Stat(h.volumePath("vol-pointer", "stale.txt")); !os.IsNotExist(err) {
+		t.Errorf("keys not found in the new target should be removed")
+	}
+
+	createVersion("cm-foo-v3", map[string]string{"a.txt": "3"})
+	h.eventually("switch following the selector", func() bool {
+		content, _ := ioutil.ReadFile(h.volumePath("vol-selector", "a.txt"))
+		return string(content) == "3"
+	})
+
+	h.m.volumeMap.volGuard.Lock()
+	target := h.m.volumeMap.metadataMap["vol-selector"].ConfigMapName
+	h.m.volumeMap.volGuard.Unlock()
+	if target != "cm-foo-v3" {
+		t.Errorf("volume should be switched to cm-foo-v3, but got %q", target)
+	}
+
+	err = h.m.Mount(context.TODO(), "vol-invalid", filepath.Join(h.root, "targets", "vol-invalid"), "app=foo",
+		testNamespace, PodInfo{Pod: "pod-0", PodNamespace: testNamespace},
+		ConfigMapOptions{ConfigMapRef: RefSelector, KeepCurrentAlways: true}, false)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("volumes following references can't keep current, but got %v", err)
+	}
+
+	h.unmount("vol-pointer")
+	h.unmount("vol-selector")
+	if len(h.m.volumeMap.cmWatcher.watcherMap) > 0 {
+		t.Errorf("watches on references should be closed")
+	}
+}
+
+func TestCrossNamespaceMounts(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo"})
+	defer h.cleanup()
+
+	if _, err := h.clientset.CoreV1().Namespaces().Create(context.TODO(), &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "bar"},
+	}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	cli := h.clientset.CoreV1().ConfigMaps("bar")
+	cm, err := cli.Create(context.TODO(), &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cm-bar", Namespace: "bar"},
+		Data:       map[string]string{"bar.txt": "bar"},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mount := func(volumeID string) error {
+		return h.m.Mount(context.TODO(), volumeID, filepath.Join(h.root, "targets", volumeID), "cm-bar", "bar",
+			PodInfo{Pod: "pod-0", PodNamespace: testNamespace}, ConfigMapOptions{}, false)
+	}
+
+	// ConfigMaps must be shared with other namespaces even if mounts are not reviewed.
+	if err = mount("vol-denied"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("configmaps not shared should not be mounted, but got %v", err)
+	}
+
+	cm.Annotations = map[string]string{annotationSharedWith: testNamespace}
+	if _, err = cli.Update(context.TODO(), cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = mount("vol-shared"); err != nil {
+		t.Fatal(err)
+	}
+
+	if h.readVolume("vol-shared", "bar.txt") != "bar" {
+		t.Errorf("shared configmaps should be mounted")
+	}
+}
+
+func TestConfigMapRefAuthorization(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"foo.txt": "foo"})
+	defer h.cleanup()
+
+	h.clientset.PrependReactor("create", "subjectaccessreviews",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+			review.Status.Allowed = review.Spec.ResourceAttributes.Name != "cm-foo-v2"
+			return true, review, nil
+		})
+
+	cli := h.clientset.CoreV1().ConfigMaps(testNamespace)
+	for _, cm := range []*corev1.ConfigMap{
+		{ObjectMeta: metav1.ObjectMeta{Name: "cm-foo-v1"}, Data: map[string]string{"a.txt": "1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "cm-foo-v2"}, Data: map[string]string{"a.txt": "2"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "cm-foo-current"}, Data: map[string]string{pointerKey: "cm-foo-v1"}},
+	} {
+		cm.Namespace = testNamespace
+		if _, err := cli.Create(context.TODO(), cm, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h.m.volumeMap.authorizeMounts = true
+	if err := h.m.Mount(context.TODO(), "vol", filepath.Join(h.root, "targets", "vol"), "cm-foo-current",
+		testNamespace, PodInfo{Pod: "pod-0", PodNamespace: testNamespace}, ConfigMapOptions{ConfigMapRef: RefPointer},
+		false); err != nil {
+		t.Fatal(err)
+	}
+
+	pointer, err := cli.Get(context.TODO(), "cm-foo-current", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pointer.Data[pointerKey] = "cm-foo-v2"
+	if _, err = cli.Update(context.TODO(), pointer, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Switches to targets the pod can't read are refused.
+	vm := h.m.volumeMap
+	vm.volGuard.Lock()
+	vm.followRef(context.TODO(), "vol", vm.metadataMap["vol"])
+	target := vm.metadataMap["vol"].ConfigMapName
+	vm.volGuard.Unlock()
+	if target != "cm-foo-v1" || h.readVolume("vol", "a.txt") != "1" {
+		t.Errorf("volume should not be switched to unauthorized configmaps, but got %q", target)
+	}
+}
@@ -0,0 +1,257 @@
+package cmmouter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/xerrors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const notifyHTTPTimeout = 5 * time.Second
+
+// NotifyEvent is the body posted to the HTTP endpoint of the pod after the volume is refreshed.
+type NotifyEvent struct {
+	Volume             string `json:"volume"`
+	ConfigMapName      string `json:"configMapName"`
+	ConfigMapNamespace string `json:"configMapNamespace"`
+	ResourceVersion    string `json:"resourceVersion"`
+}
+
+func validateNotifyFileName(name, attr string) error {
+	if len(name) > 0 && (name != filepath.Base(name) || name == ".." || name == ".") {
+		return status.Errorf(codes.InvalidArgument, "%s %q must be a file name rather than a path", attr, name)
+	}
+
+	return nil
+}
+
+func (o *ConfigMapOptions) validateNotify() error {
+	if len(o.NotifyFile) == 0 && len(o.NotifyHTTP) == 0 && len(o.NotifyFIFO) == 0 {
+		return nil
+	}
+
+	if !o.KeepCurrentAlways {
+		return status.Error(codes.InvalidArgument, "notifications require keepCurrentAlways")
+	}
+
+	if (len(o.NotifyFile) > 0 || len(o.NotifyFIFO) > 0) && len(o.SubPath) > 0 {
+		return status.Error(codes.InvalidArgument, "notifyFile and notifyFIFO can't be used along with subPath")
+	}
+
+	if err := validateNotifyFileName(o.NotifyFile, "notifyFile"); err != nil {
+		return err
+	}
+
+	if err := validateNotifyFileName(o.NotifyFIFO, "notifyFIFO"); err != nil {
+		return err
+	}
+
+	if len(o.NotifyFile) > 0 && o.NotifyFile == o.NotifyFIFO {
+		return status.Error(codes.InvalidArgument, "notifyFile and notifyFIFO must be different")
+	}
+
+	if o.Format != NoFormat && (o.NotifyFile == o.formatFileName() || o.NotifyFIFO == o.formatFileName()) {
+		return status.Errorf(codes.InvalidArgument, "%q is the formatted file", o.formatFileName())
+	}
+
+	if len(o.NotifyHTTP) > 0 {
+		if _, _, err := splitNotifyHTTP(o.NotifyHTTP); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid notifyHTTP %q: %s", o.NotifyHTTP, err)
+		}
+	}
+
+	return nil
+}
+
+// splitNotifyHTTP splits endpoints like ":8080/-/reload" into the port and the path.
+func splitNotifyHTTP(endpoint string) (port int, path string, err error) {
+	if !strings.HasPrefix(endpoint, ":") {
+		err = xerrors.New(`must be ":<port>/<path>"`)
+		return
+	}
+
+	path = "/"
+	portStr := endpoint[1:]
+	if slash := strings.IndexByte(portStr, '/'); slash >= 0 {
+		portStr, path = portStr[:slash], portStr[slash:]
+	}
+
+	port, err = strconv.Atoi(portStr)
+	if err == nil && (port <= 0 || port > 65535) {
+		err = xerrors.Errorf("invalid port %d", port)
+	}
+
+	return
+}
+
+// checkNotifyPaths makes sure that notification files don't overwrite keys of the ConfigMap.
+func (m *volumeMetadata) checkNotifyPaths(cm *corev1.ConfigMap) error {
+	if (len(m.NotifyFile) == 0 && len(m.NotifyFIFO) == 0) || m.Format != NoFormat {
+		return nil
+	}
+
+	keyPaths, err := m.keyPaths(cm)
+	if err != nil {
+		return err
+	}
+
+	for k, p := range keyPaths {
+		if p == m.NotifyFile || p == m.NotifyFIFO {
+			return status.Errorf(codes.InvalidArgument, "notification file %q conflicts with key %q", p, k)
+		}
+	}
+
+	return nil
+}
+
+// prepareNotifications creates the FIFO and the sentinel file in the volume.
+func (m *volumeMap) prepareNotifications(volumeID string, metadata *volumeMetadata) error {
+	if len(metadata.NotifyFIFO) > 0 {
+		fifo := filepath.Join(m.volumeRoot, volumeID, metadata.NotifyFIFO)
+		mode := metadata.fileMode("")
+		if err := syscall.Mkfifo(fifo, uint32(mode)); err != nil && !os.IsExist(err) {
+			klog.Errorf("unable to create fifo %q: %s", fifo, err)
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		if err := metadata.applyOwnership(fifo, mode); err != nil {
+			klog.Errorf("unable to change owner of fifo %q: %s", fifo, err)
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if len(metadata.NotifyFile) > 0 {
+		return m.writeNotifyFile(volumeID, metadata)
+	}
+
+	return nil
+}
+
+func (m *volumeMap) writeNotifyFile(volumeID string, metadata *volumeMetadata) error {
+	sentinel := filepath.Join(m.volumeRoot, volumeID, metadata.NotifyFile)
+	if err := metadata.writeKey(sentinel, "", []byte(metadata.ResourceVersion+"\n")); err != nil {
+		klog.Errorf("unable to update sentinel %q: %s", sentinel, err)
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	return nil
+}
+
+// notifyRefresh notifies the application of the volume via all configured hooks after the volume is refreshed.
+func (m *volumeMap) notifyRefresh(volumeID string, metadata *volumeMetadata) {
+	if len(metadata.NotifyFile) > 0 {
+		if err := m.writeNotifyFile(volumeID, metadata); err != nil {
+			m.recordPodEvent(metadata, corev1.EventTypeWarning, reasonNotifyFailed,
+				"unable to update notification file of volume %q: %s", volumeID, err)
+		}
+	}
+
+	if len(metadata.NotifyFIFO) > 0 {
+		if err := m.writeNotifyFIFO(volumeID, metadata); err != nil {
+			m.recordPodEvent(metadata, corev1.EventTypeWarning, reasonNotifyFailed,
+				"unable to write notification FIFO of volume %q: %s", volumeID, err)
+		}
+	}
+
+	if len(metadata.NotifyHTTP) > 0 {
+		// Don't block other volumes while posting. Copy the metadata since it changes on following refreshes.
+		snapshot := *metadata
+		m.notifications.Start(func() {
+			if err := m.postNotifyEvent(volumeID, &snapshot); err != nil {
+				klog.Errorf("unable to notify pod %s/%s of volume %q: %s", snapshot.PodNamespace, snapshot.Pod,
+					volumeID, err)
+				m.recordPodEvent(&snapshot, corev1.EventTypeWarning, reasonNotifyFailed,
+					"unable to notify %q of volume %q: %s", snapshot.NotifyHTTP, volumeID, err)
+			}
+		})
+	}
+}
+
+// writeNotifyFIFO writes the ResourceVersion as a line to the FIFO. Notifications are dropped if no one reads it.
+func (m *volumeMap) writeNotifyFIFO(volumeID string, metadata *volumeMetadata) error {
+	fifo := filepath.Join(m.volumeRoot, volumeID, metadata.NotifyFIFO)
+	f, err := os.OpenFile(fifo, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.ENXIO {
+			klog.Infof("no reader of fifo %q. drop the notification", fifo)
+			return nil
+		}
+
+		return err
+	}
+
+	defer f.Close()
+	_, err = f.WriteString(metadata.ResourceVersion + "\n")
+	if err == syscall.EAGAIN {
+		klog.Warningf("fifo %q is full. drop the notification", fifo)
+		return nil
+	}
+
+	return err
+}
+
+func (m *volumeMap) postNotifyEvent(volumeID string, metadata *volumeMetadata) error {
+	port, path, err := splitNotifyHTTP(metadata.NotifyHTTP)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), notifyHTTPTimeout)
+	defer cancel()
+
+	// The pod IP is assigned after volumes are mounted. Fetch it with the driver identity, which requires `get` on
+	// pods, each time since it changes if the pod sandbox is recreated.
+	pod, err := m.clientset.CoreV1().Pods(metadata.PodNamespace).Get(ctx, metadata.Pod, metav1.GetOptions{})
+	if err != nil {
+		recordAPIError("pods", "get")
+		return err
+	}
+
+	if len(pod.Status.PodIP) == 0 {
+		return xerrors.New("pod IP is not assigned")
+	}
+
+	body, err := json.Marshal(&NotifyEvent{
+		Volume:             volumeID,
+		ConfigMapName:      metadata.ConfigMapName,
+		ConfigMapNamespace: metadata.ConfigMapNamespace,
+		ResourceVersion:    metadata.ResourceVersion,
+	})
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("http://%s%s", net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(port)), path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return xerrors.Errorf("unexpected status %s", resp.Status)
+	}
+
+	klog.Infof("pod %s/%s is notified of volume %q", metadata.PodNamespace, metadata.Pod, volumeID)
+	return nil
+}
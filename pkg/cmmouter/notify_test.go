@@ -0,0 +1,167 @@
+package cmmouter
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSplitNotifyHTTP(t *testing.T) {
+	cases := []struct {
+		endpoint string
+		port     int
+		path     string
+		valid    bool
+	}{
+		{":8080/-/reload", 8080, "/-/reload", true},
+		{":80", 80, "/", true},
+		{"8080/reload", 0, "", false},
+		{":0/reload", 0, "", false},
+		{":http/reload", 0, "", false},
+	}
+
+	for _, c := range cases {
+		port, path, err := splitNotifyHTTP(c.endpoint)
+		if (err == nil) != c.valid {
+			t.Errorf("%q: unexpected error %v", c.endpoint, err)
+			continue
+		}
+
+		if c.valid && (port != c.port || path != c.path) {
+			t.Errorf("%q: unexpected port %d and path %q", c.endpoint, port, path)
+		}
+	}
+}
+
+func TestValidateNotify(t *testing.T) {
+	invalid := []ConfigMapOptions{
+		{NotifyFile: ".version"},
+		{KeepCurrentAlways: true, SubPath: "foo", NotifyFile: ".version"},
+		{KeepCurrentAlways: true, NotifyFile: "../version"},
+		{KeepCurrentAlways: true, NotifyFile: ".version", NotifyFIFO: ".version"},
+		{KeepCurrentAlways: true, Format: FormatDotenv, NotifyFile: ".env"},
+		{KeepCurrentAlways: true, NotifyHTTP: "localhost:8080"},
+	}
+
+	for i, opts := range invalid {
+		if err := opts.validateNotify(); err == nil {
+			t.Errorf("case %d: should be invalid", i)
+		}
+	}
+
+	valid := ConfigMapOptions{KeepCurrentAlways: true, NotifyFile: ".version", NotifyFIFO: ".events",
+		NotifyHTTP: ":8080/reload"}
+	if err := valid.validateNotify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNotifyFIFO(t *testing.T) {
+	root, err := ioutil.TempDir("", "cm-notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	m := &volumeMap{volumeRoot: root}
+	metadata := &volumeMetadata{
+		ConfigMapOptions: ConfigMapOptions{KeepCurrentAlways: true, NotifyFIFO: ".events", NotifyFile: ".version"},
+		ResourceVersion:  "1",
+	}
+
+	if err = os.Mkdir(filepath.Join(root, "vol"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = m.prepareNotifications("vol", metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	// no reader
+	if err = m.writeNotifyFIFO("vol", metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := os.OpenFile(filepath.Join(root, "vol", ".events"), os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	metadata.ResourceVersion = "2"
+	m.notifyRefresh("vol", metadata)
+	line, err := bufio.NewReader(reader).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if line != "2\n" {
+		t.Errorf("unexpected notification %q", line)
+	}
+
+	version, err := ioutil.ReadFile(filepath.Join(root, "vol", ".version"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(version) != "2\n" {
+		t.Errorf("unexpected version %q", version)
+	}
+}
+
+func TestNotifyHTTP(t *testing.T) {
+	received := make(chan *NotifyEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// slow enough to be in flight when notifyRefresh returns
+		time.Sleep(200 * time.Millisecond)
+		event := &NotifyEvent{}
+		if r.URL.Path != "/reload" || json.NewDecoder(r.Body).Decode(event) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		received <- event
+	}))
+	defer server.Close()
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &volumeMap{clientset: fake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default"},
+		Status:     corev1.PodStatus{PodIP: host},
+	})}
+
+	metadata := &volumeMetadata{
+		ConfigMapOptions:   ConfigMapOptions{KeepCurrentAlways: true, NotifyHTTP: ":" + port + "/reload"},
+		ConfigMapName:      "foo",
+		ConfigMapNamespace: "default",
+		PodInfo:            PodInfo{Pod: "pod", PodNamespace: "default"},
+		ResourceVersion:    "2",
+	}
+
+	m.notifyRefresh("vol", metadata)
+	// Shutdown waits for notifications in flight.
+	m.notifications.Wait()
+	select {
+	case event := <-received:
+		if event.Volume != "vol" || event.ResourceVersion != "2" {
+			t.Errorf("unexpected notification %#v", event)
+		}
+	default:
+		t.Error("the notification should be posted before Wait returns")
+	}
+}
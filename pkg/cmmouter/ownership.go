@@ -0,0 +1,147 @@
+package cmmouter
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+)
+
+const (
+	defaultFileMode os.FileMode = 0644
+	defaultDirMode  os.FileMode = 0755
+	maxFileMode                 = 0777
+)
+
+func validateMode(mode *int32, name string) error {
+	if mode != nil && (*mode < 0 || *mode > maxFileMode) {
+		return status.Errorf(codes.InvalidArgument, "%s %#o must be in the range of 0 to 0777", name, *mode)
+	}
+
+	return nil
+}
+
+func (o *ConfigMapOptions) validateOwnership() error {
+	if err := validateMode(o.DefaultMode, "defaultMode"); err != nil {
+		return err
+	}
+
+	for _, item := range o.Items {
+		if err := validateMode(item.Mode, "mode of key "+item.Key); err != nil {
+			return err
+		}
+	}
+
+	if o.UID != nil && *o.UID < 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid uid %d", *o.UID)
+	}
+
+	if o.GID != nil && *o.GID < 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid gid %d", *o.GID)
+	}
+
+	return nil
+}
+
+// fileMode returns the mode of the file of the key. The mode of the item goes first, then the defaultMode.
+// If the fsGroup of the pod is set, the group can read the file, and write it as well if commitChangesOn is enabled.
+// Files of read-only volumes are not writable.
+func (m *volumeMetadata) fileMode(key string) os.FileMode {
+	mode := defaultFileMode
+	if m.DefaultMode != nil {
+		mode = os.FileMode(*m.DefaultMode)
+	}
+
+	for _, item := range m.Items {
+		if item.Key == key && item.Mode != nil {
+			mode = os.FileMode(*item.Mode)
+			break
+		}
+	}
+
+	if m.FSGroup != nil {
+		mode |= 0040
+		if m.CommitChangesOn != NoCommit {
+			mode |= 0020
+		}
+	}
+
+	if m.ReadOnly == ReadOnlyAlways {
+		mode &^= 0222
+	}
+
+	return mode
+}
+
+// dirMode returns the mode of directories in the volume.
+func (m *volumeMetadata) dirMode() os.FileMode {
+	mode := defaultDirMode
+	if m.FSGroup != nil && m.CommitChangesOn != NoCommit {
+		mode |= 0070 | os.ModeSetgid
+	}
+
+	if m.ReadOnly == ReadOnlyAlways {
+		mode &^= 0222
+	}
+
+	return mode
+}
+
+// resolveReadOnly resolves the read-only policy against whether the pod mounts the volume read-only.
+// Volumes which commit changes must be writable.
+func (o *ConfigMapOptions) resolveReadOnly(ro bool) error {
+	switch o.ReadOnly {
+	case "", ReadOnlyAuto:
+		o.ReadOnly = ReadOnlyNever
+		if ro || o.CommitChangesOn == NoCommit {
+			o.ReadOnly = ReadOnlyAlways
+		}
+	case ReadOnlyAlways:
+	case ReadOnlyNever:
+		if ro {
+			o.ReadOnly = ReadOnlyAlways
+		}
+	default:
+		return status.Errorf(codes.InvalidArgument, "valid values of %q are %q, %q and %q", "readOnly",
+			ReadOnlyAuto, ReadOnlyAlways, ReadOnlyNever)
+	}
+
+	if o.ReadOnly == ReadOnlyAlways && o.CommitChangesOn != NoCommit {
+		if ro {
+			return status.Error(codes.InvalidArgument, "commitChangesOn can't be set since the pod mounts the volume read-only")
+		}
+
+		return status.Error(codes.InvalidArgument, "commitChangesOn can't be used along with readOnly")
+	}
+
+	return nil
+}
+
+// owner returns the uid and gid of files in the volume. -1 means unchanged.
+func (m *volumeMetadata) owner() (uid, gid int) {
+	uid, gid = -1, -1
+	if m.UID != nil {
+		uid = int(*m.UID)
+	}
+
+	if m.GID != nil {
+		gid = int(*m.GID)
+	} else if m.FSGroup != nil {
+		gid = int(*m.FSGroup)
+	}
+
+	return
+}
+
+// applyOwnership changes the mode and owner of the path.
+func (m *volumeMetadata) applyOwnership(path string, mode os.FileMode) error {
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+
+	uid, gid := m.owner()
+	if uid < 0 && gid < 0 {
+		return nil
+	}
+
+	return os.Lchown(path, uid, gid)
+}
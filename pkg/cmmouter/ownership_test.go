@@ -0,0 +1,78 @@
+package cmmouter
+
+import (
+	"os"
+	"testing"
+)
+
+func TestFileMode(t *testing.T) {
+	defaultMode := int32(0600)
+	itemMode := int32(0400)
+	fsGroup := int64(2000)
+
+	cases := []struct {
+		metadata volumeMetadata
+		mode     os.FileMode
+	}{
+		{volumeMetadata{}, defaultFileMode},
+		{volumeMetadata{ConfigMapOptions: ConfigMapOptions{DefaultMode: &defaultMode}}, 0600},
+		{volumeMetadata{ConfigMapOptions: ConfigMapOptions{
+			DefaultMode: &defaultMode,
+			Items:       []KeyToPath{{Key: "foo", Mode: &itemMode}},
+		}}, 0400},
+		{volumeMetadata{
+			ConfigMapOptions: ConfigMapOptions{DefaultMode: &defaultMode},
+			PodInfo:          PodInfo{FSGroup: &fsGroup},
+		}, 0640},
+		{volumeMetadata{
+			ConfigMapOptions: ConfigMapOptions{DefaultMode: &defaultMode, CommitChangesOn: CommitOnModify},
+			PodInfo:          PodInfo{FSGroup: &fsGroup},
+		}, 0660},
+		{volumeMetadata{ConfigMapOptions: ConfigMapOptions{ReadOnly: ReadOnlyAlways}}, 0444},
+	}
+
+	for i, c := range cases {
+		if mode := c.metadata.fileMode("foo"); mode != c.mode {
+			t.Errorf("case %d: expect %#o, but got %#o", i, c.mode, mode)
+		}
+	}
+
+	if _, gid := (&volumeMetadata{PodInfo: PodInfo{FSGroup: &fsGroup}}).owner(); gid != int(fsGroup) {
+		t.Errorf("fsGroup should be the gid, but got %d", gid)
+	}
+}
+
+func TestResolveReadOnly(t *testing.T) {
+	cases := []struct {
+		opts     ConfigMapOptions
+		ro       bool
+		resolved ConfigMapReadOnlyPolicy
+	}{
+		{ConfigMapOptions{}, false, ReadOnlyAlways},
+		{ConfigMapOptions{CommitChangesOn: CommitOnUnmount}, false, ReadOnlyNever},
+		{ConfigMapOptions{ReadOnly: ReadOnlyNever}, false, ReadOnlyNever},
+		{ConfigMapOptions{ReadOnly: ReadOnlyNever}, true, ReadOnlyAlways},
+		{ConfigMapOptions{ReadOnly: ReadOnlyAuto, CommitChangesOn: CommitOnModify}, false, ReadOnlyNever},
+	}
+
+	for i, c := range cases {
+		if err := c.opts.resolveReadOnly(c.ro); err != nil || c.opts.ReadOnly != c.resolved {
+			t.Errorf("case %d: expect %q, but got %q: %v", i, c.resolved, c.opts.ReadOnly, err)
+		}
+	}
+
+	invalid := []struct {
+		opts ConfigMapOptions
+		ro   bool
+	}{
+		{ConfigMapOptions{ReadOnly: "yes"}, false},
+		{ConfigMapOptions{CommitChangesOn: CommitOnModify}, true},
+		{ConfigMapOptions{CommitChangesOn: CommitOnModify, ReadOnly: ReadOnlyAlways}, false},
+	}
+
+	for i, c := range invalid {
+		if err := c.opts.resolveReadOnly(c.ro); err == nil {
+			t.Errorf("case %d: should be invalid", i)
+		}
+	}
+}
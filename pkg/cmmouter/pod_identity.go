@@ -0,0 +1,124 @@
+package cmmouter
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// podIdentityHelper maintains clientsets authenticated by ServiceAccount tokens of pods.
+// Tokens are saved in files which clientsets reload periodically, so that rotated tokens passed by kubelet in
+// republishing take effect without rebuilding clientsets.
+type podIdentityHelper struct {
+	tokenRoot  string
+	baseConfig *rest.Config
+
+	guard sync.Mutex
+	// mapping from volumeKey to the clientset of its pod
+	clients map[string]kubernetes.Interface
+}
+
+func (h *podIdentityHelper) tokenPath(volumeID string) string {
+	return filepath.Join(h.tokenRoot, volumeID)
+}
+
+// saveToken writes the ServiceAccount token of the pod which mounts the volume.
+func (h *podIdentityHelper) saveToken(volumeID, token string) error {
+	if len(token) == 0 {
+		return status.Errorf(codes.InvalidArgument,
+			"no ServiceAccount token found for volume %q. tokenRequests of the CSIDriver is required", volumeID)
+	}
+
+	if err := os.MkdirAll(h.tokenRoot, 0700); err != nil {
+		klog.Errorf("unable to mkdir %q: %s", h.tokenRoot, err)
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	// Write a temporary file then rename it to avoid clients reading partial tokens.
+	path := h.tokenPath(volumeID)
+	if err := ioutil.WriteFile(path+".tmp", []byte(token), 0600); err != nil {
+		klog.Errorf("unable to write token of volume %q: %s", volumeID, err)
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		klog.Errorf("unable to write token of volume %q: %s", volumeID, err)
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	return nil
+}
+
+// podClientset returns the clientset authenticated by the pod token of the volume.
+func (h *podIdentityHelper) podClientset(volumeID string) (kubernetes.Interface, error) {
+	h.guard.Lock()
+	defer h.guard.Unlock()
+
+	if c, found := h.clients[volumeID]; found {
+		return c, nil
+	}
+
+	if h.baseConfig == nil {
+		return nil, status.Error(codes.FailedPrecondition, "pod identity is not supported")
+	}
+
+	path := h.tokenPath(volumeID)
+	if _, err := os.Stat(path); err != nil {
+		klog.Errorf("unable to find token of volume %q: %s", volumeID, err)
+		return nil, status.Errorf(codes.Unauthenticated, "no token found for volume %q", volumeID)
+	}
+
+	config := rest.AnonymousClientConfig(h.baseConfig)
+	config.BearerTokenFile = path
+	c, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		klog.Errorf("unable to create clientset for volume %q: %s", volumeID, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	h.clients[volumeID] = c
+	return c, nil
+}
+
+func (h *podIdentityHelper) deleteToken(volumeID string) {
+	h.guard.Lock()
+	delete(h.clients, volumeID)
+	h.guard.Unlock()
+
+	if err := os.Remove(h.tokenPath(volumeID)); err != nil && !os.IsNotExist(err) {
+		klog.Errorf("unable to delete token of volume %q: %s", volumeID, err)
+	}
+}
+
+// clientsetOf returns the clientset to access the ConfigMap of the volume.
+func (m *volumeMap) clientsetOf(volumeID string, metadata *volumeMetadata) (kubernetes.Interface, error) {
+	if !metadata.UsePodIdentity {
+		return m.clientset, nil
+	}
+
+	return m.podClientset(volumeID)
+}
+
+// watcherKeyOf returns the key of the ConfigMap watcher for the volume.
+// Volumes using pod identities have their own watchers.
+func watcherKeyOf(volumeID string, metadata *volumeMetadata) string {
+	key := cmKeyOf(metadata.ConfigMapName, metadata.ConfigMapNamespace)
+	switch metadata.ConfigMapRef {
+	case RefPointer:
+		key = "ref:" + cmKeyOf(metadata.Reference, metadata.ConfigMapNamespace)
+	case RefSelector:
+		key = "selector:" + cmKeyOf(metadata.Reference, metadata.ConfigMapNamespace)
+	}
+
+	if metadata.UsePodIdentity {
+		key += "@" + volumeID
+	}
+
+	return key
+}
@@ -0,0 +1,117 @@
+package cmmouter
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveToken(t *testing.T) {
+	root, err := ioutil.TempDir("", "cm-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	h := &podIdentityHelper{tokenRoot: filepath.Join(root, "tokens"), clients: map[string]kubernetes.Interface{}}
+	if err = h.saveToken("vol", ""); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("empty tokens should be rejected, but got %v", err)
+	}
+
+	for _, token := range []string{"token-1", "token-2"} {
+		if err = h.saveToken("vol", token); err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadFile(h.tokenPath("vol"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(content) != token {
+			t.Errorf("expect token %q, but got %q", token, content)
+		}
+	}
+
+	// Tokens are renamed from temporary files, which must not be left behind.
+	fis, err := ioutil.ReadDir(h.tokenRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fis) != 1 || fis[0].Name() != "vol" || fis[0].Mode().Perm() != 0600 {
+		t.Errorf("unexpected token files %v", fis)
+	}
+}
+
+func TestPodClientset(t *testing.T) {
+	root, err := ioutil.TempDir("", "cm-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	h := &podIdentityHelper{tokenRoot: root, clients: map[string]kubernetes.Interface{}}
+	if _, err = h.podClientset("vol"); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("pod identities require the base config, but got %v", err)
+	}
+
+	h.baseConfig = &rest.Config{Host: "https://127.0.0.1:6443", BearerToken: "driver"}
+	if _, err = h.podClientset("vol"); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("clientsets require tokens, but got %v", err)
+	}
+
+	if err = h.saveToken("vol", "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := h.podClientset("vol")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cached, _ := h.podClientset("vol"); cached != c {
+		t.Errorf("clientsets should be cached")
+	}
+
+	h.deleteToken("vol")
+	if _, err = h.podClientset("vol"); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("clientsets should be dropped along with tokens, but got %v", err)
+	}
+}
+
+func TestWatcherKeyOf(t *testing.T) {
+	cases := []struct {
+		metadata volumeMetadata
+		key      string
+	}{
+		{volumeMetadata{ConfigMapName: "cm-foo", ConfigMapNamespace: "foo"}, "cm-foo~foo"},
+		{volumeMetadata{
+			ConfigMapOptions: ConfigMapOptions{ConfigMapRef: RefPointer},
+			ConfigMapName:    "cm-foo-v1", ConfigMapNamespace: "foo", Reference: "cm-foo-current",
+		}, "ref:cm-foo-current~foo"},
+		{volumeMetadata{
+			ConfigMapOptions: ConfigMapOptions{ConfigMapRef: RefSelector},
+			ConfigMapName:    "cm-foo-v1", ConfigMapNamespace: "foo", Reference: "app=foo",
+		}, "selector:app=foo~foo"},
+		{volumeMetadata{
+			ConfigMapOptions: ConfigMapOptions{UsePodIdentity: true},
+			ConfigMapName:    "cm-foo", ConfigMapNamespace: "foo",
+		}, "cm-foo~foo@vol"},
+		{volumeMetadata{
+			ConfigMapOptions: ConfigMapOptions{ConfigMapRef: RefPointer, UsePodIdentity: true},
+			ConfigMapName:    "cm-foo-v1", ConfigMapNamespace: "foo", Reference: "cm-foo-current",
+		}, "ref:cm-foo-current~foo@vol"},
+	}
+
+	for i, c := range cases {
+		if key := watcherKeyOf("vol", &c.metadata); key != c.key {
+			t.Errorf("case %d: expect key %q, but got %q", i, c.key, key)
+		}
+	}
+}
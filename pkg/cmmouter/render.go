@@ -0,0 +1,118 @@
+package cmmouter
+
+import (
+	"bytes"
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"os"
+	"text/template"
+)
+
+type ConfigMapRenderMode string
+
+const (
+	NoRender       ConfigMapRenderMode = ""
+	RenderTemplate ConfigMapRenderMode = "template"
+)
+
+// TemplatePod is the pod information which templates can refer to as `.Pod`.
+type TemplatePod struct {
+	Name           string
+	Namespace      string
+	UID            string
+	ServiceAccount string
+	Labels         map[string]string
+	Annotations    map[string]string
+}
+
+// TemplateContext is the data to execute templates.
+type TemplateContext struct {
+	Pod  TemplatePod
+	Node string
+	// Env contains only environment variables of the driver which are allowed via --template-env.
+	Env map[string]string
+}
+
+func (o *ConfigMapOptions) validateRender() error {
+	switch o.Render {
+	case NoRender:
+	case RenderTemplate:
+		if o.CommitChangesOn != NoCommit {
+			return status.Error(codes.InvalidArgument,
+				"commitChangesOn can't be enabled if render is set since the content is derived")
+		}
+	default:
+		return status.Errorf(codes.InvalidArgument, "valid values of %q are %q and %q", "render", NoRender,
+			RenderTemplate)
+	}
+
+	return nil
+}
+
+func templateEnvOf(names []string) map[string]string {
+	env := make(map[string]string, len(names))
+	for _, name := range names {
+		if v, found := os.LookupEnv(name); found {
+			env[name] = v
+		}
+	}
+
+	return env
+}
+
+// renderConfigMap returns a copy of the ConfigMap with values of Data rendered if render is set.
+// BinaryData is never rendered.
+func (m *volumeMap) renderConfigMap(ctx context.Context, metadata *volumeMetadata, cm *corev1.ConfigMap) (
+	*corev1.ConfigMap, error,
+) {
+	if metadata.Render != RenderTemplate {
+		return cm, nil
+	}
+
+	pod, err := m.clientset.CoreV1().Pods(metadata.PodNamespace).Get(ctx, metadata.Pod, metav1.GetOptions{})
+	if err != nil {
+		recordAPIError("pods", "get")
+		klog.Errorf("unable to fetch pod %s/%s: %s", metadata.PodNamespace, metadata.Pod, err)
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	tmplCtx := &TemplateContext{
+		Pod: TemplatePod{
+			Name:           pod.Name,
+			Namespace:      pod.Namespace,
+			UID:            string(pod.UID),
+			ServiceAccount: pod.Spec.ServiceAccountName,
+			Labels:         pod.Labels,
+			Annotations:    pod.Annotations,
+		},
+		Node: m.node,
+		Env:  m.templateEnv,
+	}
+
+	rendered := cm.DeepCopy()
+	for k, v := range cm.Data {
+		if !metadata.filterKey(k) {
+			continue
+		}
+
+		tmpl, err := template.New(k).Option("missingkey=error").Parse(v)
+		if err != nil {
+			klog.Errorf("unable to parse template %q of configmap %s/%s: %s", k, cm.Namespace, cm.Name, err)
+			return nil, status.Errorf(codes.InvalidArgument, "invalid template %q: %s", k, err)
+		}
+
+		buf := bytes.Buffer{}
+		if err = tmpl.Execute(&buf, tmplCtx); err != nil {
+			klog.Errorf("unable to render template %q of configmap %s/%s: %s", k, cm.Namespace, cm.Name, err)
+			return nil, status.Errorf(codes.InvalidArgument, "unable to render template %q: %s", k, err)
+		}
+
+		rendered.Data[k] = buf.String()
+	}
+
+	return rendered, nil
+}
@@ -0,0 +1,100 @@
+package cmmouter
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestRenderConfigMap(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pod-0",
+			Namespace:   "foo",
+			UID:         "uid-0",
+			Labels:      map[string]string{"app": "web"},
+			Annotations: map[string]string{"port": "8080"},
+		},
+		Spec: corev1.PodSpec{ServiceAccountName: "sa-0"},
+	}
+
+	m := &volumeMap{
+		clientset:   fake.NewSimpleClientset(pod),
+		node:        "node-0",
+		templateEnv: map[string]string{"CLUSTER": "prod"},
+	}
+
+	metadata := &volumeMetadata{
+		ConfigMapOptions: ConfigMapOptions{Render: RenderTemplate, Exclude: []string{"raw.*"}},
+		PodInfo:          PodInfo{Pod: "pod-0", PodNamespace: "foo"},
+	}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cm-foo", Namespace: "foo"},
+		Data: map[string]string{
+			"pod.conf": `{{ .Pod.Namespace }}/{{ .Pod.Name }}/{{ .Pod.UID }}/{{ .Pod.ServiceAccount }}/` +
+				`{{ .Pod.Labels.app }}:{{ index .Pod.Annotations "port" }}`,
+			"node.conf": "{{ .Node }}.{{ .Env.CLUSTER }}",
+			"raw.tpl":   "{{ .Pod.Name }}",
+		},
+		BinaryData: map[string][]byte{"a.bin": []byte("{{ .Node }}")},
+	}
+
+	rendered, err := m.renderConfigMap(context.TODO(), metadata, cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"pod.conf":  "foo/pod-0/uid-0/sa-0/web:8080",
+		"node.conf": "node-0.prod",
+		// Keys filtered out are never rendered.
+		"raw.tpl": "{{ .Pod.Name }}",
+	}
+	for k, v := range expected {
+		if rendered.Data[k] != v {
+			t.Errorf("expect %q of key %q, but got %q", v, k, rendered.Data[k])
+		}
+	}
+
+	if string(rendered.BinaryData["a.bin"]) != "{{ .Node }}" {
+		t.Errorf("BinaryData should not be rendered")
+	}
+
+	if cm.Data["node.conf"] != "{{ .Node }}.{{ .Env.CLUSTER }}" {
+		t.Errorf("the ConfigMap should not be changed")
+	}
+
+	for _, tmpl := range []string{"{{ .Env.HOME }}", "{{ .Pod.Labels.tier }}", "{{ .Pod.Name "} {
+		cm.Data = map[string]string{"bad.conf": tmpl}
+		if _, err = m.renderConfigMap(context.TODO(), metadata, cm); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("template %q should be rejected, but got %v", tmpl, err)
+		}
+	}
+
+	metadata.Render = NoRender
+	if unrendered, _ := m.renderConfigMap(context.TODO(), metadata, cm); unrendered != cm {
+		t.Errorf("ConfigMaps should not be rendered unless render is set")
+	}
+}
+
+func TestValidateRender(t *testing.T) {
+	opts := ConfigMapOptions{Render: RenderTemplate}
+	if err := opts.validateRender(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.CommitChangesOn = CommitOnModify
+	if err := opts.validateRender(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("commits of rendered volumes should be rejected, but got %v", err)
+	}
+
+	opts = ConfigMapOptions{Render: "helm"}
+	if err := opts.validateRender(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("unknown render modes should be rejected, but got %v", err)
+	}
+}
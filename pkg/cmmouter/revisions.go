@@ -0,0 +1,520 @@
+package cmmouter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// annotationRetainRevisions on a ConfigMap enables snapshots of its revisions and limits the number of them.
+	annotationRetainRevisions = "csi-cm.warm-metal.tech/retain-revisions"
+
+	// labelSnapshotOf on a snapshot ConfigMap is the name of its source ConfigMap.
+	labelSnapshotOf = "csi-cm.warm-metal.tech/snapshot-of"
+
+	annotationSnapshotResourceVersion = "csi-cm.warm-metal.tech/resource-version"
+	annotationSnapshotContentHash     = "csi-cm.warm-metal.tech/content-hash"
+
+	// Author of revisions committed by pods
+	annotationAuthorPod    = "csi-cm.warm-metal.tech/author-pod"
+	annotationAuthorVolume = "csi-cm.warm-metal.tech/author-volume"
+	annotationAuthorNode   = "csi-cm.warm-metal.tech/author-node"
+
+	// annotationRollbackTo on a ConfigMap requests rolling it back to the revision of the ResourceVersion or
+	// content hash.
+	annotationRollbackTo = "csi-cm.warm-metal.tech/rollback-to"
+
+	// minimum length of content hash prefixes to pin
+	minContentHashPrefix = 8
+)
+
+// contentHashOf returns the SHA-256 digest of all keys and values of the ConfigMap. Values saved in shards must be
+// merged into it beforehand.
+func contentHashOf(cm *corev1.ConfigMap) string {
+	keys := make([]string, 0, len(cm.Data)+len(cm.BinaryData))
+	for k := range cm.Data {
+		keys = append(keys, k)
+	}
+
+	for k := range cm.BinaryData {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		v, _ := readDataFromConfigMap(cm, k)
+		fmt.Fprintf(h, "%d:%s%d:", len(k), k, len(v))
+		h.Write(v)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (o *ConfigMapOptions) pinned() bool {
+	return len(o.PinResourceVersion) > 0 || len(o.PinContentHash) > 0
+}
+
+func (o *ConfigMapOptions) validatePin() error {
+	if !o.pinned() {
+		return nil
+	}
+
+	if len(o.PinResourceVersion) > 0 && len(o.PinContentHash) > 0 {
+		return status.Error(codes.InvalidArgument, "only one of pinResourceVersion and pinContentHash can be set")
+	}
+
+	if len(o.PinContentHash) > 0 && len(o.PinContentHash) < minContentHashPrefix {
+		return status.Errorf(codes.InvalidArgument, "pinContentHash requires at least %d characters",
+			minContentHashPrefix)
+	}
+
+	if o.KeepCurrentAlways || o.CommitChangesOn != NoCommit {
+		return status.Error(codes.InvalidArgument,
+			"pinned volumes can't keep current or commit changes")
+	}
+
+	return nil
+}
+
+func (o *ConfigMapOptions) validateRetainRevisions() error {
+	if o.RetainRevisions < 0 {
+		return status.Errorf(codes.InvalidArgument, "retainRevisions must not be negative, but got %d",
+			o.RetainRevisions)
+	}
+
+	if o.RetainRevisions > 0 && o.CommitChangesOn == NoCommit {
+		return status.Error(codes.InvalidArgument, "retainRevisions is only valid if commitChangesOn is set")
+	}
+
+	return nil
+}
+
+// matchPin returns true if the revision of the ResourceVersion and content hash is the pinned one.
+func (o *ConfigMapOptions) matchPin(resourceVersion, contentHash string) bool {
+	if len(o.PinResourceVersion) > 0 {
+		return o.PinResourceVersion == resourceVersion
+	}
+
+	return strings.HasPrefix(contentHash, strings.ToLower(o.PinContentHash))
+}
+
+// matchRevision returns true if the revision is either the ResourceVersion or a prefix of the content hash.
+func matchRevision(revision, resourceVersion, contentHash string) bool {
+	if revision == resourceVersion {
+		return true
+	}
+
+	return len(revision) >= minContentHashPrefix && strings.HasPrefix(contentHash, strings.ToLower(revision))
+}
+
+// snapshotNameOf returns the name of the snapshot of the revision. Both the ResourceVersion and the content hash are
+// included since a ConfigMap may change back to the content of previous revisions.
+func snapshotNameOf(cm *corev1.ConfigMap, contentHash string) string {
+	name := cm.Name
+	// keep the name shorter than the 253 limit
+	if len(name) > 200 {
+		name = name[:200]
+	}
+
+	return fmt.Sprintf("%s-rev-%s-%s", name, cm.ResourceVersion, contentHash[:12])
+}
+
+// retainedRevisionsOf returns the number of revisions to be retained for the ConfigMap, or defaultRevisions if the
+// ConfigMap doesn't specify it.
+func retainedRevisionsOf(cm *corev1.ConfigMap, defaultRevisions int) int {
+	v, found := cm.Annotations[annotationRetainRevisions]
+	if !found {
+		return defaultRevisions
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		klog.Warningf("invalid annotation %s=%q of configmap %s/%s", annotationRetainRevisions, v, cm.Namespace,
+			cm.Name)
+		return defaultRevisions
+	}
+
+	return n
+}
+
+// snapshotConfigMap saves the revision of the ConfigMap in a snapshot ConfigMap owned by it, and prunes snapshots
+// except the latest retained ones. Nothing is saved if retained is 0. Extra annotations are attached to new snapshots.
+// The ConfigMap must come along with values saved in its shards. Snapshots refer to the same shards rather than
+// copying the values, and shards are kept until no snapshots refer to them.
+func snapshotConfigMap(
+	ctx context.Context, clientset kubernetes.Interface, cm *corev1.ConfigMap, retained int,
+	annotations map[string]string,
+) error {
+	if retained == 0 {
+		return nil
+	}
+
+	shards, err := shardsOf(cm)
+	if err != nil {
+		return err
+	}
+
+	binaryData := cm.BinaryData
+	if len(shards) > 0 {
+		binaryData = make(map[string][]byte, len(cm.BinaryData))
+		for k, v := range cm.BinaryData {
+			if _, sharded := shards[k]; !sharded {
+				binaryData[k] = v
+			}
+		}
+	}
+
+	contentHash := contentHashOf(cm)
+	snapshot := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      snapshotNameOf(cm, contentHash),
+			Namespace: cm.Namespace,
+			Labels:    map[string]string{labelSnapshotOf: cm.Name},
+			Annotations: map[string]string{
+				annotationSnapshotResourceVersion: cm.ResourceVersion,
+				annotationSnapshotContentHash:     contentHash,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: "v1",
+					Kind:       "ConfigMap",
+					Name:       cm.Name,
+					UID:        cm.UID,
+				},
+			},
+		},
+		Data:       cm.Data,
+		BinaryData: binaryData,
+	}
+
+	if len(shards) > 0 {
+		snapshot.Annotations[annotationShards] = cm.Annotations[annotationShards]
+	}
+
+	for k, v := range annotations {
+		snapshot.Annotations[k] = v
+	}
+
+	cli := clientset.CoreV1().ConfigMaps(cm.Namespace)
+	if _, err := cli.Create(ctx, snapshot, metav1.CreateOptions{}); err != nil {
+		if errors.IsAlreadyExists(err) {
+			return nil
+		}
+
+		recordAPIError("configmaps", "create")
+		klog.Errorf("unable to create snapshot of configmap %s/%s: %s", cm.Namespace, cm.Name, err)
+		return err
+	}
+
+	klog.Infof("snapshot %q of configmap %s/%s is created for ResourceVersion %s", snapshot.Name, cm.Namespace,
+		cm.Name, cm.ResourceVersion)
+
+	snapshots, err := listSnapshots(ctx, clientset, cm)
+	if err != nil {
+		return err
+	}
+
+	var pruned []*corev1.ConfigMap
+	for i := 0; i < len(snapshots)-retained; i++ {
+		klog.Infof("prune snapshot %q of configmap %s/%s", snapshots[i].Name, cm.Namespace, cm.Name)
+		if err = cli.Delete(ctx, snapshots[i].Name, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			recordAPIError("configmaps", "delete")
+			klog.Errorf("unable to delete snapshot %q: %s", snapshots[i].Name, err)
+			continue
+		}
+
+		pruned = append(pruned, &snapshots[i])
+	}
+
+	releaseShards(ctx, clientset, cm, shardNamesOf(pruned...))
+	return nil
+}
+
+// shardNamesOf returns names of shards which the ConfigMaps refer to. Invalid annotations are ignored.
+func shardNamesOf(cms ...*corev1.ConfigMap) []string {
+	var names []string
+	for _, cm := range cms {
+		shards, _ := shardsOf(cm)
+		for _, ref := range shards {
+			names = append(names, ref.ConfigMap)
+		}
+	}
+
+	return names
+}
+
+// releaseShards deletes the shards unless either the ConfigMap or its snapshots refer to them. Shards are kept if
+// snapshots can't be listed. They are removed along with the ConfigMap anyway.
+func releaseShards(ctx context.Context, clientset kubernetes.Interface, cm *corev1.ConfigMap, names []string) {
+	if len(names) == 0 {
+		return
+	}
+
+	snapshots, err := listSnapshots(ctx, clientset, cm)
+	if err != nil {
+		klog.Warningf("keep shards %q of configmap %s/%s since snapshots may refer to them", names, cm.Namespace,
+			cm.Name)
+		return
+	}
+
+	referred := make(map[string]bool)
+	for _, name := range shardNamesOf(cm) {
+		referred[name] = true
+	}
+
+	for i := range snapshots {
+		for _, name := range shardNamesOf(&snapshots[i]) {
+			referred[name] = true
+		}
+	}
+
+	var stale []string
+	for _, name := range names {
+		if !referred[name] {
+			referred[name] = true
+			stale = append(stale, name)
+		}
+	}
+
+	deleteShards(ctx, clientset, cm.Namespace, stale)
+}
+
+// isSnapshotOf returns true if the snapshot is owned by the ConfigMap. Labels can be set by anyone who can create
+// ConfigMaps in the namespace, so they alone don't identify snapshots.
+func isSnapshotOf(snapshot, cm *corev1.ConfigMap) bool {
+	for _, ref := range snapshot.OwnerReferences {
+		if ref.Kind == "ConfigMap" && ref.Name == cm.Name && ref.UID == cm.UID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// snapshotContentOf returns the revision saved in the snapshot along with values saved in shards. It returns nil if
+// the content doesn't match the content hash of the snapshot.
+func snapshotContentOf(ctx context.Context, clientset kubernetes.Interface, snapshot *corev1.ConfigMap) (
+	*corev1.ConfigMap, error,
+) {
+	content, err := mergeShards(ctx, clientset, snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	if contentHashOf(content) != snapshot.Annotations[annotationSnapshotContentHash] {
+		klog.Warningf("ignore snapshot %s/%s of which the content doesn't match the content hash",
+			snapshot.Namespace, snapshot.Name)
+		return nil, nil
+	}
+
+	return content, nil
+}
+
+// listSnapshots returns snapshots of the ConfigMap from the oldest to the latest. ConfigMaps labeled as its snapshots
+// but not owned by it are ignored.
+func listSnapshots(ctx context.Context, clientset kubernetes.Interface, cm *corev1.ConfigMap) (
+	[]corev1.ConfigMap, error,
+) {
+	list, err := clientset.CoreV1().ConfigMaps(cm.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{labelSnapshotOf: cm.Name}).String(),
+	})
+	if err != nil {
+		recordAPIError("configmaps", "list")
+		klog.Errorf("unable to list snapshots of configmap %s/%s: %s", cm.Namespace, cm.Name, err)
+		return nil, err
+	}
+
+	snapshots := make([]corev1.ConfigMap, 0, len(list.Items))
+	for i := range list.Items {
+		if !isSnapshotOf(&list.Items[i], cm) {
+			klog.Warningf("ignore configmap %q which is labeled as a snapshot of configmap %s/%s but not genuine",
+				list.Items[i].Name, cm.Namespace, cm.Name)
+			continue
+		}
+
+		snapshots = append(snapshots, list.Items[i])
+	}
+
+	// Creation timestamps are in seconds. Snapshots created in the same second are ordered by ResourceVersions.
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		ti, tj := snapshots[i].CreationTimestamp, snapshots[j].CreationTimestamp
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+
+		return resourceVersionLess(snapshots[i].Annotations[annotationSnapshotResourceVersion],
+			snapshots[j].Annotations[annotationSnapshotResourceVersion])
+	})
+
+	return snapshots, nil
+}
+
+// resourceVersionLess compares ResourceVersions numerically as etcd revisions, or lexically if they are not numbers.
+func resourceVersionLess(a, b string) bool {
+	va, errA := strconv.ParseUint(a, 10, 64)
+	vb, errB := strconv.ParseUint(b, 10, 64)
+	if errA != nil || errB != nil {
+		return a < b
+	}
+
+	return va < vb
+}
+
+// pinnedConfigMap returns the pinned revision of the ConfigMap, from either the current ConfigMap or its snapshots.
+// Both the ConfigMap and the revision returned come along with values saved in shards.
+func pinnedConfigMap(
+	ctx context.Context, clientset kubernetes.Interface, cm *corev1.ConfigMap, opts *ConfigMapOptions,
+) (*corev1.ConfigMap, error) {
+	if opts.matchPin(cm.ResourceVersion, contentHashOf(cm)) {
+		return cm, nil
+	}
+
+	snapshots, err := listSnapshots(ctx, clientset, cm)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		snapshot := &snapshots[i]
+		rv := snapshot.Annotations[annotationSnapshotResourceVersion]
+		if !opts.matchPin(rv, snapshot.Annotations[annotationSnapshotContentHash]) {
+			continue
+		}
+
+		content, err := snapshotContentOf(ctx, clientset, snapshot)
+		if err != nil {
+			return nil, err
+		}
+
+		if content == nil {
+			continue
+		}
+
+		klog.Infof("use snapshot %q as the pinned revision of configmap %s/%s", snapshot.Name, cm.Namespace, cm.Name)
+		pinned := cm.DeepCopy()
+		pinned.ResourceVersion = rv
+		pinned.Data = content.Data
+		pinned.BinaryData = content.BinaryData
+		// Values of the revision are all merged. Shards of the current ConfigMap must not be merged again.
+		delete(pinned.Annotations, annotationShards)
+		return pinned, nil
+	}
+
+	return nil, status.Errorf(codes.FailedPrecondition,
+		"the pinned revision of configmap %s/%s is neither current nor retained", cm.Namespace, cm.Name)
+}
+
+// rollbackConfigMap restores the ConfigMap to the revision requested via annotationRollbackTo with the clientset of
+// the volume. It returns true if the ConfigMap is rolled back or changed by others, in which case volumes are
+// refreshed on the next event. It returns false if no rollback is requested or the rollback fails.
+//
+// Requests are only seen by nodes with volumes keeping current with the ConfigMap. Nodes race to roll it back, but only
+// one of them succeeds since updates carry the ResourceVersion. Others get conflicts.
+func (m *volumeMap) rollbackConfigMap(
+	ctx context.Context, volumeID string, metadata *volumeMetadata, cm *corev1.ConfigMap,
+) bool {
+	// get volGuard locked in callers
+	revision, found := cm.Annotations[annotationRollbackTo]
+	if !found {
+		return false
+	}
+
+	clientset, err := m.clientsetOf(volumeID, metadata)
+	if err != nil {
+		klog.Errorf("unable to roll back configmap %s/%s for volume %q: %s", cm.Namespace, cm.Name, volumeID, err)
+		return false
+	}
+
+	cmRef := &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Name:       cm.Name,
+		Namespace:  cm.Namespace,
+		UID:        cm.UID,
+	}
+
+	rolled := cm.DeepCopy()
+	delete(rolled.Annotations, annotationRollbackTo)
+
+	var target *corev1.ConfigMap
+	snapshots, err := listSnapshots(ctx, clientset, cm)
+	if err != nil {
+		return false
+	}
+
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if !matchRevision(revision, snapshots[i].Annotations[annotationSnapshotResourceVersion],
+			snapshots[i].Annotations[annotationSnapshotContentHash]) {
+			continue
+		}
+
+		content, err := snapshotContentOf(ctx, clientset, &snapshots[i])
+		if err != nil {
+			return false
+		}
+
+		if content != nil {
+			target = &snapshots[i]
+			break
+		}
+	}
+
+	if target != nil {
+		// Restore the shards the revision refers to, which are kept along with the snapshot.
+		rolled.Data = target.Data
+		rolled.BinaryData = target.BinaryData
+		if shards, found := target.Annotations[annotationShards]; found {
+			rolled.Annotations[annotationShards] = shards
+		} else {
+			delete(rolled.Annotations, annotationShards)
+		}
+	}
+
+	rolled, err = clientset.CoreV1().ConfigMaps(cm.Namespace).Update(ctx, rolled, metav1.UpdateOptions{})
+	if err != nil {
+		if errors.IsConflict(err) {
+			// The ConfigMap has been rolled back on other volumes or updated by others.
+			return true
+		}
+
+		recordAPIError("configmaps", "update")
+		klog.Errorf("unable to roll back configmap %s/%s: %s", cm.Namespace, cm.Name, err)
+		return false
+	}
+
+	if target == nil {
+		klog.Errorf("revision %q of configmap %s/%s is not retained", revision, cm.Namespace, cm.Name)
+		if m.recorder != nil {
+			m.recorder.Eventf(cmRef, corev1.EventTypeWarning, reasonRollbackFailed,
+				"revision %q is not retained", revision)
+		}
+
+		return true
+	}
+
+	klog.Infof("configmap %s/%s is rolled back to %q as ResourceVersion %s", cm.Namespace, cm.Name, target.Name,
+		rolled.ResourceVersion)
+	releaseShards(ctx, clientset, rolled, shardNamesOf(cm))
+	if m.recorder != nil {
+		m.recorder.Eventf(cmRef, corev1.EventTypeNormal, reasonRolledBack,
+			"rolled back to revision %s, content hash %s, as ResourceVersion %s",
+			target.Annotations[annotationSnapshotResourceVersion], target.Annotations[annotationSnapshotContentHash],
+			rolled.ResourceVersion)
+	}
+
+	return true
+}
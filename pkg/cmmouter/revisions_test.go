@@ -0,0 +1,205 @@
+package cmmouter
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestContentHash(t *testing.T) {
+	foo := &corev1.ConfigMap{
+		Data:       map[string]string{"foo": "bar", "bar": "foo"},
+		BinaryData: map[string][]byte{"bin": []byte("foo")},
+	}
+
+	hash := contentHashOf(foo)
+	if len(hash) != 64 {
+		t.Fatalf("unexpected hash %q", hash)
+	}
+
+	moved := &corev1.ConfigMap{
+		Data:       map[string]string{"foo": "bar", "bar": "foo", "bin": "foo"},
+		BinaryData: map[string][]byte{},
+	}
+
+	if contentHashOf(moved) != hash {
+		t.Errorf("hash should be the same if values are the same")
+	}
+
+	joined := &corev1.ConfigMap{
+		Data: map[string]string{"foo": "barbar", "bin": "foo"},
+	}
+
+	if contentHashOf(joined) == hash {
+		t.Errorf("hash should be different if values are different")
+	}
+
+	opts := ConfigMapOptions{PinContentHash: hash[:8]}
+	if err := opts.validatePin(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !opts.matchPin("1", hash) || opts.matchPin("1", contentHashOf(joined)) {
+		t.Errorf("content hash prefix %q isn't matched correctly", opts.PinContentHash)
+	}
+}
+
+func TestValidatePin(t *testing.T) {
+	invalid := []ConfigMapOptions{
+		{PinResourceVersion: "1", PinContentHash: "12345678"},
+		{PinContentHash: "1234"},
+		{PinResourceVersion: "1", KeepCurrentAlways: true},
+		{PinResourceVersion: "1", CommitChangesOn: CommitOnUnmount},
+	}
+
+	for i, opts := range invalid {
+		if err := opts.validatePin(); err == nil {
+			t.Errorf("case %d: should be invalid", i)
+		}
+	}
+}
+
+func TestValidateRetainRevisions(t *testing.T) {
+	invalid := []ConfigMapOptions{
+		{RetainRevisions: -1, CommitChangesOn: CommitOnUnmount},
+		{RetainRevisions: 3},
+	}
+
+	for i, opts := range invalid {
+		if err := opts.validateRetainRevisions(); err == nil {
+			t.Errorf("case %d: should be invalid", i)
+		}
+	}
+
+	valid := ConfigMapOptions{RetainRevisions: 3, CommitChangesOn: CommitOnModify}
+	if err := valid.validateRetainRevisions(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMatchRevision(t *testing.T) {
+	hash := contentHashOf(&corev1.ConfigMap{Data: map[string]string{"foo": "bar"}})
+	cases := []struct {
+		revision string
+		matched  bool
+	}{
+		{"42", true},
+		{hash[:8], true},
+		{strings.ToUpper(hash[:12]), true},
+		{hash[:4], false},
+		{"43", false},
+	}
+
+	for _, c := range cases {
+		if matchRevision(c.revision, "42", hash) != c.matched {
+			t.Errorf("revision %q should be matched: %t", c.revision, c.matched)
+		}
+	}
+}
+
+func TestSnapshotRevisions(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", ResourceVersion: "9", UID: "uid-foo"},
+		Data:       map[string]string{"foo": "a"},
+	}
+
+	// A revision changes back to the content of a previous one.
+	for i, content := range []string{"a", "b", "a"} {
+		cm.ResourceVersion = strconv.Itoa(9 + i)
+		cm.Data["foo"] = content
+		if err := snapshotConfigMap(context.TODO(), clientset, cm, 10, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshots, err := listSnapshots(context.TODO(), clientset, cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snapshots) != 3 {
+		t.Fatalf("each revision should be saved, but got %d snapshots", len(snapshots))
+	}
+
+	// Snapshots are created in the same second and ordered by ResourceVersions, even "10" after "9".
+	for i, rv := range []string{"9", "10", "11"} {
+		if got := snapshots[i].Annotations[annotationSnapshotResourceVersion]; got != rv {
+			t.Errorf("snapshot %d should be of ResourceVersion %s, but got %s", i, rv, got)
+		}
+	}
+
+	pinned, err := pinnedConfigMap(context.TODO(), clientset, cm, &ConfigMapOptions{PinResourceVersion: "9"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pinned.ResourceVersion != "9" || pinned.Data["foo"] != "a" {
+		t.Errorf("unexpected pinned revision %s: %#v", pinned.ResourceVersion, pinned.Data)
+	}
+}
+
+func TestForgedSnapshots(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", ResourceVersion: "9", UID: "uid-foo"},
+		Data:       map[string]string{"foo": "a"},
+	}
+
+	if err := snapshotConfigMap(context.TODO(), clientset, cm, 10, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	genuine, err := listSnapshots(context.TODO(), clientset, cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(genuine) != 1 {
+		t.Fatalf("expect 1 snapshot, but got %d", len(genuine))
+	}
+
+	// A snapshot owned by another ConfigMap of the same name, and one with content modified after being saved
+	forged := map[string]*corev1.ConfigMap{}
+	forged["not-owned"] = genuine[0].DeepCopy()
+	forged["not-owned"].OwnerReferences[0].UID = "uid-bar"
+	forged["not-owned"].Annotations[annotationSnapshotResourceVersion] = "7"
+	forged["not-owned"].Data = map[string]string{"foo": "forged"}
+	forged["not-owned"].Annotations[annotationSnapshotContentHash] = contentHashOf(forged["not-owned"])
+	forged["modified"] = genuine[0].DeepCopy()
+	forged["modified"].Annotations[annotationSnapshotResourceVersion] = "8"
+	forged["modified"].Data = map[string]string{"foo": "forged"}
+	for name, snapshot := range forged {
+		snapshot.Name = name
+		snapshot.ResourceVersion = ""
+		if _, err = clientset.CoreV1().ConfigMaps("default").Create(
+			context.TODO(), snapshot, metav1.CreateOptions{},
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshots, err := listSnapshots(context.TODO(), clientset, cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Content is only checked when being used.
+	if len(snapshots) != 2 || snapshots[0].Name == "not-owned" || snapshots[1].Name == "not-owned" {
+		t.Errorf("snapshots not owned by the ConfigMap should be ignored, but got %d snapshots", len(snapshots))
+	}
+
+	for _, rv := range []string{"7", "8"} {
+		if _, err = pinnedConfigMap(
+			context.TODO(), clientset, cm, &ConfigMapOptions{PinResourceVersion: rv},
+		); status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("forged snapshot of ResourceVersion %s should not be pinned, but got %v", rv, err)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package cmmouter
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"hash/fnv"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// annotationRolloutPaused on a ConfigMap holds back refreshes of all volumes until it is removed.
+const annotationRolloutPaused = "csi-cm.warm-metal.tech/rollout-paused"
+
+// pendingRefresh is a refresh held back by the rollout policy or a paused rollout.
+type pendingRefresh struct {
+	cm    *corev1.ConfigMap
+	timer *time.Timer
+}
+
+func (o *ConfigMapOptions) staggered() bool {
+	return o.UpdateDelay > 0 || o.UpdateJitter > 0 || len(o.RolloutWaves) > 0
+}
+
+func (o *ConfigMapOptions) validateRollout() error {
+	if o.UpdateDelay == 0 && o.UpdateJitter == 0 && len(o.RolloutWaves) == 0 && o.WaveInterval == 0 {
+		return nil
+	}
+
+	if !o.KeepCurrentAlways {
+		return status.Error(codes.InvalidArgument, "rollout policies require keepCurrentAlways")
+	}
+
+	if o.UpdateDelay < 0 || o.UpdateJitter < 0 || o.WaveInterval < 0 {
+		return status.Error(codes.InvalidArgument, "updateDelay, updateJitter and waveInterval must be positive")
+	}
+
+	if len(o.RolloutWaves) == 0 {
+		if o.WaveInterval > 0 {
+			return status.Error(codes.InvalidArgument, "waveInterval is only valid if rolloutWaves is set")
+		}
+
+		return nil
+	}
+
+	if o.WaveInterval == 0 {
+		return status.Error(codes.InvalidArgument, "waveInterval is required if rolloutWaves is set")
+	}
+
+	last := 0
+	for _, pct := range o.RolloutWaves {
+		if pct <= last || pct > 100 {
+			return status.Errorf(codes.InvalidArgument,
+				"rolloutWaves must be ascending percentages in (0, 100], but got %v", o.RolloutWaves)
+		}
+
+		last = pct
+	}
+
+	if last != 100 {
+		return status.Errorf(codes.InvalidArgument, "the last wave of rolloutWaves must be 100, but got %d", last)
+	}
+
+	return nil
+}
+
+// waveOf returns the wave the pod belongs to. Pods are distributed to waves by hashes of their names.
+func (m *volumeMetadata) waveOf() int {
+	h := fnv.New32a()
+	h.Write([]byte(m.PodNamespace + "/" + m.Pod))
+	bucket := int(h.Sum32() % 100)
+	for i, pct := range m.RolloutWaves {
+		if bucket < pct {
+			return i
+		}
+	}
+
+	return len(m.RolloutWaves) - 1
+}
+
+func (m *volumeMetadata) refreshDelay() time.Duration {
+	delay := m.UpdateDelay
+	if len(m.RolloutWaves) > 0 {
+		delay += time.Duration(m.waveOf()) * m.WaveInterval
+	}
+
+	if m.UpdateJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(m.UpdateJitter)))
+	}
+
+	return delay
+}
+
+func rolloutPaused(cm *corev1.ConfigMap) bool {
+	return strings.ToLower(cm.Annotations[annotationRolloutPaused]) == "true"
+}
+
+// deferRefresh holds back the refresh of the volume to the ConfigMap if the rollout is paused or staggered.
+// It returns false if the volume should be refreshed right now.
+func (m *volumeMap) deferRefresh(volumeID string, metadata *volumeMetadata, cm *corev1.ConfigMap) bool {
+	// get volGuard locked in callers
+	pending := m.pendingRefreshes[volumeID]
+	if rolloutPaused(cm) {
+		if pending == nil {
+			pending = &pendingRefresh{}
+			m.pendingRefreshes[volumeID] = pending
+		} else if pending.timer != nil {
+			pending.timer.Stop()
+			pending.timer = nil
+		}
+
+		klog.Infof("rollout of configmap %s/%s is paused. hold back volume %q", cm.Namespace, cm.Name, volumeID)
+		pending.cm = cm
+		return true
+	}
+
+	if pending != nil && pending.timer != nil {
+		// The latest ConfigMap would be used when the timer fires.
+		pending.cm = cm
+		return true
+	}
+
+	if !metadata.staggered() || cm.ResourceVersion == metadata.ResourceVersion {
+		// Refresh right now if the rollout is resumed.
+		delete(m.pendingRefreshes, volumeID)
+		return false
+	}
+
+	if pending == nil {
+		pending = &pendingRefresh{}
+		m.pendingRefreshes[volumeID] = pending
+	}
+
+	pending.cm = cm
+	delay := metadata.refreshDelay()
+	klog.Infof("refresh of volume %q is delayed for %s", volumeID, delay)
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		m.volGuard.Lock()
+		defer m.volGuard.Unlock()
+		// The timer could be stopped or replaced while waiting for the lock.
+		if m.pendingRefreshes[volumeID] != pending || pending.timer != timer {
+			return
+		}
+
+		delete(m.pendingRefreshes, volumeID)
+		if m.metadataMap[volumeID] != nil {
+			m.refreshVolume(volumeID, m.metadataMap[volumeID], pending.cm)
+		}
+	})
+
+	pending.timer = timer
+	return true
+}
+
+// cancelPendingRefresh drops the refresh held back for the volume.
+func (m *volumeMap) cancelPendingRefresh(volumeID string) {
+	// get volGuard locked in callers
+	if pending := m.pendingRefreshes[volumeID]; pending != nil {
+		if pending.timer != nil {
+			pending.timer.Stop()
+		}
+
+		delete(m.pendingRefreshes, volumeID)
+	}
+}
@@ -0,0 +1,94 @@
+package cmmouter
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+func TestValidateRollout(t *testing.T) {
+	invalid := []ConfigMapOptions{
+		{UpdateDelay: time.Second},
+		{KeepCurrentAlways: true, UpdateDelay: -time.Second},
+		{KeepCurrentAlways: true, RolloutWaves: []int{10, 100}},
+		{KeepCurrentAlways: true, WaveInterval: time.Minute},
+		{KeepCurrentAlways: true, RolloutWaves: []int{50, 10, 100}, WaveInterval: time.Minute},
+		{KeepCurrentAlways: true, RolloutWaves: []int{10, 50}, WaveInterval: time.Minute},
+	}
+
+	for i, opts := range invalid {
+		if err := opts.validateRollout(); err == nil {
+			t.Errorf("case %d: should be invalid", i)
+		}
+	}
+
+	valid := ConfigMapOptions{KeepCurrentAlways: true, RolloutWaves: []int{10, 50, 100}, WaveInterval: time.Minute}
+	if err := valid.validateRollout(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWaves(t *testing.T) {
+	waves := make([]int, 3)
+	for i := 0; i < 1000; i++ {
+		metadata := &volumeMetadata{
+			ConfigMapOptions: ConfigMapOptions{RolloutWaves: []int{10, 50, 100}, WaveInterval: time.Minute},
+			PodInfo:          PodInfo{Pod: fmt.Sprintf("pod-%d", i), PodNamespace: "default"},
+		}
+
+		wave := metadata.waveOf()
+		if wave != metadata.waveOf() {
+			t.Fatalf("wave of pod %q should be stable", metadata.Pod)
+		}
+
+		if metadata.refreshDelay() != time.Duration(wave)*time.Minute {
+			t.Fatalf("unexpected delay %s of wave %d", metadata.refreshDelay(), wave)
+		}
+
+		waves[wave]++
+	}
+
+	// roughly 10%, 40% and 50%
+	if waves[0] < 50 || waves[0] > 150 || waves[1] < 300 || waves[1] > 500 || waves[2] < 400 || waves[2] > 600 {
+		t.Errorf("pods are not distributed as expected: %v", waves)
+	}
+}
+
+func TestDeferRefresh(t *testing.T) {
+	m := &volumeMap{
+		metadataMap:      make(map[string]*volumeMetadata),
+		pendingRefreshes: make(map[string]*pendingRefresh),
+	}
+
+	metadata := &volumeMetadata{ResourceVersion: "1"}
+	paused := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+		ResourceVersion: "2",
+		Annotations:     map[string]string{annotationRolloutPaused: "true"},
+	}}
+
+	if !m.deferRefresh("vol", metadata, paused) {
+		t.Fatal("refresh should be held back if the rollout is paused")
+	}
+
+	resumed := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "3"}}
+	if m.deferRefresh("vol", metadata, resumed) || len(m.pendingRefreshes) > 0 {
+		t.Fatal("refresh should go on once the rollout is resumed")
+	}
+
+	metadata.UpdateDelay = time.Hour
+	if !m.deferRefresh("vol", metadata, resumed) || m.pendingRefreshes["vol"].timer == nil {
+		t.Fatal("refresh should be delayed")
+	}
+
+	latest := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "4"}}
+	if !m.deferRefresh("vol", metadata, latest) || m.pendingRefreshes["vol"].cm != latest {
+		t.Fatal("the latest configmap should be used in the delayed refresh")
+	}
+
+	m.cancelPendingRefresh("vol")
+	if len(m.pendingRefreshes) > 0 {
+		t.Fatal("pending refreshes should be canceled")
+	}
+}
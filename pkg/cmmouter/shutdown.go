@@ -0,0 +1,135 @@
+package cmmouter
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"sort"
+)
+
+var errShuttingDown = status.Error(codes.Unavailable, "the plugin is shutting down")
+
+// stop shuts down watchers and commits local changes of volumes which are committed on modification. Refreshes
+// held back and commits not done before the deadline of ctx are saved as interrupted work, which is resumed on the
+// next start.
+func (m *volumeMap) stop(ctx context.Context) error {
+	m.volGuard.Lock()
+	if m.stopped {
+		m.volGuard.Unlock()
+		return nil
+	}
+
+	m.stopped = true
+	m.volGuard.Unlock()
+
+	// Watchers and the garbage collector run with volGuard locked. Stop them before draining.
+	klog.Info("stop the garbage collector, configmap and volume watchers")
+	m.stopGC()
+	m.cmWatcher.stop()
+	m.volWatcher.stop()
+
+	// Notifications time out after notifyHTTPTimeout.
+	klog.Info("wait for HTTP notifications in flight")
+	m.notifications.Wait()
+
+	m.volGuard.Lock()
+	defer m.volGuard.Unlock()
+
+	works := make(map[string]*interruptedWork)
+	for volumeID := range m.pendingRefreshes {
+		klog.Infof("refresh of volume %q is held back. resume it on the next start", volumeID)
+		m.cancelPendingRefresh(volumeID)
+		works[volumeID] = &interruptedWork{Refresh: true}
+	}
+
+	volumes := make([]string, 0, len(m.metadataMap))
+	for volumeID, metadata := range m.metadataMap {
+		if metadata.CommitChangesOn == CommitOnModify {
+			volumes = append(volumes, volumeID)
+		}
+	}
+
+	sort.Strings(volumes)
+	for _, volumeID := range volumes {
+		metadata := m.metadataMap[volumeID]
+		if !m.locallyModified(volumeID, metadata) {
+			continue
+		}
+
+		if ctx.Err() == nil {
+			klog.Infof("commit local changes of volume %q before shutdown", volumeID)
+			err := m.commitLocalVolumeChanges(ctx, volumeID, metadata)
+			if status.Code(err) != codes.Unavailable {
+				continue
+			}
+		}
+
+		klog.Warningf("local changes of volume %q are not committed. resume it on the next start", volumeID)
+		if works[volumeID] == nil {
+			works[volumeID] = &interruptedWork{}
+		}
+
+		works[volumeID].Commit = true
+	}
+
+	for volumeID, work := range works {
+		m.persistentInterruptedWork(volumeID, work)
+	}
+
+	klog.Info("close the state store")
+	return m.stateStore.close()
+}
+
+// locallyModified checks whether the volume differs from the ConfigMap content it was refreshed or committed to.
+func (m *volumeMap) locallyModified(volumeID string, metadata *volumeMetadata) bool {
+	keys, err := m.driftedKeys(volumeID, metadata)
+	return err == nil && len(keys) > 0
+}
+
+// resumeInterruptedWork resumes commits and refreshes interrupted by the last shutdown.
+func (m *volumeMap) resumeInterruptedWork(ctx context.Context) {
+	// get volGuard locked in callers
+	works, err := m.loadInterruptedWork()
+	if err != nil {
+		return
+	}
+
+	for volumeID, work := range works {
+		metadata := m.metadataMap[volumeID]
+		if metadata == nil {
+			m.deleteInterruptedWork(volumeID)
+			continue
+		}
+
+		if work.Commit && metadata.CommitChangesOn == CommitOnModify {
+			klog.Infof("resume the interrupted commit of volume %q", volumeID)
+			if err := m.commitLocalVolumeChanges(ctx, volumeID, metadata); status.Code(err) == codes.Unavailable {
+				// Keep the work until the commit succeeds.
+				continue
+			}
+		}
+
+		m.deleteInterruptedWork(volumeID)
+		if work.Refresh && metadata.KeepCurrentAlways {
+			clientset, err := m.clientsetOf(volumeID, metadata)
+			if err != nil {
+				klog.Errorf("unable to resume the refresh of volume %q: %s", volumeID, err)
+				continue
+			}
+
+			cm, err := clientset.CoreV1().ConfigMaps(metadata.ConfigMapNamespace).
+				Get(ctx, metadata.ConfigMapName, metav1.GetOptions{})
+			if err != nil {
+				recordAPIError("configmaps", "get")
+				klog.Errorf("unable to fetch configmap %s/%s: %s", metadata.ConfigMapNamespace,
+					metadata.ConfigMapName, err)
+				continue
+			}
+
+			klog.Infof("resume the held back refresh of volume %q", volumeID)
+			m.updateLocalFs(volumeID, cm)
+		}
+	}
+}
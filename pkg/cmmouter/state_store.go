@@ -0,0 +1,401 @@
+package cmmouter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/xerrors"
+	"io/ioutil"
+	"k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	stateStoreFile = "state.db"
+	// legacyMetadataDir is where the per-volume JSON metadata files were saved before the state store.
+	legacyMetadataDir = "metadata"
+
+	// stateSchemaVersion should be increased whenever the layout of buckets or records changes.
+	stateSchemaVersion = 1
+
+	maxCommitHistory = 32
+)
+
+var (
+	bucketSchema   = []byte("schema")
+	bucketVolumes  = []byte("volumes")
+	bucketDigests  = []byte("digests")
+	bucketHistory  = []byte("history")
+	bucketWatchers = []byte("watchers")
+	// bucketInterrupted saves work interrupted by the last shutdown.
+	bucketInterrupted = []byte("interrupted")
+
+	keySchemaVersion = []byte("version")
+)
+
+// commitRecord saves a successful commit of local changes to a ConfigMap.
+type commitRecord struct {
+	Volume          string    `json:"volume"`
+	Pod             string    `json:"pod"`
+	PodNamespace    string    `json:"podNamespace"`
+	ResourceVersion string    `json:"resourceVersion"`
+	Keys            []string  `json:"keys,omitempty"`
+	Time            time.Time `json:"time"`
+}
+
+// watcherState saves the last ResourceVersion the ConfigMap watcher observed. Watchers restarted after a restart of
+// the plugin compare it to the current ResourceVersion to catch up changes made while not watching.
+type watcherState struct {
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+// interruptedWork saves work of a volume which is interrupted by shutdown. It is resumed on the next start.
+type interruptedWork struct {
+	// Commit is set if local changes are not committed yet.
+	Commit bool `json:"commit,omitempty"`
+	// Refresh is set if the refresh to the latest ConfigMap is held back.
+	Refresh bool `json:"refresh,omitempty"`
+}
+
+// stateStore is a transactional store of volume metadata, content digests, commit history, watcher states and
+// interrupted work.
+type stateStore struct {
+	db *bolt.DB
+}
+
+func openStateStore(sourceRoot string) (*stateStore, error) {
+	path := filepath.Join(sourceRoot, stateStoreFile)
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		klog.Errorf("unable to open state store %q: %s", path, err)
+		return nil, err
+	}
+
+	s := &stateStore{db: db}
+	if err = s.upgrade(filepath.Join(sourceRoot, legacyMetadataDir)); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *stateStore) upgrade(legacyMetaRoot string) error {
+	migrated := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{
+			bucketSchema, bucketVolumes, bucketDigests, bucketHistory, bucketWatchers, bucketInterrupted,
+		} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		schema := tx.Bucket(bucketSchema)
+		version := 0
+		if v := schema.Get(keySchemaVersion); v != nil {
+			var err error
+			if version, err = strconv.Atoi(string(v)); err != nil {
+				return xerrors.Errorf("invalid schema version %q: %s", v, err)
+			}
+		}
+
+		if version > stateSchemaVersion {
+			return xerrors.Errorf("schema version %d of the state store is newer than %d", version,
+				stateSchemaVersion)
+		}
+
+		if version == stateSchemaVersion {
+			return nil
+		}
+
+		if version == 0 {
+			if err := migrateLegacyMetadata(tx.Bucket(bucketVolumes), legacyMetaRoot); err != nil {
+				return err
+			}
+			migrated = true
+		}
+
+		klog.Infof("upgrade the state store from schema version %d to %d", version, stateSchemaVersion)
+		return schema.Put(keySchemaVersion, []byte(strconv.Itoa(stateSchemaVersion)))
+	})
+
+	if err != nil {
+		klog.Errorf("unable to upgrade the state store: %s", err)
+		return err
+	}
+
+	if migrated {
+		if err = os.RemoveAll(legacyMetaRoot); err != nil {
+			klog.Warningf("unable to remove the legacy metadata directory %q: %s", legacyMetaRoot, err)
+		}
+	}
+
+	return nil
+}
+
+// migrateLegacyMetadata imports metadata files of the legacy metadata directory into the volume bucket.
+func migrateLegacyMetadata(volumes *bolt.Bucket, legacyMetaRoot string) error {
+	fis, err := ioutil.ReadDir(legacyMetaRoot)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		klog.Errorf("unable to read legacy metadata from %q: %s", legacyMetaRoot, err)
+		return err
+	}
+
+	for _, fi := range fis {
+		path := filepath.Join(legacyMetaRoot, fi.Name())
+		bytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			klog.Errorf("unable to read legacy metadata file %q: %s", path, err)
+			return err
+		}
+
+		// Broken metadata is skipped. Its volume will be cleaned as an ambiguous volume.
+		if err = json.Unmarshal(bytes, &volumeMetadata{}); err != nil {
+			klog.Errorf("unable to decode legacy metadata from %q: %s. skip it", path, err)
+			continue
+		}
+
+		klog.Infof("migrate metadata of volume %q", fi.Name())
+		if err = volumes.Put([]byte(fi.Name()), bytes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *stateStore) close() error {
+	return s.db.Close()
+}
+
+func (s *stateStore) loadMetadata(volumeKey string) (*volumeMetadata, error) {
+	metadata := &volumeMetadata{}
+	found, err := s.get(bucketVolumes, volumeKey, metadata)
+	if err != nil {
+		klog.Errorf("unable to load metadata of volume %q: %s", volumeKey, err)
+		return nil, err
+	}
+
+	if !found {
+		klog.Errorf("metadata of volume %q not found", volumeKey)
+		return nil, os.ErrNotExist
+	}
+
+	return metadata, nil
+}
+
+func (s *stateStore) persistentMetadata(volumeKey string, metadata *volumeMetadata) error {
+	if err := s.put(bucketVolumes, volumeKey, metadata); err != nil {
+		klog.Errorf("unable to write metadata of volume %q: %s", volumeKey, err)
+		return err
+	}
+
+	return nil
+}
+
+// deleteMetadata removes the metadata, content digests and interrupted work of the volume.
+func (s *stateStore) deleteMetadata(volumeKey string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{bucketVolumes, bucketDigests, bucketInterrupted} {
+			if err := tx.Bucket(bucket).Delete([]byte(volumeKey)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		klog.Errorf("unable to delete metadata of volume %q: %s", volumeKey, err)
+	}
+	return err
+}
+
+// listVolumes returns keys of all volumes which have metadata.
+func (s *stateStore) listVolumes() (keys []string, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketVolumes).ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+
+	if err != nil {
+		klog.Errorf("unable to list volumes in the state store: %s", err)
+	}
+	return
+}
+
+// contentDigests maps keys to SHA-256 digests of their content.
+type contentDigests map[string]string
+
+func digestOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *stateStore) persistentDigests(volumeKey string, digests contentDigests) error {
+	if err := s.put(bucketDigests, volumeKey, digests); err != nil {
+		klog.Errorf("unable to write content digests of volume %q: %s", volumeKey, err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *stateStore) loadDigests(volumeKey string) (contentDigests, error) {
+	digests := contentDigests{}
+	if _, err := s.get(bucketDigests, volumeKey, &digests); err != nil {
+		klog.Errorf("unable to load content digests of volume %q: %s", volumeKey, err)
+		return nil, err
+	}
+
+	return digests, nil
+}
+
+// appendHistory saves the commit record of a ConfigMap. Only the latest maxCommitHistory records are kept.
+func (s *stateStore) appendHistory(cmKey string, record *commitRecord) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketHistory)
+		var history []*commitRecord
+		if v := b.Get([]byte(cmKey)); v != nil {
+			if err := json.Unmarshal(v, &history); err != nil {
+				return err
+			}
+		}
+
+		history = append(history, record)
+		if len(history) > maxCommitHistory {
+			history = history[len(history)-maxCommitHistory:]
+		}
+
+		bytes, err := json.Marshal(history)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(cmKey), bytes)
+	})
+
+	if err != nil {
+		klog.Errorf("unable to save commit history of configmap %q: %s", cmKey, err)
+	}
+	return err
+}
+
+func (s *stateStore) loadHistory(cmKey string) (history []*commitRecord, err error) {
+	if _, err = s.get(bucketHistory, cmKey, &history); err != nil {
+		klog.Errorf("unable to load commit history of configmap %q: %s", cmKey, err)
+	}
+	return
+}
+
+// loadWatcherState returns the saved state of the watcher, or nil if not found.
+func (s *stateStore) loadWatcherState(mapKey string) (*watcherState, error) {
+	state := &watcherState{}
+	found, err := s.get(bucketWatchers, mapKey, state)
+	if err != nil {
+		klog.Errorf("unable to load state of watcher %q: %s", mapKey, err)
+		return nil, err
+	}
+
+	if !found {
+		return nil, nil
+	}
+
+	return state, nil
+}
+
+func (s *stateStore) persistentWatcherState(mapKey string, state *watcherState) error {
+	if err := s.put(bucketWatchers, mapKey, state); err != nil {
+		klog.Errorf("unable to write state of watcher %q: %s", mapKey, err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *stateStore) deleteWatcherState(mapKey string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketWatchers).Delete([]byte(mapKey))
+	})
+
+	if err != nil {
+		klog.Errorf("unable to delete state of watcher %q: %s", mapKey, err)
+	}
+	return err
+}
+
+func (s *stateStore) persistentInterruptedWork(volumeKey string, work *interruptedWork) error {
+	if err := s.put(bucketInterrupted, volumeKey, work); err != nil {
+		klog.Errorf("unable to write interrupted work of volume %q: %s", volumeKey, err)
+		return err
+	}
+
+	return nil
+}
+
+// loadInterruptedWork returns interrupted work of all volumes.
+func (s *stateStore) loadInterruptedWork() (works map[string]*interruptedWork, err error) {
+	works = make(map[string]*interruptedWork)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketInterrupted).ForEach(func(k, v []byte) error {
+			work := &interruptedWork{}
+			if err := json.Unmarshal(v, work); err != nil {
+				return err
+			}
+
+			works[string(k)] = work
+			return nil
+		})
+	})
+
+	if err != nil {
+		klog.Errorf("unable to load interrupted work: %s", err)
+	}
+	return
+}
+
+func (s *stateStore) deleteInterruptedWork(volumeKey string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketInterrupted).Delete([]byte(volumeKey))
+	})
+
+	if err != nil {
+		klog.Errorf("unable to delete interrupted work of volume %q: %s", volumeKey, err)
+	}
+	return err
+}
+
+func (s *stateStore) put(bucket []byte, key string, v interface{}) error {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), bytes)
+	})
+}
+
+func (s *stateStore) get(bucket []byte, key string, v interface{}) (found bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		bytes := tx.Bucket(bucket).Get([]byte(key))
+		if bytes == nil {
+			return nil
+		}
+
+		found = true
+		return json.Unmarshal(bytes, v)
+	})
+	return
+}
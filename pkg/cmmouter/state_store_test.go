@@ -0,0 +1,112 @@
+package cmmouter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStateStoreMigrateLegacyMetadata(t *testing.T) {
+	root, err := ioutil.TempDir("", "cm-state-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	legacyRoot := filepath.Join(root, legacyMetadataDir)
+	if err = os.MkdirAll(legacyRoot, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	legacy := &volumeMetadata{
+		ConfigMapOptions:   ConfigMapOptions{SubPath: "foo.txt", CommitChangesOn: CommitOnUnmount},
+		ConfigMapName:      "foo",
+		ConfigMapNamespace: "default",
+		PodInfo:            PodInfo{Pod: "bar", PodNamespace: "default"},
+		ResourceVersion:    "42",
+	}
+
+	bytes, _ := json.Marshal(legacy)
+	if err = ioutil.WriteFile(filepath.Join(legacyRoot, "vol-1"), bytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(legacyRoot, "vol-broken"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := openStateStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := store.loadMetadata("vol-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(metadata, legacy) {
+		t.Errorf("metadata mismatched: %#v", metadata)
+	}
+
+	if _, err = store.loadMetadata("vol-broken"); err == nil {
+		t.Error("broken metadata should not be migrated")
+	}
+
+	if _, err = os.Stat(legacyRoot); !os.IsNotExist(err) {
+		t.Errorf("legacy metadata directory should be removed: %v", err)
+	}
+
+	store.close()
+
+	// Reopening the store must not lose migrated metadata.
+	if store, err = openStateStore(root); err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+
+	keys, err := store.listVolumes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 1 || keys[0] != "vol-1" {
+		t.Errorf("unexpected volumes %#v", keys)
+	}
+}
+
+func TestStateStoreBoundedHistory(t *testing.T) {
+	root, err := ioutil.TempDir("", "cm-state-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	store, err := openStateStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+
+	for i := 0; i < maxCommitHistory+3; i++ {
+		if err = store.appendHistory("foo~default", &commitRecord{ResourceVersion: string(rune('a' + i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history, err := store.loadHistory("foo~default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history) != maxCommitHistory {
+		t.Fatalf("expect %d records, but got %d", maxCommitHistory, len(history))
+	}
+
+	if history[0].ResourceVersion != string(rune('a'+3)) {
+		t.Errorf("the oldest records should be dropped, but got %q", history[0].ResourceVersion)
+	}
+}
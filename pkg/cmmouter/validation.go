@@ -0,0 +1,179 @@
+package cmmouter
+
+import (
+	"encoding/json"
+	"github.com/xeipuuv/gojsonschema"
+	"golang.org/x/xerrors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"path"
+	"regexp"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+type ValueValidatorType string
+
+const (
+	ValidateJSON       ValueValidatorType = "json"
+	ValidateYAML       ValueValidatorType = "yaml"
+	ValidateRegex      ValueValidatorType = "regex"
+	ValidateJSONSchema ValueValidatorType = "jsonSchema"
+)
+
+// ValueValidator checks values of keys matching the glob pattern Key before committing them.
+type ValueValidator struct {
+	Key  string             `json:"key"`
+	Type ValueValidatorType `json:"type"`
+	// Pattern is the regular expression values must match if Type is regex.
+	Pattern string `json:"pattern,omitempty"`
+	// Schema is the JSON Schema, in either JSON or YAML, to validate values in JSON or YAML if Type is jsonSchema.
+	Schema json.RawMessage `json:"schema,omitempty"`
+}
+
+func (o *ConfigMapOptions) validateValidators() error {
+	for _, v := range o.Validate {
+		if _, err := path.Match(v.Key, ""); err != nil || len(v.Key) == 0 {
+			return status.Errorf(codes.InvalidArgument, "invalid key pattern %q of validators", v.Key)
+		}
+
+		switch v.Type {
+		case ValidateJSON, ValidateYAML:
+		case ValidateRegex:
+			if _, err := regexp.Compile(v.Pattern); err != nil {
+				return status.Errorf(codes.InvalidArgument, "invalid pattern of validator for %q: %s", v.Key, err)
+			}
+		case ValidateJSONSchema:
+			schema, err := v.schema()
+			if err == nil {
+				_, err = gojsonschema.NewSchema(gojsonschema.NewBytesLoader(schema))
+			}
+
+			if err != nil {
+				return status.Errorf(codes.InvalidArgument, "invalid schema of validator for %q: %s", v.Key, err)
+			}
+		default:
+			return status.Errorf(codes.InvalidArgument, "valid types of validators are %q, %q, %q and %q",
+				ValidateJSON, ValidateYAML, ValidateRegex, ValidateJSONSchema)
+		}
+	}
+
+	return nil
+}
+
+// validateValue checks the value of the key against all matching validators.
+func (o *ConfigMapOptions) validateValue(key string, value []byte) error {
+	for _, v := range o.Validate {
+		if matched, _ := path.Match(v.Key, key); !matched {
+			continue
+		}
+
+		if err := v.check(value); err != nil {
+			return status.Errorf(codes.InvalidArgument, "%q is invalid: %s", key, err)
+		}
+	}
+
+	return nil
+}
+
+// schema returns the JSON Schema in JSON. The schema could be either an object or a string in JSON or YAML.
+// Schemas referring to anything but themselves are rejected, since the plugin would otherwise fetch any URL or file
+// which pods specify.
+func (v *ValueValidator) schema() ([]byte, error) {
+	schema := []byte(v.Schema)
+	if len(v.Schema) > 0 && v.Schema[0] == '"' {
+		var s string
+		if err := json.Unmarshal(v.Schema, &s); err != nil {
+			return nil, err
+		}
+
+		var err error
+		if schema, err = yaml.YAMLToJSON([]byte(s)); err != nil {
+			return nil, err
+		}
+	}
+
+	var obj interface{}
+	if err := json.Unmarshal(schema, &obj); err != nil {
+		return nil, err
+	}
+
+	if err := checkLocalRefs(obj); err != nil {
+		return nil, err
+	}
+
+	return schema, nil
+}
+
+// checkLocalRefs returns an error if any "$ref", "$id" or "id" of the schema isn't a fragment of the schema itself.
+func checkLocalRefs(obj interface{}) error {
+	switch o := obj.(type) {
+	case map[string]interface{}:
+		for k, v := range o {
+			if ref, ok := v.(string); ok && (k == "$ref" || k == "$id" || k == "id") && !strings.HasPrefix(ref, "#") {
+				return xerrors.Errorf("%s %q out of the schema is not allowed", k, ref)
+			}
+
+			if err := checkLocalRefs(v); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, v := range o {
+			if err := checkLocalRefs(v); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (v *ValueValidator) check(value []byte) error {
+	switch v.Type {
+	case ValidateJSON:
+		if !json.Valid(value) {
+			return xerrors.New("malformed JSON")
+		}
+	case ValidateYAML:
+		var obj interface{}
+		if err := yaml.Unmarshal(value, &obj); err != nil {
+			return err
+		}
+	case ValidateRegex:
+		re, err := regexp.Compile(v.Pattern)
+		if err != nil {
+			return err
+		}
+
+		if !re.Match(value) {
+			return xerrors.Errorf("not matching %q", v.Pattern)
+		}
+	case ValidateJSONSchema:
+		doc, err := yaml.YAMLToJSON(value)
+		if err != nil {
+			return err
+		}
+
+		schema, err := v.schema()
+		if err != nil {
+			return err
+		}
+
+		result, err := gojsonschema.Validate(gojsonschema.NewBytesLoader(schema), gojsonschema.NewBytesLoader(doc))
+		if err != nil {
+			return err
+		}
+
+		if !result.Valid() {
+			msgs := make([]string, 0, len(result.Errors()))
+			for _, e := range result.Errors() {
+				msgs = append(msgs, e.String())
+			}
+
+			return xerrors.New(strings.Join(msgs, "; "))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package cmmouter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestValidateValue(t *testing.T) {
+	opts := ConfigMapOptions{
+		Validate: []ValueValidator{
+			{Key: "*.json", Type: ValidateJSON},
+			{Key: "*.yaml", Type: ValidateYAML},
+			{Key: "port", Type: ValidateRegex, Pattern: `^[0-9]+$`},
+			{Key: "app.yaml", Type: ValidateJSONSchema, Schema: []byte(`{
+				"type": "object",
+				"required": ["name"],
+				"properties": {"name": {"type": "string"}}
+			}`)},
+			{Key: "app.json", Type: ValidateJSONSchema, Schema: []byte(`"type: object\nrequired: [name]"`)},
+		},
+	}
+
+	if err := opts.validateValidators(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		key   string
+		value string
+		valid bool
+	}{
+		{"foo.json", `{"a": 1}`, true},
+		{"foo.json", `{"a": 1`, false},
+		{"foo.yaml", "a: [1", false},
+		{"port", "8080", true},
+		{"port", "http", false},
+		{"app.yaml", "name: foo", true},
+		{"app.yaml", "name: 1", false},
+		{"app.json", `{"name": "foo"}`, true},
+		{"app.json", `{"id": "foo"}`, false},
+		{"unchecked", "anything", true},
+	}
+
+	for i, c := range cases {
+		if err := opts.validateValue(c.key, []byte(c.value)); (err == nil) != c.valid {
+			t.Errorf("case %d: expect valid %v, but got %v", i, c.valid, err)
+		}
+	}
+
+	invalid := ConfigMapOptions{Validate: []ValueValidator{{Key: "port", Type: ValidateRegex, Pattern: "["}}}
+	if err := invalid.validateValidators(); err == nil {
+		t.Error("invalid regex should fail")
+	}
+}
+
+func TestRemoteSchemaRefs(t *testing.T) {
+	var fetched int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetched, 1)
+		w.Write([]byte(`{"type": "string"}`))
+	}))
+	defer server.Close()
+
+	for _, schema := range []string{
+		`{"$ref": "` + server.URL + `/schema.json"}`,
+		`{"properties": {"name": {"$ref": "file:///etc/passwd"}}}`,
+		`"allOf:\n- $ref: ` + server.URL + `/schema.json"`,
+		`{"$id": "` + server.URL + `/", "$ref": "#/definitions/name", "definitions": {"name": {"type": "string"}}}`,
+	} {
+		opts := ConfigMapOptions{Validate: []ValueValidator{{Key: "*", Type: ValidateJSONSchema, Schema: []byte(schema)}}}
+		if err := opts.validateValidators(); err == nil {
+			t.Errorf("schema %s refers to remote resources and should be rejected", schema)
+		}
+
+		if err := opts.validateValue("foo", []byte(`"foo"`)); err == nil {
+			t.Errorf("values should not be validated against schema %s", schema)
+		}
+	}
+
+	if n := atomic.LoadInt32(&fetched); n > 0 {
+		t.Errorf("remote schemas should never be fetched, but got %d requests", n)
+	}
+
+	local := ConfigMapOptions{Validate: []ValueValidator{{Key: "*", Type: ValidateJSONSchema, Schema: []byte(
+		`{"$ref": "#/definitions/name", "definitions": {"name": {"type": "string"}}}`,
+	)}}}
+	if err := local.validateValidators(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := local.validateValue("foo", []byte("1")); err == nil {
+		t.Errorf("values should be validated against local references")
+	}
+}
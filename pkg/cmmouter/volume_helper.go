@@ -8,6 +8,7 @@ import (
 	"k8s.io/klog/v2"
 	"os"
 	"path/filepath"
+	"syscall"
 )
 
 type volumeHelper struct {
@@ -53,7 +54,7 @@ func (v volumeHelper) updateLocalVolume(
 			return
 		}
 
-		if err = ioutil.WriteFile(path, []byte(subContent), 0644); err != nil {
+		if err = metadata.writeKey(path, metadata.SubPath, subContent); err != nil {
 			klog.Errorf("unable to update volume %q: %s", path, err)
 			err = status.Error(codes.Aborted, err.Error())
 			return
@@ -63,24 +64,36 @@ func (v volumeHelper) updateLocalVolume(
 	}
 
 	klog.Infof("update volume directory %q", path)
-	if err = os.MkdirAll(path, 0755); err != nil {
+	if err = metadata.mkdir(path); err != nil {
 		klog.Errorf("unable to create dir %q: %s", path, err)
 		err = status.Error(codes.Aborted, err.Error())
 		return
 	}
 
-	for f, content := range cm.Data {
-		subpath := filepath.Join(path, f)
-		if err = ioutil.WriteFile(subpath, []byte(content), 0644); err != nil {
-			klog.Errorf("unable to update %q: %s", subpath, err)
-			err = status.Error(codes.Aborted, err.Error())
-			return
-		}
+	if metadata.Format != NoFormat {
+		err = v.updateFormattedFile(path, metadata, cm)
+		return
+	}
+
+	keyPaths, err := metadata.keyPaths(cm)
+	if err != nil {
+		klog.Errorf("unable to select keys of configmap %s/%s for volume %q: %s", metadata.ConfigMapNamespace,
+			metadata.ConfigMapName, volumeID, err)
+		return
 	}
 
-	for f, content := range cm.BinaryData {
+	for k, f := range keyPaths {
+		content, _ := readDataFromConfigMap(cm, k)
 		subpath := filepath.Join(path, f)
-		if err = ioutil.WriteFile(subpath, content, 0644); err != nil {
+		if dir := filepath.Dir(subpath); dir != path {
+			if err = metadata.mkdir(dir); err != nil {
+				klog.Errorf("unable to create dir %q: %s", dir, err)
+				err = status.Error(codes.Aborted, err.Error())
+				return
+			}
+		}
+
+		if err = metadata.writeKey(subpath, k, content); err != nil {
 			klog.Errorf("unable to update %q: %s", subpath, err)
 			err = status.Error(codes.Aborted, err.Error())
 			return
@@ -90,57 +103,154 @@ func (v volumeHelper) updateLocalVolume(
 	return
 }
 
-func (v volumeHelper) readLocalVolume(volumeID string, metadata *volumeMetadata) map[string][]byte {
+// updateFormattedFile serializes selected values of Data into a single file in the format. BinaryData is ignored.
+func (v volumeHelper) updateFormattedFile(path string, metadata *volumeMetadata, cm *corev1.ConfigMap) error {
+	data := make(map[string]string, len(cm.Data))
+	for k, v := range cm.Data {
+		if metadata.filterKey(k) {
+			data[k] = v
+		}
+	}
+
+	content, err := encodeData(metadata.Format, data)
+	if err != nil {
+		klog.Errorf("unable to encode configmap %s/%s in %q: %s", cm.Namespace, cm.Name, metadata.Format, err)
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	filePath := filepath.Join(path, metadata.formatFileName())
+	if err = metadata.writeKey(filePath, "", content); err != nil {
+		klog.Errorf("unable to update %q: %s", filePath, err)
+		return status.Error(codes.Aborted, err.Error())
+	}
+
+	return nil
+}
+
+// readFormattedFile parses the file in the format back to values of keys.
+func (v volumeHelper) readFormattedFile(path string, metadata *volumeMetadata) (map[string][]byte, error) {
+	filePath := filepath.Join(path, metadata.formatFileName())
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		klog.Errorf("unable to read local volume %q: %s", filePath, err)
+		if os.IsNotExist(err) {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	values, err := decodeData(metadata.Format, content)
+	if err != nil {
+		klog.Errorf("unable to parse %q in %q: %s", filePath, metadata.Format, err)
+		return nil, status.Errorf(codes.InvalidArgument, "unable to parse %q: %s", metadata.formatFileName(), err)
+	}
+
+	data := make(map[string][]byte, len(values))
+	for k, v := range values {
+		if metadata.filterKey(k) {
+			data[k] = []byte(v)
+		}
+	}
+
+	return data, nil
+}
+
+// writeKey writes the file of the key and then applies its mode and owner even if it exists.
+func (m *volumeMetadata) writeKey(path, key string, content []byte) error {
+	mode := m.fileMode(key)
+	if err := ioutil.WriteFile(path, content, mode); err != nil {
+		return err
+	}
+
+	return m.applyOwnership(path, mode)
+}
+
+// mkdir creates the directory if not exists and then applies its mode and owner.
+func (m *volumeMetadata) mkdir(path string) error {
+	if err := os.MkdirAll(path, defaultDirMode); err != nil {
+		return err
+	}
+
+	return m.applyOwnership(path, m.dirMode())
+}
+
+func (v volumeHelper) readLocalVolume(volumeID string, metadata *volumeMetadata) (map[string][]byte, error) {
 	path := filepath.Join(v.volumeRoot, volumeID)
 	fi, err := os.Lstat(path)
 	if err != nil {
 		klog.Errorf("unable to fetch local volume %q: %s", path, err)
-		return nil
+		if os.IsNotExist(err) {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
 	if fi.IsDir() {
 		if len(metadata.SubPath) > 0 {
-			klog.Fatalf("volume %q should be a file with respect to subPath %q", path, metadata.SubPath)
+			klog.Errorf("volume %q should be a file with respect to subPath %q", path, metadata.SubPath)
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %q should be a file with respect to subPath %q",
+				volumeID, metadata.SubPath)
+		}
+
+		if metadata.Format != NoFormat {
+			return v.readFormattedFile(path, metadata)
 		}
 
 		fis, err := ioutil.ReadDir(path)
 		if err != nil {
 			klog.Errorf("unable to list local volume %q: %s", path, err)
-			return nil
+			return nil, status.Error(codes.Internal, err.Error())
 		}
 
 		if len(fis) == 0 {
 			klog.Warningf("no files found in local volume %q", path)
-			return nil
+			return nil, nil
 		}
 
-		data := make(map[string][]byte, len(fis))
+		files := make([]string, 0, len(fis))
 		for _, fi := range fis {
-			pathi := filepath.Join(path, fi.Name())
+			if fi.Mode().IsRegular() {
+				files = append(files, fi.Name())
+			}
+		}
+
+		keyPaths := metadata.localKeyPaths(files)
+		data := make(map[string][]byte, len(keyPaths))
+		for k, f := range keyPaths {
+			pathi := filepath.Join(path, f)
 			bytes, err := ioutil.ReadFile(pathi)
 			if err != nil {
+				if os.IsNotExist(err) {
+					klog.Warningf("file %q of key %q is removed from local volume", pathi, k)
+					continue
+				}
+
 				klog.Errorf("unable to read local volume %q: %s", pathi, err)
-				return nil
+				return nil, status.Error(codes.Internal, err.Error())
 			}
 
-			data[fi.Name()] = bytes
+			data[k] = bytes
 		}
 
-		return data
+		return data, nil
+	}
+
+	if len(metadata.SubPath) == 0 {
+		klog.Errorf("volume %q should be a directory with respect to configmap %s/%s", path,
+			metadata.ConfigMapNamespace, metadata.ConfigMapName)
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %q should be a directory with respect to configmap %s/%s",
+			volumeID, metadata.ConfigMapNamespace, metadata.ConfigMapName)
 	}
 
 	bytes, err := ioutil.ReadFile(path)
 	if err != nil {
 		klog.Errorf("unable to read local volume %q: %s", path, err)
-		return nil
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	if len(metadata.SubPath) == 0 {
-		klog.Fatalf("volume %q should be a file with respect to any subPath of configmap %s/%s", path,
-			metadata.ConfigMapNamespace, metadata.ConfigMapName)
-	}
-
-	return map[string][]byte{metadata.SubPath: bytes}
+	return map[string][]byte{metadata.SubPath: bytes}, nil
 }
 
 func (v volumeHelper) deleteVolume(volumeID string) error {
@@ -152,3 +262,37 @@ func (v volumeHelper) deleteVolume(volumeID string) error {
 	}
 	return err
 }
+
+// usageOf returns the usage of the volume and capacity of the filesystem it resides.
+func (v volumeHelper) usageOf(volumeID string) (*VolumeStats, error) {
+	path := filepath.Join(v.volumeRoot, volumeID)
+	fs := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &fs); err != nil {
+		klog.Errorf("unable to stat filesystem of %q: %s", path, err)
+		return nil, err
+	}
+
+	stats := &VolumeStats{
+		TotalBytes:      int64(fs.Blocks) * int64(fs.Bsize),
+		AvailableBytes:  int64(fs.Bavail) * int64(fs.Bsize),
+		TotalInodes:     int64(fs.Files),
+		AvailableInodes: int64(fs.Ffree),
+	}
+
+	err := filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		stats.UsedBytes += fi.Size()
+		stats.UsedInodes++
+		return nil
+	})
+
+	if err != nil {
+		klog.Errorf("unable to walk through volume %q: %s", path, err)
+		return nil, err
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,41 @@
+package cmmouter
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadLocalVolumeMismatchedType(t *testing.T) {
+	root, err := ioutil.TempDir("", "cm-volume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err = os.Mkdir(filepath.Join(root, "dir-vol"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(root, "file-vol"), []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	helper := volumeHelper{volumeRoot: root}
+	if _, err = helper.readLocalVolume("dir-vol", &volumeMetadata{
+		ConfigMapOptions: ConfigMapOptions{SubPath: "foo.txt"},
+	}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expect FailedPrecondition, but got %v", err)
+	}
+
+	if _, err = helper.readLocalVolume("file-vol", &volumeMetadata{}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expect FailedPrecondition, but got %v", err)
+	}
+
+	if _, err = helper.readLocalVolume("missing-vol", &volumeMetadata{}); status.Code(err) != codes.NotFound {
+		t.Errorf("expect NotFound, but got %v", err)
+	}
+}
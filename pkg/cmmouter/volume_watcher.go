@@ -4,26 +4,32 @@ import (
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 	"k8s.io/utils/inotify"
+	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 )
 
-func createVolumeWatcherMap(volRoot string, volGuard *sync.Mutex, handleChange volumeModifiedHandle) *volumeWatcherMap {
+func createVolumeWatcherMap(
+	volRoot string, volGuard *sync.Mutex, handleChange volumeModifiedHandle,
+) (*volumeWatcherMap, error) {
 	volMap := &volumeWatcherMap{
 		volumeRoot:   volRoot,
 		volGuard:     volGuard,
-		watcherMap:   make(map[string]struct{}),
+		watcherMap:   make(map[string]bool),
+		subDirs:      make(map[string][]string),
 		handleChange: handleChange,
+		stopCh:       make(chan struct{}),
 	}
 
 	var err error
 	volMap.fsWatcher, err = inotify.NewWatcher()
 	if err != nil {
-		klog.Fatal(err)
+		return nil, err
 	}
 
 	volMap.wg.Start(volMap.evLoop)
-	return volMap
+	return volMap, nil
 }
 
 type volumeModifiedHandle func(volumeKey string)
@@ -31,20 +37,25 @@ type volumeModifiedHandle func(volumeKey string)
 type volumeWatcherMap struct {
 	volumeRoot string
 	volGuard   *sync.Mutex
-	// mapping save volumeKeys
-	watcherMap   map[string]struct{}
+	// mapping from volumeKeys to whether they are directories
+	watcherMap map[string]bool
+	// mapping from volumeKeys of dir volumes to their watched subdirectories, created by items mapping keys to
+	// nested paths
+	subDirs      map[string][]string
 	handleChange volumeModifiedHandle
 
 	fsWatcher *inotify.Watcher
 	wg        wait.Group
+	stopCh    chan struct{}
 }
 
 func (m *volumeWatcherMap) watchVolume(volumeID string, dir bool) (err error) {
 	if _, found := m.watcherMap[volumeID]; found {
-		panic(volumeID)
+		klog.Warningf("volume %q is already in the inotify list", volumeID)
+		return nil
 	}
 
-	m.watcherMap[volumeID] = struct{}{}
+	m.watcherMap[volumeID] = dir
 	defer func() {
 		if err != nil {
 			delete(m.watcherMap, volumeID)
@@ -53,7 +64,7 @@ func (m *volumeWatcherMap) watchVolume(volumeID string, dir bool) (err error) {
 
 	if !dir {
 		klog.Infof("volume %q is watching the volume root", volumeID)
-		if len(m.watcherMap) == 1 {
+		if m.countFileVolumes() == 1 {
 			klog.Infof("start inotify on the volume root %q", m.volumeRoot)
 			if err = m.fsWatcher.Watch(m.volumeRoot); err != nil {
 				klog.Errorf("unable to watch %q: %s", m.volumeRoot, err)
@@ -71,27 +82,73 @@ func (m *volumeWatcherMap) watchVolume(volumeID string, dir bool) (err error) {
 		return
 	}
 
+	err = filepath.Walk(path, func(subDir string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() || subDir == path {
+			return err
+		}
+
+		klog.Infof("volume %q is watching subdirectory %q", volumeID, subDir)
+		if err = m.fsWatcher.Watch(subDir); err != nil {
+			klog.Errorf("unable to watch %q: %s", subDir, err)
+			return err
+		}
+
+		m.subDirs[volumeID] = append(m.subDirs[volumeID], subDir)
+		return nil
+	})
+
+	if err != nil {
+		m.removeDirWatches(volumeID)
+	}
+
+	return
+}
+
+// removeDirWatches removes watches on the dir volume and its subdirectories.
+func (m *volumeWatcherMap) removeDirWatches(volumeID string) (err error) {
+	for _, subDir := range m.subDirs[volumeID] {
+		if e := m.fsWatcher.RemoveWatch(subDir); e != nil {
+			klog.Errorf("unable to remove inotify on %q: %s", subDir, e)
+		}
+	}
+
+	delete(m.subDirs, volumeID)
+	path := filepath.Join(m.volumeRoot, volumeID)
+	if err = m.fsWatcher.RemoveWatch(path); err != nil {
+		klog.Errorf("unable to remove inotify on %q: %s", path, err)
+	}
+
+	return
+}
+
+// countFileVolumes returns the number of file volumes which share the watch on the volume root.
+func (m *volumeWatcherMap) countFileVolumes() (n int) {
+	for _, dir := range m.watcherMap {
+		if !dir {
+			n++
+		}
+	}
+
 	return
 }
 
 func (m *volumeWatcherMap) unwatchVolume(volumeID string, dir bool) error {
-	if _, found := m.watcherMap[volumeID]; !found {
+	watchedDir, found := m.watcherMap[volumeID]
+	if !found {
 		klog.Infof("volume %q is not found in the inotify list", volumeID)
 		return nil
 	}
 
+	// Callers may not know the type of ambiguous volumes.
+	dir = watchedDir
+
 	klog.Infof("remove inotify watch for volume %q", volumeID)
 	delete(m.watcherMap, volumeID)
 	if dir {
-		path := filepath.Join(m.volumeRoot, volumeID)
-		err := m.fsWatcher.RemoveWatch(path)
-		if err != nil {
-			klog.Errorf("unable to remove inotify on %q: %s", path, err)
-		}
-		return err
+		return m.removeDirWatches(volumeID)
 	}
 
-	if len(m.watcherMap) == 0 {
+	if m.countFileVolumes() == 0 {
 		klog.Infof("remove inotify on the volume root %q", m.volumeRoot)
 		err := m.fsWatcher.RemoveWatch(m.volumeRoot)
 		if err != nil {
@@ -107,6 +164,8 @@ func (m *volumeWatcherMap) unwatchVolume(volumeID string, dir bool) error {
 func (m *volumeWatcherMap) evLoop() {
 	for {
 		select {
+		case <-m.stopCh:
+			return
 		case event, ok := <-m.fsWatcher.Event:
 			if !ok {
 				return
@@ -118,27 +177,30 @@ func (m *volumeWatcherMap) evLoop() {
 			}
 
 			klog.Infof("fs event: %#v", event)
-			if len(event.Name) < len(m.volumeRoot) {
-				panic(event.Name)
+			if len(event.Name) <= len(m.volumeRoot) {
+				klog.Warningf("ignore event %s out of the volume root", event)
+				break
 			}
 
 			if event.Mask&inotify.InCloseWrite != inotify.InCloseWrite {
 				klog.V(1).Infof("ignore event %s", event)
+				inotifyEventsTotal.WithLabelValues(inotifyIgnored).Inc()
 				break
 			}
 
-			dir, file := filepath.Split(event.Name[len(m.volumeRoot)+1:])
-			var volumeID string
-			if len(dir) == 0 {
-				volumeID = file
-			} else {
-				volumeID = dir[:len(dir)-1]
+			// Files of dir volumes may be saved in subdirectories.
+			volumeID := event.Name[len(m.volumeRoot)+1:]
+			if i := strings.IndexRune(volumeID, filepath.Separator); i >= 0 {
+				volumeID = volumeID[:i]
 			}
 
 			klog.Infof("fs events of volume %q", volumeID)
 			m.volGuard.Lock()
 			if _, found := m.watcherMap[volumeID]; found {
+				inotifyEventsTotal.WithLabelValues(inotifyHandled).Inc()
 				m.handleChange(volumeID)
+			} else {
+				inotifyEventsTotal.WithLabelValues(inotifyIgnored).Inc()
 			}
 			m.volGuard.Unlock()
 
@@ -151,7 +213,10 @@ func (m *volumeWatcherMap) evLoop() {
 	}
 }
 
+// stop closes the inotify watcher and waits for the event handler in progress.
 func (m *volumeWatcherMap) stop() {
+	// The event channel isn't closed until the next inotify event arrives. Quit the event loop explicitly.
+	close(m.stopCh)
 	m.fsWatcher.Close()
 	m.wg.Wait()
 }
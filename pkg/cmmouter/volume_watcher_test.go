@@ -0,0 +1,72 @@
+package cmmouter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVolumeWatcherMixedVolumes(t *testing.T) {
+	root, err := ioutil.TempDir("", "volume-watcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err = os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(chan string, 16)
+	var guard sync.Mutex
+	watcher, err := createVolumeWatcherMap(root, &guard, func(volumeID string) { changed <- volumeID })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.stop()
+
+	expectChange := func(volumeID, path string) {
+		if err := ioutil.WriteFile(filepath.Join(root, path), []byte("foo"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case id := <-changed:
+			if id != volumeID {
+				t.Fatalf("expect changes of volume %q, but got %q", volumeID, id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("changes of volume %q are not observed", volumeID)
+		}
+	}
+
+	guard.Lock()
+	// A dir volume is watched before the first file volume, which must still watch the volume root.
+	if err = watcher.watchVolume("dir", true); err != nil {
+		t.Fatal(err)
+	}
+	if err = watcher.watchVolume("file", false); err != nil {
+		t.Fatal(err)
+	}
+	guard.Unlock()
+
+	expectChange("file", "file")
+	expectChange("dir", "dir/foo")
+
+	guard.Lock()
+	// Unwatching the dir volume as a file volume must neither leak its watch nor remove the one on the volume root.
+	if err = watcher.unwatchVolume("dir", false); err != nil {
+		t.Fatal(err)
+	}
+	n := watcher.countFileVolumes()
+	guard.Unlock()
+
+	if n != 1 {
+		t.Fatalf("expect 1 file volume, but got %d", n)
+	}
+
+	expectChange("file", "file")
+}
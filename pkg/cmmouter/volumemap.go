@@ -8,37 +8,70 @@ import (
 	"google.golang.org/grpc/status"
 	"io/ioutil"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
 	"k8s.io/klog/v2"
+	"k8s.io/utils/mount"
 	"os"
 	"path/filepath"
 	"sort"
 	"sync"
+	"time"
 )
 
-func createVolumeMap(clientset *kubernetes.Clientset, sourceRoot string) *volumeMap {
+func createVolumeMap(
+	clientset kubernetes.Interface, mounter mount.Interface, recorder record.EventRecorder, opts MounterOptions,
+) (*volumeMap, error) {
+	sourceRoot := opts.SourceRoot
 	volRoot := filepath.Join(sourceRoot, "volumes")
-	metaRoot := filepath.Join(sourceRoot, "metadata")
-	for _, dir := range []string{volRoot, metaRoot} {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			klog.Fatalf("unable to mkdir %q: %s", dir, err)
-		}
+	if err := os.MkdirAll(volRoot, 0755); err != nil {
+		return nil, xerrors.Errorf("unable to mkdir %q: %w", volRoot, err)
+	}
+
+	store, err := openStateStore(sourceRoot)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to open the state store in %q: %w", sourceRoot, err)
 	}
 
 	volMap := &volumeMap{
-		clientset:      clientset,
-		volumeRoot:     volRoot,
-		metaRoot:       metaRoot,
-		metadataMap:    make(map[string]*volumeMetadata),
-		volumeHelper:   volumeHelper{volumeRoot: volRoot},
-		metadataHelper: metadataHelper{metaRoot: metaRoot},
+		clientset:        clientset,
+		mounter:          mounter,
+		recorder:         recorder,
+		volumeRoot:       volRoot,
+		authorizeMounts:  opts.AuthorizeMounts,
+		node:             opts.Node,
+		templateEnv:      templateEnvOf(opts.TemplateEnv),
+		metadataMap:      make(map[string]*volumeMetadata),
+		pendingRefreshes: make(map[string]*pendingRefresh),
+		drifts:           make(map[string][]string),
+		volumeHelper:     volumeHelper{volumeRoot: volRoot},
+		stateStore:       store,
+		gc: garbageCollector{
+			interval:    opts.GCInterval,
+			gracePeriod: opts.GCGracePeriod,
+			dryRun:      opts.GCDryRun,
+			staleSince:  make(map[string]time.Time),
+			stopCh:      make(chan struct{}),
+		},
+		podIdentityHelper: podIdentityHelper{
+			tokenRoot:  filepath.Join(sourceRoot, "tokens"),
+			baseConfig: opts.Config,
+			clients:    make(map[string]kubernetes.Interface),
+		},
 	}
 
-	volMap.cmWatcher = createCMWatcherMap(clientset, &volMap.volGuard, volMap.updateLocalFs)
-	volMap.volWatcher = createVolumeWatcherMap(volRoot, &volMap.volGuard, volMap.commitLocalChanges)
-	return volMap
+	volMap.cmWatcher = createCMWatcherMap(store, &volMap.volGuard, volMap.updateLocalFs,
+		volMap.handleWatchLost)
+	if volMap.volWatcher, err = createVolumeWatcherMap(volRoot, &volMap.volGuard, volMap.handleLocalChanges); err != nil {
+		store.close()
+		return nil, xerrors.Errorf("unable to create the inotify watcher: %w", err)
+	}
+
+	return volMap, nil
 }
 
 type volumeMetadata struct {
@@ -46,35 +79,60 @@ type volumeMetadata struct {
 	ConfigMapName      string `json:"configMapName"`
 	ConfigMapNamespace string `json:"configMapNamespace"`
 	TargetPath         string `json:"targetPath"`
-	Pod                string `json:"pod"`
-	PodNamespace       string `json:"podNamespace"`
+	PodInfo            `json:",inline"`
 	ResourceVersion    string `json:"resourceVersion"`
+	// Immutable ConfigMaps are never watched.
+	Immutable bool `json:"immutable,omitempty"`
+	// Reference is the pointer ConfigMap or the label selector the volume follows.
+	Reference string `json:"reference,omitempty"`
 }
 
 type volumeMap struct {
 	volumeHelper
-	metadataHelper
+	*stateStore
+	podIdentityHelper
 
-	clientset  *kubernetes.Clientset
+	clientset  kubernetes.Interface
+	mounter    mount.Interface
+	recorder   record.EventRecorder
 	volumeRoot string
-	metaRoot   string
+
+	// whether to review access of pods to ConfigMaps before mounting them
+	authorizeMounts bool
+
+	node        string
+	templateEnv map[string]string
 
 	volGuard sync.Mutex
 
 	// mapping from volumeKey to volumeMetadata
 	metadataMap map[string]*volumeMetadata
 
+	// refreshes held back by rollout policies
+	pendingRefreshes map[string]*pendingRefresh
+
+	// mapping from volumeKey to keys drifting from the ConfigMap
+	drifts map[string][]string
+
 	cmWatcher  *configMapWatcherMap
 	volWatcher *volumeWatcherMap
+	gc         garbageCollector
+
+	// HTTP notifications in flight
+	notifications wait.Group
+
+	// set once the volumeMap is stopped. No volumes can be mounted or unmounted since then.
+	stopped bool
 }
 
-func (m *volumeMap) buildOrDie() {
+// build restores volumes from the local filesystem and the state store.
+func (m *volumeMap) build() error {
 	m.volGuard.Lock()
 	defer m.volGuard.Unlock()
 
 	fis, err := ioutil.ReadDir(m.volumeRoot)
 	if err != nil {
-		klog.Fatalf("unable to read volumes from %q: %s", m.volumeRoot, err)
+		return xerrors.Errorf("unable to read volumes from %q: %w", m.volumeRoot, err)
 	}
 
 	ctx := context.TODO()
@@ -82,65 +140,101 @@ func (m *volumeMap) buildOrDie() {
 		volumeID := fi.Name()
 		metadata, err := m.loadMetadata(volumeID)
 		if err != nil {
-			m.cleanAmbiguousVolume(volumeID, "", "")
+			m.cleanAmbiguousVolume(volumeID, nil)
 			continue
 		}
 
 		if err := checkPod(ctx, m.clientset, metadata.Pod, metadata.PodNamespace); err != nil {
-			m.cleanAmbiguousVolume(volumeID, "", "")
+			// The volume can't be unmounted again if its pod is gone. Commit local changes before removing it,
+			// just like unmountVolume does.
+			if metadata.CommitChangesOn == CommitOnUnmount {
+				klog.Infof("pod of volume %q is gone. commit local changes before removing the volume", volumeID)
+				m.commitLocalVolumeChanges(ctx, volumeID, metadata)
+			}
+
+			m.cleanAmbiguousVolume(volumeID, nil)
 			continue
 		}
 
 		m.metadataMap[volumeID] = metadata
 
 		if err = m.watchVolume(volumeID, metadata); err != nil {
-			m.cleanAmbiguousVolume(volumeID, metadata.ConfigMapName, metadata.ConfigMapNamespace)
+			m.cleanAmbiguousVolume(volumeID, metadata)
 			continue
 		}
 	}
 
 	// clean dangling metadata
-	metadatafis, err := ioutil.ReadDir(m.metaRoot)
+	volumeKeys, err := m.listVolumes()
 	if err != nil {
-		klog.Fatalf("unable to read metadata from %q: %s", m.metaRoot, err)
+		return xerrors.Errorf("unable to read metadata from the state store: %w", err)
 	}
 
-	for _, fi := range metadatafis {
-		_, err := os.Lstat(filepath.Join(m.volumeRoot, fi.Name()))
+	for _, volumeID := range volumeKeys {
+		_, err := os.Lstat(filepath.Join(m.volumeRoot, volumeID))
 		if err == nil {
 			continue
 		}
 
 		if !os.IsNotExist(err) {
-			klog.Fatalf("unable to access volume %q: %s", fi.Name(), err)
+			return xerrors.Errorf("unable to access volume %q: %w", volumeID, err)
 		}
 
-		m.deleteMetadata(fi.Name())
+		m.deleteMetadata(volumeID)
 	}
+
+	m.resumeInterruptedWork(ctx)
+	return nil
 }
 
 func (m *volumeMap) watchVolume(volumeID string, metadata *volumeMetadata) error {
-	if metadata.KeepCurrentAlways {
+	if metadata.ConfigMapRef != NoRef {
+		// watch the reference and switch local volumes to new targets
+		clientset, err := m.clientsetOf(volumeID, metadata)
+		if err != nil {
+			return err
+		}
+
+		if err = m.cmWatcher.watchRef(volumeID, watcherKeyOf(volumeID, metadata), metadata.ConfigMapRef,
+			metadata.Reference, metadata.ConfigMapNamespace, clientset); err != nil {
+			return err
+		}
+	} else if metadata.KeepCurrentAlways && !metadata.Immutable {
 		// watch changes on the configmap and update local volumes
-		if err := m.cmWatcher.watchCM(volumeID, metadata.ConfigMapName, metadata.ConfigMapNamespace); err != nil {
+		clientset, err := m.clientsetOf(volumeID, metadata)
+		if err != nil {
+			return err
+		}
+
+		if err = m.cmWatcher.watchCM(volumeID, watcherKeyOf(volumeID, metadata), metadata.ConfigMapName,
+			metadata.ConfigMapNamespace, clientset); err != nil {
 			return err
 		}
 	}
 
-	if metadata.CommitChangesOn == CommitOnModify {
+	switch metadata.CommitChangesOn {
+	case CommitOnModify:
 		klog.Infof("local modification of volume %q is going to sync to configmap %s/%s", volumeID,
 			metadata.ConfigMapNamespace, metadata.ConfigMapName)
-		if err := m.volWatcher.watchVolume(volumeID, len(metadata.SubPath) == 0); err != nil {
-			return err
+	case NoCommit:
+		if metadata.ReadOnly == ReadOnlyAlways {
+			// Pods can't modify read-only volumes.
+			return nil
 		}
+
+		klog.Infof("local drift of volume %q from configmap %s/%s is going to be detected", volumeID,
+			metadata.ConfigMapNamespace, metadata.ConfigMapName)
+	default:
+		return nil
 	}
 
-	return nil
+	return m.volWatcher.watchVolume(volumeID, len(metadata.SubPath) == 0)
 }
 
-func checkPod(ctx context.Context, clientset *kubernetes.Clientset, podName, podNS string) error {
+func checkPod(ctx context.Context, clientset kubernetes.Interface, podName, podNS string) error {
 	_, err := clientset.CoreV1().Pods(podNS).Get(ctx, podName, metav1.GetOptions{})
 	if err != nil {
+		recordAPIError("pods", "get")
 		klog.Errorf("unable to fetch pod %s/%s: %s", podNS, podName, err)
 		return err
 	}
@@ -148,59 +242,127 @@ func checkPod(ctx context.Context, clientset *kubernetes.Clientset, podName, pod
 	return nil
 }
 
-func (m *volumeMap) cleanAmbiguousVolume(volumeID, cmName, cmNamespace string) {
+func (m *volumeMap) cleanAmbiguousVolume(volumeID string, metadata *volumeMetadata) {
 	klog.Errorf(">> clear ambiguous resource of volume %q. errors can be ignored", volumeID)
 	defer func() {
 		klog.Errorf("<< volume %q is removed", volumeID)
 	}()
 
 	delete(m.metadataMap, volumeID)
-	if len(cmName) > 0 {
-		m.cmWatcher.unwatchCM(volumeID, cmName, cmNamespace)
+	if metadata != nil {
+		m.cmWatcher.unwatchCM(volumeID, watcherKeyOf(volumeID, metadata))
 	}
 
 	m.volWatcher.unwatchVolume(volumeID, true)
 	m.deleteMetadata(volumeID)
 	m.deleteVolume(volumeID)
+	m.deleteToken(volumeID)
 }
 
 func (m *volumeMap) prepareVolume(
-	ctx context.Context, volumeID, targetPath, cmName, cmNamespace, pod, podNs string, opts ConfigMapOptions,
+	ctx context.Context, volumeID, targetPath, cmName, cmNamespace string, pod PodInfo, opts ConfigMapOptions,
 ) (sourcePath string, err error) {
-	cm, err := m.clientset.CoreV1().ConfigMaps(cmNamespace).Get(ctx, cmName, metav1.GetOptions{})
+	metadata := &volumeMetadata{
+		ConfigMapOptions:   opts,
+		ConfigMapName:      cmName,
+		ConfigMapNamespace: cmNamespace,
+		TargetPath:         targetPath,
+		PodInfo:            pod,
+	}
+
+	if opts.UsePodIdentity {
+		if err = m.saveToken(volumeID, pod.Token); err != nil {
+			return
+		}
+
+		defer func() {
+			if err != nil {
+				m.deleteToken(volumeID)
+			}
+		}()
+	}
+
+	clientset, err := m.clientsetOf(volumeID, metadata)
 	if err != nil {
+		return
+	}
+
+	var cm *corev1.ConfigMap
+	if opts.ConfigMapRef != NoRef {
+		metadata.Reference = cmName
+		if cm, err = targetOf(ctx, clientset, opts.ConfigMapRef, cmName, cmNamespace); err != nil {
+			return
+		}
+
+		metadata.ConfigMapName = cm.Name
+	} else if cm, err = clientset.CoreV1().ConfigMaps(cmNamespace).Get(ctx, cmName, metav1.GetOptions{}); err != nil {
+		recordAPIError("configmaps", "get")
 		klog.Errorf("unable to fetch configmap %s/%s: %s", cmNamespace, cmName, err)
 		err = status.Error(codes.Unavailable, err.Error())
 		return
 	}
 
+	if err = metadata.checkImmutable(cm); err != nil {
+		return
+	}
+
+	if err = m.authorizeMount(ctx, cm, &metadata.PodInfo, &opts); err != nil {
+		return
+	}
+
+	if m.authorizeMounts && opts.ConfigMapRef != NoRef {
+		if err = m.authorizeRef(ctx, metadata); err != nil {
+			return
+		}
+	}
+
+	if cm, err = mergeShards(ctx, clientset, cm); err != nil {
+		return
+	}
+
+	snapshotConfigMap(ctx, clientset, cm, retainedRevisionsOf(cm, 0), nil)
+	if opts.pinned() {
+		if cm, err = pinnedConfigMap(ctx, clientset, cm, &opts); err != nil {
+			return
+		}
+	}
+
+	if cm, err = m.renderConfigMap(ctx, metadata, cm); err != nil {
+		return
+	}
+
+	if err = metadata.checkNotifyPaths(cm); err != nil {
+		return
+	}
+
 	m.volGuard.Lock()
 	defer m.volGuard.Unlock()
 
+	if m.stopped {
+		err = errShuttingDown
+		return
+	}
+
 	defer func() {
 		if err != nil {
-			m.cleanAmbiguousVolume(volumeID, cmName, cmNamespace)
+			m.cleanAmbiguousVolume(volumeID, metadata)
 		}
 	}()
 
-	metadata := &volumeMetadata{
-		ConfigMapOptions:   opts,
-		ConfigMapName:      cmName,
-		ConfigMapNamespace: cmNamespace,
-		TargetPath:         targetPath,
-		Pod:                pod,
-		PodNamespace:       podNs,
-	}
-
 	// write local filesystem
 	if sourcePath, _, err = m.updateLocalVolume(volumeID, metadata, cm); err != nil {
 		return
 	}
 
+	if err = m.prepareNotifications(volumeID, metadata); err != nil {
+		return
+	}
+
 	if err = m.persistentMetadata(volumeID, metadata); err != nil {
 		return
 	}
 
+	m.persistentDigests(volumeID, digestsOfVolume(metadata, cm))
 	m.metadataMap[volumeID] = metadata
 	if err = m.watchVolume(volumeID, metadata); err != nil {
 		return
@@ -214,33 +376,59 @@ func (m *volumeMap) unmountVolume(ctx context.Context, volumeID string) (err err
 	m.volGuard.Lock()
 	defer m.volGuard.Unlock()
 
+	if m.stopped {
+		return errShuttingDown
+	}
+
 	metadata := m.metadataMap[volumeID]
 	if metadata == nil {
-		klog.Fatalf("volume %q is not found. maybe unmounted twice", volumeID)
+		// The volume may be unmounted twice or cleaned as an ambiguous volume. Clean leftovers if any.
+		klog.Warningf("volume %q is not found. maybe unmounted twice", volumeID)
+		m.volWatcher.unwatchVolume(volumeID, true)
+		m.deleteMetadata(volumeID)
+		m.deleteToken(volumeID)
+		if err = m.deleteVolume(volumeID); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
 	}
 
 	delete(m.metadataMap, volumeID)
+	if err = m.releaseVolume(ctx, volumeID, metadata); err != nil {
+		return err
+	}
 
-	if metadata.KeepCurrentAlways {
-		m.cmWatcher.unwatchCM(volumeID, metadata.ConfigMapName, metadata.ConfigMapNamespace)
+	klog.Infof("volume %q is unmounted", volumeID)
+	return nil
+}
+
+// releaseVolume stops watching the volume, commits local changes if required, then removes the volume and its state.
+func (m *volumeMap) releaseVolume(ctx context.Context, volumeID string, metadata *volumeMetadata) error {
+	// get volGuard locked in callers
+	if metadata.KeepCurrentAlways || metadata.ConfigMapRef != NoRef {
+		m.cmWatcher.unwatchCM(volumeID, watcherKeyOf(volumeID, metadata))
+		m.cancelPendingRefresh(volumeID)
 	}
 
 	switch metadata.CommitChangesOn {
-	case CommitOnModify:
+	case CommitOnModify, NoCommit:
 		m.volWatcher.unwatchVolume(volumeID, len(metadata.SubPath) == 0)
+		m.clearDrift(volumeID)
 	case CommitOnUnmount:
-		m.commitLocalVolumeChanges(volumeID, metadata)
+		// Local changes are given up if they can't be committed. Otherwise, the volume would never be unmounted.
+		m.commitLocalVolumeChanges(ctx, volumeID, metadata)
 	}
 
-	if err = m.deleteMetadata(volumeID); err != nil {
-		return err
+	if err := m.deleteMetadata(volumeID); err != nil {
+		return status.Error(codes.Internal, err.Error())
 	}
 
-	if err = m.deleteVolume(volumeID); err != nil {
-		return err
+	if err := m.deleteVolume(volumeID); err != nil {
+		return status.Error(codes.Internal, err.Error())
 	}
 
-	klog.Infof("volume %q is unmounted", volumeID)
+	m.deleteToken(volumeID)
 	return nil
 }
 
@@ -252,17 +440,82 @@ func (m *volumeMap) updateLocalFs(volumeID string, cm *corev1.ConfigMap) {
 		return
 	}
 
+	if metadata.ConfigMapRef != NoRef {
+		m.followRef(context.TODO(), volumeID, metadata)
+		return
+	}
+
+	if m.rollbackConfigMap(context.TODO(), volumeID, metadata, cm) {
+		// volumes are refreshed after the ConfigMap is rolled back
+		return
+	}
+
+	if m.deferRefresh(volumeID, metadata, cm) {
+		return
+	}
+
+	m.refreshVolume(volumeID, metadata, cm)
+}
+
+// refreshVolume updates the local volume to the ConfigMap.
+func (m *volumeMap) refreshVolume(volumeID string, metadata *volumeMetadata, cm *corev1.ConfigMap) {
+	// get volGuard locked in callers
+	start := time.Now()
+	if cm.ResourceVersion != metadata.ResourceVersion {
+		clientset, err := m.clientsetOf(volumeID, metadata)
+		if err == nil {
+			if cm, err = mergeShards(context.TODO(), clientset, cm); err == nil {
+				snapshotConfigMap(context.TODO(), clientset, cm, retainedRevisionsOf(cm, 0), nil)
+			}
+		}
+
+		if err != nil {
+			klog.Errorf("unable to fetch shards of configmap for volume %q: %s", volumeID, err)
+			return
+		}
+	}
+
+	if metadata.Render != NoRender && cm.ResourceVersion != metadata.ResourceVersion {
+		var err error
+		if cm, err = m.renderConfigMap(context.TODO(), metadata, cm); err != nil {
+			klog.Errorf("unable to render configmap for volume %q: %s", volumeID, err)
+			return
+		}
+	}
+
 	_, updateMetadata, err := m.updateLocalVolume(volumeID, metadata, cm)
 	if err == nil && updateMetadata {
+		refreshDuration.WithLabelValues(metadata.ConfigMapNamespace, metadata.ConfigMapName).
+			Observe(time.Since(start).Seconds())
+		m.recordPodEvent(metadata, corev1.EventTypeNormal, reasonRefreshed,
+			"volume %q is refreshed to ResourceVersion %s of configmap %s/%s", volumeID, cm.ResourceVersion,
+			metadata.ConfigMapNamespace, metadata.ConfigMapName)
 		// Ignore the metadata persistent error since that the volume files are up-to-date even the ResourceVersion
 		// in the metadata doesn't.
 		m.persistentMetadata(volumeID, metadata)
+		m.persistentDigests(volumeID, digestsOfVolume(metadata, cm))
+		m.notifyRefresh(volumeID, metadata)
 	}
 
 	return
 }
 
-func (m *volumeMap) commitLocalChanges(volumeID string) {
+func (m *volumeMap) handleWatchLost(volumeID string, reason error) {
+	// get volGuard locked in callers
+	metadata := m.metadataMap[volumeID]
+	if metadata == nil {
+		return
+	}
+
+	m.recordPodEvent(metadata, corev1.EventTypeWarning, reasonConfigMapWatchLost,
+		"volume %q stops getting updates of configmap %s/%s: %s", volumeID, metadata.ConfigMapNamespace,
+		metadata.ConfigMapName, reason)
+}
+
+// handleLocalChanges commits local changes of the volume, or checks its drift if commits are disabled. Events of
+// writes of the driver itself, such as refreshes and restorations, are ignored since the volume then matches the
+// content digests saved along with the writes.
+func (m *volumeMap) handleLocalChanges(volumeID string) {
 	// get volGuard locked in callers
 	metadata := m.metadataMap[volumeID]
 	if metadata == nil {
@@ -270,54 +523,102 @@ func (m *volumeMap) commitLocalChanges(volumeID string) {
 		return
 	}
 
-	m.commitLocalVolumeChanges(volumeID, metadata)
+	// Volumes drifting before must be checked again to clear the drift.
+	if _, drifting := m.drifts[volumeID]; !drifting && !m.locallyModified(volumeID, metadata) {
+		klog.V(1).Infof("volume %q is not modified. ignore the event", volumeID)
+		return
+	}
+
+	if metadata.CommitChangesOn == NoCommit {
+		m.checkDrift(volumeID, metadata)
+		return
+	}
+
+	m.commitLocalVolumeChanges(context.TODO(), volumeID, metadata)
 }
 
 const configMapSizeHardLimit = 1 << 20
 
-func (m *volumeMap) commitLocalVolumeChanges(volumeID string, metadata *volumeMetadata) {
-	volData := m.readLocalVolume(volumeID, metadata)
+// commitLocalVolumeChanges commits local changes of the volume to the ConfigMap. Retries on conflicts stop once ctx is
+// done, in which case Unavailable is returned.
+func (m *volumeMap) commitLocalVolumeChanges(ctx context.Context, volumeID string, metadata *volumeMetadata) error {
+	volData, err := m.readLocalVolume(volumeID, metadata)
+	if err != nil {
+		klog.Errorf("unable to commit changes of volume %q: %s", volumeID, err)
+		return err
+	}
+
 	if len(volData) == 0 {
-		return
+		return nil
 	}
 
-	cli := m.clientset.CoreV1().ConfigMaps(metadata.ConfigMapNamespace)
+	clientset, err := m.clientsetOf(volumeID, metadata)
+	if err != nil {
+		klog.Errorf("unable to commit changes of volume %q: %s", volumeID, err)
+		return err
+	}
 
-	err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
-		cm, err := cli.Get(context.TODO(), metadata.ConfigMapName, metav1.GetOptions{})
+	cli := clientset.CoreV1().ConfigMaps(metadata.ConfigMapNamespace)
+
+	var committedKeys []string
+	var binary *binaryCommit
+	result := commitResultFailed
+	err = retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		// RetryOnConflict doesn't know the deadline.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		cm, err := cli.Get(ctx, metadata.ConfigMapName, metav1.GetOptions{})
 		if err != nil {
+			recordAPIError("configmaps", "get")
 			return err
 		}
 
-		if cm.ResourceVersion != metadata.ResourceVersion {
+		conflicted := cm.ResourceVersion != metadata.ResourceVersion
+		if isImmutable(cm) {
+			if len(metadata.VersionPointer) == 0 {
+				klog.Errorf("configmap %s/%s is immutable. local changes of volume %q are rejected",
+					metadata.ConfigMapNamespace, metadata.ConfigMapName, volumeID)
+				result = commitResultRejected
+				return status.Errorf(codes.FailedPrecondition, "configmap %s/%s is immutable",
+					metadata.ConfigMapNamespace, metadata.ConfigMapName)
+			}
+
+			// Versions never change. Other versions committed since then conflict with local changes.
+			if conflicted, err = versionConflicted(ctx, clientset, metadata); err != nil {
+				return err
+			}
+		}
+
+		if conflicted {
+			conflictsTotal.WithLabelValues(metadata.ConfigMapNamespace, metadata.ConfigMapName,
+				string(metadata.ConflictPolicy)).Inc()
 			if metadata.ConflictPolicy == DiscardLocalChanges {
 				klog.Errorf("remote configmap %s/%s is updated. discard local changes according to the policy",
 					metadata.ConfigMapName, metadata.ConfigMapNamespace)
+				m.recordEvent(metadata, corev1.EventTypeWarning, reasonConflictDiscard,
+					"local changes of volume %q are discarded since configmap %s/%s is updated remotely", volumeID,
+					metadata.ConfigMapNamespace, metadata.ConfigMapName)
+				result = commitResultDiscarded
 				return nil
 			}
 		}
 
-		originalSize := 0
-		totalSize := 0
-		volBinaries := make(map[string][]byte, len(cm.BinaryData))
-
-		cmBinaries := make(map[string][]byte, len(cm.BinaryData))
-		for k, v := range cm.BinaryData {
-			// Users can only update existed values.
-			originalSize += len(v)
+		base := cm.DeepCopy()
+		shards, err := shardsOf(cm)
+		if err != nil {
+			return err
+		}
 
-			if newV, found := volData[k]; found {
-				totalSize += len(newV)
-				cmBinaries[k] = newV
-				volBinaries[k] = newV
-				delete(volData, k)
-			} else {
-				totalSize += len(v)
-				cmBinaries[k] = v
-			}
+		merged, err := mergeShards(ctx, clientset, cm)
+		if err != nil {
+			return err
 		}
 
-		binarySizeDelta := totalSize - originalSize
+		committedKeys = committedKeys[:0]
+		originalSize := 0
+		totalSize := 0
 
 		cmData := make(map[string]string, len(cm.Data))
 		for k, v := range cm.Data {
@@ -325,6 +626,7 @@ func (m *volumeMap) commitLocalVolumeChanges(volumeID string, metadata *volumeMe
 			originalSize += len(v)
 
 			if newV, found := volData[k]; found {
+				committedKeys = append(committedKeys, k)
 				totalSize += len(newV)
 				cmData[k] = string(newV)
 			} else {
@@ -333,51 +635,188 @@ func (m *volumeMap) commitLocalVolumeChanges(volumeID string, metadata *volumeMe
 			}
 		}
 
-		if binarySizeDelta + originalSize > configMapSizeHardLimit {
+		// Text changes are committed as long as the original text and the new BinaryData fit.
+		binary = commitBinaryData(merged.BinaryData, volData, shards, originalSize, metadata.BinaryOversizePolicy)
+		if binary.size+originalSize > configMapSizeHardLimit {
 			klog.Errorf("total binary size of volume %q is over the 1MB limit. Give up.", volumeID)
 			return xerrors.New("total binary size is over the 1MB limit. Give up.")
 		}
 
-		cm.BinaryData = cmBinaries
-		originalSize+=binarySizeDelta
+		committedKeys = append(committedKeys, binary.keys...)
+		cm.BinaryData = binary.data
+		originalSize += binary.size
+		totalSize += binary.size
 
 		if totalSize > configMapSizeHardLimit {
 			klog.Warningf("total size of updated configmap is over the 1MB limit. apply %q policy",
 				metadata.OversizePolicy)
 
-			applyOversizePolicy(cm.Data, volData, originalSize, metadata.OversizePolicy)
+			if err := applyOversizePolicy(cm.Data, volData, originalSize, metadata.OversizePolicy); err != nil {
+				return err
+			}
+
+			truncated := 0
+			for k, v := range volData {
+				if newV, found := cm.Data[k]; found && len(v) > len(newV) {
+					truncated += len(v) - len(newV)
+				}
+			}
+
+			truncatedBytesTotal.WithLabelValues(metadata.ConfigMapNamespace, metadata.ConfigMapName,
+				string(metadata.OversizePolicy)).Add(float64(truncated))
+			m.recordEvent(metadata, corev1.EventTypeWarning, reasonTruncated,
+				"%d bytes of volume %q are truncated according to the oversize policy %q", truncated, volumeID,
+				metadata.OversizePolicy)
 		} else {
 			cm.Data = cmData
 		}
 
-		if cm, err = cli.Update(context.TODO(), cm, metav1.UpdateOptions{}); err != nil {
-			klog.Errorf("unable to update configmap for volume %q(size:%d): %s", volumeID, totalSize, err)
+		committed := binary.withShards(cm)
+		for _, k := range committedKeys {
+			value, _ := readDataFromConfigMap(committed, k)
+			if err := metadata.validateValue(k, value); err != nil {
+				klog.Errorf("local changes of volume %q are rejected: %s", volumeID, err)
+				m.recordEvent(metadata, corev1.EventTypeWarning, reasonValidationFailed,
+					"local changes of volume %q are rejected: %s", volumeID, err)
+				result = commitResultRejected
+				return err
+			}
+		}
+
+		if equalData(cm.Data, base.Data) && !binary.changed(base, shards) {
+			// Local files are identical to the ConfigMap, e.g. they are rewritten with the same content.
+			klog.Infof("volume %q doesn't change configmap %s/%s. skip the commit", volumeID,
+				metadata.ConfigMapNamespace, metadata.ConfigMapName)
+			result = commitResultUnchanged
+			metadata.ResourceVersion = cm.ResourceVersion
+			m.persistentMetadata(volumeID, metadata)
+			m.persistentDigests(volumeID, digestsOfVolume(metadata, binary.withShards(cm)))
+			m.reportDroppedKeys(volumeID, metadata, binary.withShards(cm), binary.dropped)
+			return nil
+		}
+
+		if err = binary.saveShards(ctx, clientset, cm, shards); err != nil {
 			return err
 		}
 
+		author := map[string]string{
+			annotationAuthorPod:    metadata.PodNamespace + "/" + metadata.Pod,
+			annotationAuthorVolume: volumeID,
+			annotationAuthorNode:   m.node,
+		}
+
+		if isImmutable(base) {
+			// Versions are revisions by themselves. No snapshots are needed.
+			if cm, err = commitNewVersion(ctx, clientset, metadata, cm, author); err != nil {
+				return err
+			}
+
+			metadata.ConfigMapName = cm.Name
+		} else {
+			if cm, err = cli.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+				recordAPIError("configmaps", "update")
+				klog.Errorf("unable to update configmap for volume %q(size:%d): %s", volumeID, totalSize, err)
+				if !errors.IsTimeout(err) && !errors.IsServerTimeout(err) {
+					// The update is known to be not applied. Shards created for it are never referred.
+					binary.rollbackShards(ctx, clientset, metadata.ConfigMapNamespace)
+				}
+				return err
+			}
+
+			// Keep both revisions before and after the commit so that it can be rolled back. Shards replaced by the
+			// commit are deleted unless the snapshots refer to them.
+			retained := retainedRevisionsOf(cm, metadata.RetainRevisions)
+			snapshotConfigMap(ctx, clientset, merged, retained, nil)
+			snapshotConfigMap(ctx, clientset, binary.withShards(cm), retained, author)
+			releaseShards(ctx, clientset, cm, binary.staleShards)
+		}
+
 		metadata.ResourceVersion = cm.ResourceVersion
 		m.persistentMetadata(volumeID, metadata)
+		m.persistentDigests(volumeID, digestsOfVolume(metadata, binary.withShards(cm)))
+		m.appendHistory(cmKeyOf(metadata.ConfigMapName, metadata.ConfigMapNamespace), &commitRecord{
+			Volume:          volumeID,
+			Pod:             metadata.Pod,
+			PodNamespace:    metadata.PodNamespace,
+			ResourceVersion: cm.ResourceVersion,
+			Keys:            committedKeys,
+			Time:            time.Now(),
+		})
+		result = commitResultCommitted
+		m.recordEvent(metadata, corev1.EventTypeNormal, reasonCommitted,
+			"local changes of volume %q are committed to configmap %s/%s as ResourceVersion %s", volumeID,
+			metadata.ConfigMapNamespace, metadata.ConfigMapName, cm.ResourceVersion)
 		klog.Infof("volume %q committed", volumeID)
+		m.reportDroppedKeys(volumeID, metadata, binary.withShards(cm), binary.dropped)
 		return nil
 	})
 
-	if err != nil {
+	commitAttemptsTotal.WithLabelValues(metadata.ConfigMapNamespace, metadata.ConfigMapName, result).Inc()
+	if err != nil && result != commitResultRejected {
 		klog.Errorf("unable to udpate configmap %s/%s: %s", metadata.ConfigMapNamespace, metadata.ConfigMapName,
 			err)
+		m.recordEvent(metadata, corev1.EventTypeWarning, reasonCommitFailed,
+			"unable to commit local changes of volume %q: %s", volumeID, err)
+		if _, ok := status.FromError(err); !ok {
+			err = status.Error(codes.Unavailable, err.Error())
+		}
 	}
+
+	return err
+}
+
+func cmKeyOf(cm, ns string) string {
+	return cm + "~" + ns
+}
+
+// equalData checks whether two Data maps have the same content. A nil map equals an empty one.
+func equalData(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if bv, found := b[k]; !found || bv != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// digestsOfVolume returns digests of the ConfigMap content materialized in the volume.
+func digestsOfVolume(metadata *volumeMetadata, cm *corev1.ConfigMap) contentDigests {
+	if len(metadata.SubPath) > 0 {
+		content, _ := readDataFromConfigMap(cm, metadata.SubPath)
+		return contentDigests{metadata.SubPath: digestOf(content)}
+	}
+
+	keyPaths, _ := metadata.keyPaths(cm)
+	digests := make(contentDigests, len(keyPaths))
+	for k := range keyPaths {
+		if _, found := cm.Data[k]; !found && metadata.Format != NoFormat {
+			// BinaryData isn't saved in formatted files
+			continue
+		}
+
+		content, _ := readDataFromConfigMap(cm, k)
+		digests[k] = digestOf(content)
+	}
+
+	return digests
 }
 
 type mapIO struct {
-	Key            string
-	Write          func(key string, data []byte)
-	Read           func(key string) []byte
-	ReadVolume     func(key string) []byte
+	Key        string
+	Write      func(key string, data []byte)
+	Read       func(key string) []byte
+	ReadVolume func(key string) []byte
 }
 
 func applyOversizePolicy(
 	cmData map[string]string, volData map[string][]byte, originalSize int,
 	policy ConfigMapOversizePolicy,
-) {
+) error {
 	fileSizeDelta := make(map[string]int, len(volData))
 	dataWriter := func(key string, data []byte) { cmData[key] = string(data) }
 	dataReader := func(key string) []byte { return []byte(cmData[key]) }
@@ -398,7 +837,8 @@ func applyOversizePolicy(
 	freeSize := configMapSizeHardLimit - originalSize
 	for _, delta := range deltaOrder {
 		if freeSize < 0 {
-			klog.Fatalf("deltaOrder: %#v, k: %s, volData: %#v", deltaOrder, delta.Key, volData)
+			klog.Errorf("deltaOrder: %#v, k: %s, freeSize: %d", deltaOrder, delta.Key, freeSize)
+			return status.Errorf(codes.Internal, "no free space left while committing %q", delta.Key)
 		}
 
 		if fileSizeDelta[delta.Key] <= freeSize {
@@ -411,7 +851,8 @@ func applyOversizePolicy(
 		maxDataSize := len(origin) + freeSize
 		v := delta.ReadVolume(delta.Key)
 		if len(v) <= maxDataSize {
-			klog.Fatalf("k: %s, v: %s, maxDataSize: %d", delta.Key, v, maxDataSize)
+			klog.Errorf("k: %s, size: %d, maxDataSize: %d", delta.Key, len(v), maxDataSize)
+			return status.Errorf(codes.Internal, "%q needn't be truncated", delta.Key)
 		}
 
 		klog.V(5).Infof("k: %s, freeSize: %d, maxDataSize: %d", delta.Key, freeSize, maxDataSize)
@@ -454,9 +895,11 @@ func applyOversizePolicy(
 
 			delta.Write(delta.Key, v[:dataEnd])
 		default:
-			panic(policy)
+			return status.Errorf(codes.InvalidArgument, "unknown oversizePolicy %q", policy)
 		}
 
 		break
 	}
+
+	return nil
 }
@@ -8,6 +8,7 @@ kubectl delete ns foo bar
 set -e
 echo "Installing the CSI driver..."
 kubectl apply -f ../install/csi-driver-cm.yaml
+kubectl apply -f ../install/csi-driver-cm-writer.yaml
 
 echo "Creating namespace foo and bar"
 kubectl create --dry-run=client -oyaml ns foo | kubectl apply --wait -f -
@@ -24,6 +25,16 @@ kubectl -n foo create --dry-run=client -oyaml configmap cm-complicated \
 echo "Creating configmap bar/cm-bar"
 kubectl -n bar create --dry-run=client -oyaml configmap cm-bar --from-file=foo.txt --from-file=bar.txt | kubectl apply --wait -f -
 
+echo "Sharing configmap bar/cm-bar with namespace foo"
+kubectl -n bar annotate --overwrite configmap cm-bar csi-cm.warm-metal.tech/shared-with=foo
+
+echo "Granting pods in namespace foo access to configmaps they mount"
+for ns in foo bar; do
+  kubectl -n $ns create --dry-run=client -oyaml role configmap-volumes --verb=get,update --resource=configmaps | kubectl apply -f -
+  kubectl -n $ns create --dry-run=client -oyaml rolebinding configmap-volumes --role=configmap-volumes \
+    --serviceaccount=foo:default | kubectl apply -f -
+done
+
 for i in 0*.sh; do
   if [[ "${CASE}" != "" ]]; then
     if [[ "${CASE}" == "$i" ]]; then